@@ -7,16 +7,47 @@ import (
 	"strings"
 
 	"github.com/ofek/csi-gcs/pkg/driver"
+	"github.com/ofek/csi-gcs/pkg/util"
 	"k8s.io/klog"
 )
 
 var (
-	version            = "development"
-	nodeNameFlag       = flag.String("node-name", "", "Node identifier")
-	driverNameFlag     = flag.String("driver-name", driver.CSIDriverName, "CSI driver name")
-	endpointFlag       = flag.String("csi-endpoint", "unix:///csi/csi.sock", "CSI endpoint")
-	versionFlag        = flag.Bool("version", false, "Print the version and exit")
-	deleteOrphanedPods = flag.Bool("delete-orphaned-pods", false, "Delete Orphaned Pods on StartUp")
+	version               = "development"
+	nodeNameFlag          = flag.String("node-name", "", "Node identifier")
+	driverNameFlag        = flag.String("driver-name", driver.CSIDriverName, "CSI driver name")
+	endpointFlag          = flag.String("csi-endpoint", "unix:///csi/csi.sock", "CSI endpoint")
+	socketMode            = flag.String("csi-endpoint-mode", "", "Octal permissions of the CSI socket e.g. 0660, empty leaves them to the umask")
+	socketOwner           = flag.String("csi-endpoint-owner", "", "Numeric UID or UID:GID to own the CSI socket e.g. 0:1000, empty leaves it to the user of the driver")
+	versionFlag           = flag.Bool("version", false, "Print the version and exit")
+	deleteOrphanedPods    = flag.Bool("delete-orphaned-pods", false, "Delete Orphaned Pods on StartUp")
+	orphanReapInterval    = flag.Duration("orphan-reap-interval", 0, "How often to unmount gcsfuse mounts whose pod is gone, 0 disables it")
+	healthAddress         = flag.String("health-address", "", "Address to serve /healthz and /readyz on, empty disables it")
+	metricsAddress        = flag.String("metrics-address", "", "Address to serve Prometheus metrics of mounts on /metrics, empty disables it")
+	readinessBucket       = flag.String("readiness-bucket", "", "Bucket whose metadata /readyz fetches, defaults to any mounted bucket")
+	selfTestBucket        = flag.String("self-test-bucket", "", "Bucket to write, read and delete an object in on start, failing readiness if that does not work")
+	snapshotBucket        = flag.String("snapshot-bucket", "", "Bucket to copy volumes to when snapshotting, unless the VolumeSnapshotClass sets snapshotBucket")
+	gcsEndpoint           = flag.String("gcs-endpoint", "", "Host to reach GCS at instead of storage.googleapis.com e.g. restricted.googleapis.com")
+	storageEmulatorHost   = flag.String("storage-emulator-host", "", "Host of a GCS emulator to use instead of GCS, for testing only")
+	components            = flag.String("components", driver.ComponentAll, "Comma-separated CSI services to serve: controller, node or all")
+	topology              = flag.Bool("topology", false, "Report the zone of nodes from the GCE metadata server and restrict volumes to the location of their bucket")
+	podOwnership          = flag.Bool("pod-ownership", false, "Make the user and fsGroup of pods own the files of their volumes with no access for others, unless uid, gid or modes are set")
+	authFileRoot          = flag.String("auth-file-root", "", "Directory of key files, e.g. projected by a secrets operator, that volumes may name with authFile, empty disables authFile")
+	stateStoragePath      = flag.String("state-storage-path", driver.StateStoragePath, "Directory on the host to keep track of mounts in across restarts, empty keeps them in memory only")
+	keyStoragePath        = flag.String("key-storage-path", driver.KeyStoragePath, "Directory to write the keys of Secrets to for gcsfuse, e.g. a memory backed emptyDir")
+	gcsfusePath           = flag.String("gcsfuse-path", "gcsfuse", "Path to the gcsfuse binary, which must be called gcsfuse")
+	logFormat             = flag.String("log-format", "text", "Log format, either text or json")
+	mountRetryTimeout     = flag.Duration("mount-retry-timeout", driver.DefaultMountRetryTimeout, "How long to retry transient mount errors, 0 disables retries")
+	gcsDialTimeout        = flag.Duration("gcs-dial-timeout", driver.DefaultGCSDialTimeout, "How long connecting to GCS may take, 0 means no limit")
+	gcsRequestTimeout     = flag.Duration("gcs-request-timeout", driver.DefaultGCSRequestTimeout, "How long a single request to GCS may take, 0 means no limit")
+	gcsRetryTimeout       = flag.Duration("gcs-retry-timeout", driver.DefaultGCSRetryTimeout, "How long to retry failed requests to GCS when provisioning, 0 means until the call's deadline")
+	gcsfuseLogs           = flag.Bool("gcsfuse-logs", true, "Stream the logs of every gcsfuse process into ours, tagged with the volume and target")
+	stageVolumes          = flag.Bool("stage-volumes", false, "Mount every bucket once per node and bind mount it into pods, node publish secrets are not used then")
+	unmountGracePeriod    = flag.Duration("unmount-grace-period", driver.DefaultUnmountGracePeriod, "How long gcsfuse may take to exit after unmounting before it is killed")
+	mountFailureThreshold = flag.Int("mount-failure-threshold", driver.DefaultMountFailureThreshold, "How many times in a row a volume may fail to mount the same way before it is not mounted for the cooldown, 0 disables it")
+	mountFailureCooldown  = flag.Duration("mount-failure-cooldown", driver.DefaultMountFailureCooldown, "How long volumes that keep failing to mount are not mounted, unless their options or secrets change")
+	volumeStatsInterval   = flag.Duration("volume-stats-interval", 0, "How often to count the objects and bytes of mounted volumes for their stats, 0 reports what gcsfuse does")
+	volumeStatsMaxObjects = flag.Int64("volume-stats-max-objects", driver.DefaultVolumeStatsMaxObjects, "How many objects of a volume to count at most for its stats, 0 means no limit")
+	maxConcurrentMounts   = flag.Int("max-concurrent-mounts", driver.DefaultMaxConcurrentMounts, "How many volumes may be mounted at the same time, 0 means no limit")
 )
 
 func main() {
@@ -25,6 +56,18 @@ func main() {
 	setEnvVarFlags()
 	flag.Parse()
 
+	switch *logFormat {
+	case "text":
+	case "json":
+		if err := util.EnableJSONLogging(os.Stderr); err != nil {
+			klog.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		klog.Errorf("Unknown log format: %s", *logFormat)
+		os.Exit(1)
+	}
+
 	if *versionFlag {
 		versionJSON, err := driver.GetVersionJSON()
 		if err != nil {
@@ -35,7 +78,50 @@ func main() {
 		os.Exit(0)
 	}
 
-	d, err := driver.NewGCSDriver(*driverNameFlag, *nodeNameFlag, *endpointFlag, version, *deleteOrphanedPods)
+	// Needs no cluster, so it is handled before anything else is set up
+	if flag.Arg(0) == "validate" {
+		if !validateStorageClass(os.Stdin, os.Stdout, *driverNameFlag) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	d, err := driver.NewGCSDriver(driver.Config{
+		Name:                  *driverNameFlag,
+		NodeName:              *nodeNameFlag,
+		Endpoint:              *endpointFlag,
+		SocketMode:            *socketMode,
+		SocketOwner:           *socketOwner,
+		Version:               version,
+		Components:            *components,
+		DeleteOrphanedPods:    *deleteOrphanedPods,
+		OrphanReapInterval:    *orphanReapInterval,
+		HealthAddress:         *healthAddress,
+		MetricsAddress:        *metricsAddress,
+		ReadinessBucket:       *readinessBucket,
+		SelfTestBucket:        *selfTestBucket,
+		SnapshotBucket:        *snapshotBucket,
+		GCSEndpoint:           *gcsEndpoint,
+		StorageEmulatorHost:   *storageEmulatorHost,
+		Topology:              *topology,
+		PodOwnership:          *podOwnership,
+		AuthFileRoot:          *authFileRoot,
+		StateStoragePath:      *stateStoragePath,
+		KeyStoragePath:        *keyStoragePath,
+		GcsfusePath:           *gcsfusePath,
+		GcsfuseLogs:           *gcsfuseLogs,
+		StageVolumes:          *stageVolumes,
+		MountRetryTimeout:     *mountRetryTimeout,
+		GCSDialTimeout:        *gcsDialTimeout,
+		GCSRequestTimeout:     *gcsRequestTimeout,
+		GCSRetryTimeout:       *gcsRetryTimeout,
+		UnmountGracePeriod:    *unmountGracePeriod,
+		MountFailureThreshold: *mountFailureThreshold,
+		MountFailureCooldown:  *mountFailureCooldown,
+		VolumeStatsInterval:   *volumeStatsInterval,
+		VolumeStatsMaxObjects: *volumeStatsMaxObjects,
+		MaxConcurrentMounts:   *maxConcurrentMounts,
+	})
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)
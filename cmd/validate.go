@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ofek/csi-gcs/pkg/driver"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Reads a StorageClass from input and reports its problems to output, returning whether it is valid
+func validateStorageClass(input io.Reader, output io.Writer, driverName string) bool {
+	var storageClass storagev1.StorageClass
+	if err := yaml.NewYAMLOrJSONDecoder(input, 4096).Decode(&storageClass); err != nil {
+		fmt.Fprintf(output, "Could not read StorageClass: %v\n", err)
+		return false
+	}
+
+	problems := driver.ValidateStorageClass(storageClass.Parameters, storageClass.MountOptions)
+	if storageClass.Kind != "StorageClass" {
+		problems = append([]error{fmt.Errorf("kind is %q, not StorageClass", storageClass.Kind)}, problems...)
+	}
+	if storageClass.Provisioner != driverName {
+		problems = append([]error{fmt.Errorf("provisioner is %q, not %s", storageClass.Provisioner, driverName)}, problems...)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(output, "StorageClass %s: %v\n", storageClass.Name, problem)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+
+	fmt.Fprintf(output, "StorageClass %s is valid\n", storageClass.Name)
+	return true
+}
@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Stops mounting volumes that keep failing the same way for a while, as kubelet retries them forever and every
+// attempt starts gcsfuse only for it to fail again. The zero value is ready to use.
+type mountBreakers struct {
+	mu      sync.Mutex
+	volumes map[string]*mountBreaker
+}
+
+type mountBreaker struct {
+	// Fingerprint of the options and secrets the failures happened with
+	config    string
+	failures  int
+	lastErr   error
+	openUntil time.Time
+}
+
+// Returns the last error of the volume while its breaker is open, a changed config closes it
+func (b *mountBreakers) Check(volumeID string, config string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, found := b.volumes[volumeID]
+	if !found {
+		return nil
+	}
+	if breaker.config != config {
+		delete(b.volumes, volumeID)
+		return nil
+	}
+	if time.Now().Before(breaker.openUntil) {
+		st := status.Convert(breaker.lastErr)
+		return status.Errorf(st.Code(), "Not mounting volume %s until %s after %d failures in a row, the last one: %s", volumeID, breaker.openUntil.Format(time.RFC3339), breaker.failures, st.Message())
+	}
+	return nil
+}
+
+// Counts consecutive permanent failures with the same code and opens the breaker of the volume for the cooldown once
+// there are threshold of them, a threshold of 0 never opens it. Successes and any other errors start over.
+func (b *mountBreakers) Record(volumeID string, config string, err error, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || threshold <= 0 || !isPermanentMountFailure(err) {
+		delete(b.volumes, volumeID)
+		return
+	}
+
+	breaker, found := b.volumes[volumeID]
+	if !found || breaker.config != config || status.Code(breaker.lastErr) != status.Code(err) {
+		breaker = &mountBreaker{config: config}
+		if b.volumes == nil {
+			b.volumes = map[string]*mountBreaker{}
+		}
+		b.volumes[volumeID] = breaker
+	}
+	breaker.failures++
+	breaker.lastErr = err
+
+	// Once the cooldown has passed a single attempt is let through, failing again opens the breaker right away
+	if breaker.failures >= threshold {
+		breaker.openUntil = time.Now().Add(cooldown)
+		klog.Warningf("Volume %s failed to mount %d times in a row, not mounting it for %s: %v", volumeID, breaker.failures, cooldown, err)
+	}
+}
+
+// Running out of time or mount slots says nothing about the volume
+func isPermanentMountFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Canceled, codes.ResourceExhausted, codes.Unavailable:
+		return false
+	}
+	return !isTransientMountError(err)
+}
+
+// Identifies what a volume is mounted with, without keeping any secrets around
+func mountConfig(options map[string]string, secrets map[string]string) string {
+	hash := sha256.New()
+	for _, values := range []map[string]string{options, secrets} {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(hash, "%q=%q\n", key, values[key])
+		}
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
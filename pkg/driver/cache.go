@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"k8s.io/klog"
+)
+
+// Every mount has its own cache so gcsfuse processes never share one. A cacheDir is a symlink at the same
+// place pointing into that directory, so unpublishing finds the cache without knowing the volume's flags.
+func (driver *GCSDriver) mountCachePath(targetPath string) string {
+	hash := sha256.Sum256([]byte(targetPath))
+	return filepath.Join(driver.cacheRootPath, hex.EncodeToString(hash[:]))
+}
+
+// Creates the file cache of a mount and returns the gcsfuse options using it, or nothing if caching is not enabled
+func (driver *GCSDriver) prepareCache(targetPath string, options map[string]string) ([]string, error) {
+	cacheDir, cacheDirFound := options[flags.FLAG_CACHE_DIR]
+	maxSizeMB, maxSizeFound := options[flags.FLAG_CACHE_MAX_SIZE_MB]
+	if !cacheDirFound && !maxSizeFound {
+		return nil, nil
+	}
+	if !maxSizeFound {
+		maxSizeMB = strconv.Itoa(DefaultCacheMaxSizeMB)
+	}
+
+	mountCachePath := driver.mountCachePath(targetPath)
+	cachePath := mountCachePath
+	if cacheDirFound {
+		cachePath = filepath.Join(driver.cacheRootPath, cacheDir, filepath.Base(mountCachePath))
+		// Flags are validated already, this guards against anything slipping through
+		if !driver.isWithinCacheRoot(cachePath) {
+			return nil, fmt.Errorf("%s must be within %s, got: %s", flags.FLAG_CACHE_DIR, driver.cacheRootPath, cacheDir)
+		}
+	}
+
+	if err := os.MkdirAll(cachePath, 0700); err != nil {
+		return nil, err
+	}
+	if cachePath != mountCachePath {
+		if err := os.Symlink(cachePath, mountCachePath); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	return []string{"cache_dir=" + cachePath, "file_cache_max_size_mb=" + maxSizeMB}, nil
+}
+
+// Removes the file cache of a mount, if any
+func (driver *GCSDriver) cleanupCache(targetPath string) {
+	mountCachePath := driver.mountCachePath(targetPath)
+
+	info, err := os.Lstat(mountCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Could not inspect cache %s: %v", mountCachePath, err)
+		}
+		return
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		cachePath, err := os.Readlink(mountCachePath)
+		if err != nil {
+			klog.Warningf("Could not resolve cache %s: %v", mountCachePath, err)
+		} else if !driver.isWithinCacheRoot(cachePath) {
+			klog.Warningf("Not removing cache %s since it is outside of %s", cachePath, driver.cacheRootPath)
+		} else if err := os.RemoveAll(cachePath); err != nil {
+			klog.Warningf("Could not remove cache %s: %v", cachePath, err)
+		}
+	}
+
+	if err := os.RemoveAll(mountCachePath); err != nil {
+		klog.Warningf("Could not remove cache %s: %v", mountCachePath, err)
+	}
+}
+
+func (driver *GCSDriver) isWithinCacheRoot(path string) bool {
+	relativePath, err := filepath.Rel(driver.cacheRootPath, filepath.Clean(path))
+	return err == nil && relativePath != "." && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	var (
+		d         *GCSDriver
+		cacheRoot string
+	)
+
+	BeforeEach(func() {
+		var err error
+		cacheRoot, err = ioutil.TempDir("", "csi-gcs-cache")
+		Expect(err).NotTo(HaveOccurred())
+
+		d = &GCSDriver{cacheRootPath: cacheRoot}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cacheRoot)
+	})
+
+	Describe("prepareCache", func() {
+		It("Should Not Cache By Default", func() {
+			Expect(d.prepareCache("/target", map[string]string{})).To(BeEmpty())
+		})
+		It("Should Default To A Directory Per Mount", func() {
+			options, err := d.prepareCache("/target", map[string]string{"cacheMaxSizeMb": "512"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(Equal([]string{"cache_dir=" + d.mountCachePath("/target"), "file_cache_max_size_mb=512"}))
+			Expect(d.mountCachePath("/target")).To(BeADirectory())
+			Expect(d.mountCachePath("/other")).NotTo(Equal(d.mountCachePath("/target")))
+		})
+		It("Should Limit The Size Of Custom Directories", func() {
+			options, err := d.prepareCache("/target", map[string]string{"cacheDir": "ssd"})
+			Expect(err).NotTo(HaveOccurred())
+
+			cachePath := filepath.Join(cacheRoot, "ssd", filepath.Base(d.mountCachePath("/target")))
+			Expect(options).To(Equal([]string{"cache_dir=" + cachePath, "file_cache_max_size_mb=1024"}))
+			Expect(cachePath).To(BeADirectory())
+		})
+		It("Should Stay Within The Cache Root", func() {
+			_, err := d.prepareCache("/target", map[string]string{"cacheDir": "../../etc"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("cleanupCache", func() {
+		It("Should Remove Default Directories", func() {
+			_, err := d.prepareCache("/target", map[string]string{"cacheMaxSizeMb": "512"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(d.mountCachePath("/target"), "object"), []byte("data"), 0600)).To(Succeed())
+
+			d.cleanupCache("/target")
+			Expect(d.mountCachePath("/target")).NotTo(BeAnExistingFile())
+		})
+		It("Should Remove Custom Directories", func() {
+			_, err := d.prepareCache("/target", map[string]string{"cacheDir": "ssd"})
+			Expect(err).NotTo(HaveOccurred())
+
+			d.cleanupCache("/target")
+			Expect(d.mountCachePath("/target")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheRoot, "ssd", filepath.Base(d.mountCachePath("/target")))).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheRoot, "ssd")).To(BeADirectory())
+		})
+		It("Should Tolerate Mounts Without A Cache", func() {
+			d.cleanupCache("/target")
+		})
+	})
+})
@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ComponentController = "controller"
+	ComponentNode       = "node"
+	// Both components, as deployed by default
+	ComponentAll = "all"
+)
+
+// The CSI services one driver process serves, the identity service is always served
+type components struct {
+	controller bool
+	node       bool
+}
+
+// Parses a comma-separated list of components e.g. controller,node
+func parseComponents(value string) (c components, err error) {
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case ComponentController:
+			c.controller = true
+		case ComponentNode:
+			c.node = true
+		case ComponentAll:
+			c.controller, c.node = true, true
+		default:
+			return components{}, fmt.Errorf("must be a comma-separated list of %s, %s or %s, got: %s", ComponentController, ComponentNode, ComponentAll, value)
+		}
+	}
+	return c, nil
+}
+
+func (c components) String() string {
+	var names []string
+	if c.controller {
+		names = append(names, ComponentController)
+	}
+	if c.node {
+		names = append(names, ComponentNode)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,34 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Components", func() {
+	It("Should Parse Lists Of Components", func() {
+		Expect(parseComponents("controller")).To(Equal(components{controller: true}))
+		Expect(parseComponents("node")).To(Equal(components{node: true}))
+		Expect(parseComponents("controller, node")).To(Equal(components{controller: true, node: true}))
+		Expect(parseComponents("all")).To(Equal(components{controller: true, node: true}))
+	})
+	It("Should Reject Unknown Components", func() {
+		for _, value := range []string{"", "webhook", "controller,"} {
+			_, err := parseComponents(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+	It("Should Only Advertise The Controller When Serving It", func() {
+		advertised := func(c components) int {
+			d := &GCSDriver{name: CSIDriverName, components: c}
+			resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			return len(resp.GetCapabilities())
+		}
+		Expect(advertised(components{controller: true, node: true})).To(Equal(1))
+		Expect(advertised(components{node: true})).To(Equal(0))
+	})
+})
@@ -1,10 +1,55 @@
 package driver
 
+import "time"
+
 const (
 	CSIDriverName   = "gcs.csi.ofek.dev"
 	BucketMountPath = "/var/lib/kubelet/pods"
 	KeyStoragePath  = "/tmp/keys"
+	CacheRootPath   = "/var/cache/csi-gcs"
+	LogStoragePath  = "/tmp/logs"
 	DefaultGid      = 63147
 	DefaultDirMode  = 0775
 	DefaultFileMode = 0664
+
+	// Within the host directory of the socket, so that it outlives the container
+	StateStoragePath = "/csi/state"
+
+	DefaultMountRetryTimeout  = 30 * time.Second
+	DefaultMountTimeout       = 60 * time.Second
+	DefaultCacheMaxSizeMB     = 1024
+	DefaultGCSDialTimeout     = 10 * time.Second
+	DefaultGCSRequestTimeout  = 30 * time.Second
+	DefaultGCSRetryTimeout    = 2 * time.Minute
+	DefaultUnmountGracePeriod = 30 * time.Second
+	// Where buckets are created unless a location is chosen or topology prefers another
+	DefaultLocation = "US"
+	// Every gcsfuse process takes tens of MiB while starting
+	DefaultMaxConcurrentMounts = 10
+	// Consecutive permanent failures after which a volume is not mounted for a while, as kubelet retries it forever
+	DefaultMountFailureThreshold = 5
+	DefaultMountFailureCooldown  = 5 * time.Minute
+	// Rotation of the dedicated gcsfuse log of a volume
+	DefaultLogRotateMaxFileSizeMB   = 10
+	DefaultLogRotateBackupFileCount = 5
+	// Listing this many objects takes 100 requests
+	DefaultVolumeStatsMaxObjects = 100000
+	// How often a supervised mount is remounted before it is reported as abnormal
+	MaxRemounts = 5
+	// How many random bucket names are tried before giving up
+	MaxBucketNameAttempts = 5
+
+	// The first release to support all flags we pass, e.g. billing_project
+	MinGcsfuseVersion = "0.28.0"
+	// The first release with the log_file option
+	MinGcsfuseLogFileVersion = "0.39.0"
+	// The first release with the anonymous_access option
+	MinGcsfuseAnonymousAccessVersion = "1.2.0"
+	// The first release whose key_file may be an external_account credential configuration
+	MinGcsfuseExternalAccountVersion = "1.0.0"
+	// The first release with the file cache, i.e. the cache_dir and file_cache_max_size_mb options
+	MinGcsfuseFileCacheVersion = "2.0.0"
+	// The first releases with the kernel_list_cache_ttl_secs and experimental_metadata_prefetch_on_mount options
+	MinGcsfuseKernelListCacheVersion  = "2.3.0"
+	MinGcsfuseMetadataPrefetchVersion = "2.3.0"
 )
@@ -3,6 +3,10 @@ package driver
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -10,15 +14,29 @@ import (
 	"github.com/ofek/csi-gcs/pkg/flags"
 	"github.com/ofek/csi-gcs/pkg/util"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
 )
 
-func (d *GCSDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (d *GCSDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (response *csi.CreateVolumeResponse, err error) {
 	klog.V(4).Infof("Method CreateVolume called with: %s", protosanitizer.StripSecrets(req))
 
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	// Filled in as the bucket and project become known
+	errorMetadata := map[string]string{ErrorMetadataVolume: req.Name}
+	defer func() {
+		if err != nil {
+			err = withErrorInfo(contextError(ctx, err), errorMetadata)
+			reportProvisioningFailure(req, err)
+		}
+	}()
+
 	if req.Name == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing name")
 	}
@@ -33,19 +51,9 @@ func (d *GCSDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 		return nil, status.Error(codes.InvalidArgument, "Only volumeMode Filesystem is supported")
 	}
 
-	// Default Options
-	var options = map[string]string{
-		"bucket":   util.BucketName(req.Name),
-		"location": "US",
-		"kmsKeyId": "",
-	}
-
-	// Merge Secret Options
-	options = flags.MergeSecret(options, req.Secrets)
-
-	// Merge MountFlag Options
-	for _, capability := range req.GetVolumeCapabilities() {
-		options = flags.MergeMountOptions(options, capability.GetMount().GetMountFlags())
+	// Restoring snapshots and cloning volumes would otherwise give an empty bucket
+	if req.VolumeContentSource != nil {
+		return nil, status.Error(codes.InvalidArgument, "Creating volumes from snapshots or other volumes is not supported")
 	}
 
 	// Merge PVC Annotation Options
@@ -62,54 +70,114 @@ func (d *GCSDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 
 		pvcAnnotations = loadedPvcAnnotations
 	}
-	options = flags.MergeAnnotations(options, pvcAnnotations)
 
-	// Merge Context
-	if req.Parameters != nil {
-		options = flags.MergeAnnotations(options, req.Parameters)
+	options, err := provisioningOptions(req.Name, req.Secrets, req.GetVolumeCapabilities(), req.Parameters, pvcAnnotations)
+	if err != nil {
+		return nil, err
 	}
-
-	var clientOpt option.ClientOption
-	if len(req.Secrets) == 0 {
-		// Find default credentials
-		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
-		if err != nil {
-			return nil, err
+	errorMetadata[ErrorMetadataBucket] = options[flags.FLAG_BUCKET]
+	errorMetadata[ErrorMetadataProject] = options[flags.FLAG_PROJECT_ID]
+
+	// New buckets go where the volume is preferably used from, unless a location was chosen
+	if _, found := options[flags.FLAG_LOCATION]; !found {
+		options[flags.FLAG_LOCATION] = DefaultLocation
+		if location := requirementsLocation(req.GetAccessibilityRequirements()); d.topology && location != "" {
+			options[flags.FLAG_LOCATION] = location
 		}
-		clientOpt = option.WithCredentials(creds)
-	} else {
-		// Retrieve Secret Key
-		keyFile, err := util.GetKey(req.Secrets, KeyStoragePath)
-		if err != nil {
-			return nil, err
-		}
-		clientOpt = option.WithCredentialsFile(keyFile)
-		defer util.CleanupKey(keyFile, KeyStoragePath)
 	}
 
-	// Creates a client.
-	client, err := storage.NewClient(ctx, clientOpt)
+	// Creates a client, the project of the credentials is used when none was chosen
+	client, credentialsProjectId, err := d.controllerClient(ctx, req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		return nil, err
+	}
+
+	// Templated buckets are labeled with their volume, so that names that expand alike are not shared
+	templated := options[flags.FLAG_BUCKET_NAME_TEMPLATE] != ""
+	if strings.Contains(options[flags.FLAG_BUCKET_NAME_TEMPLATE], flags.TEMPLATE_RANDOM) {
+		options[flags.FLAG_BUCKET], err = freeBucketName(ctx, client, req, options)
+		if err != nil {
+			return nil, err
+		}
+		errorMetadata[ErrorMetadataBucket] = options[flags.FLAG_BUCKET]
 	}
 
 	// Creates a Bucket instance.
-	bucket := client.Bucket(options[flags.FLAG_BUCKET])
+	bucket := bucketHandle(client, options[flags.FLAG_BUCKET], options[flags.FLAG_BILLING_PROJECT])
 
-	// Check if Bucket Exists
-	_, err = bucket.Attrs(ctx)
-	if err == nil {
+	// Check if Bucket Exists, surfacing typos and missing permissions on the PersistentVolumeClaim rather than the Pod
+	existingAttrs, err := bucket.Attrs(ctx)
+	if err == nil && templated && existingAttrs.Labels[util.VolumeLabel] != req.Name {
+		return nil, status.Errorf(codes.AlreadyExists, "Bucket '%s' of %s %s belongs to another volume", options[flags.FLAG_BUCKET], flags.FLAG_BUCKET_NAME_TEMPLATE, options[flags.FLAG_BUCKET_NAME_TEMPLATE])
+	} else if err == nil {
 		klog.V(2).Infof("Bucket '%s' exists", options[flags.FLAG_BUCKET])
+		for _, name := range []string{flags.FLAG_LIFECYCLE_DELETE_AFTER_DAYS, flags.FLAG_RETENTION_PERIOD_DAYS, flags.FLAG_ALLOW_NON_EMPTY_DELETE, flags.FLAG_DEFAULT_OBJECT_ACL} {
+			if _, found := options[name]; found {
+				klog.Warningf("Ignoring %s of volume %s because bucket '%s' already exists", name, req.Name, options[flags.FLAG_BUCKET])
+			}
+		}
+	} else if err != storage.ErrBucketNotExist {
+		return nil, bucketLookupError(options[flags.FLAG_BUCKET], err)
+	} else if flags.IsFalse(options, flags.FLAG_PROVISION_BUCKET) {
+		return nil, status.Errorf(codes.NotFound, "Bucket '%s' does not exist and provisionBucket is false, check the bucket name", options[flags.FLAG_BUCKET])
 	} else {
 		klog.V(2).Infof("Bucket '%s' does not exist, creating", options[flags.FLAG_BUCKET])
 
-		projectId, projectIdExists := options[flags.FLAG_PROJECT_ID]
-		if !projectIdExists {
-			return nil, status.Errorf(codes.InvalidArgument, "Project Id not provided, bucket can't be created: %s", options[flags.FLAG_BUCKET])
+		projectId := options[flags.FLAG_PROJECT_ID]
+		if projectId == "" {
+			projectId = credentialsProjectId
+		}
+		errorMetadata[ErrorMetadataProject] = projectId
+		if projectId == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Project Id not provided and not found in the credentials, bucket can't be created: %s", options[flags.FLAG_BUCKET])
+		}
+		if d.topology && !meetsRequirements(locationTopology(options[flags.FLAG_LOCATION]), req.GetAccessibilityRequirements()) {
+			return nil, status.Errorf(codes.InvalidArgument, "Bucket '%s' in location %s would not be accessible from any node the volume may be used on", options[flags.FLAG_BUCKET], options[flags.FLAG_LOCATION])
+		}
+		klog.V(2).Infof("Creating bucket '%s' in project '%s'", options[flags.FLAG_BUCKET], projectId)
+		// Already validated
+		labels, _ := flags.ParseLabels(options[flags.FLAG_BUCKET_LABELS])
+		labels[util.ManagedByLabel] = util.ManagedByLabelValue
+		if templated {
+			labels[util.VolumeLabel] = req.Name
 		}
-		if err := bucket.Create(ctx, projectId, &storage.BucketAttrs{Location: options[flags.FLAG_LOCATION],
-			Encryption: &storage.BucketEncryption{DefaultKMSKeyName: options[flags.FLAG_KMS_KEY_ID]}}); err != nil {
-			return nil, status.Errorf(codes.Internal, "Failed to create bucket: %v", err)
+		// Deleting happens without the parameters, so the bucket has to remember
+		if flags.IsTrue(options, flags.FLAG_ALLOW_NON_EMPTY_DELETE) {
+			labels[util.AllowNonEmptyDeleteLabel] = "true"
+		}
+		bucketAttrs := &storage.BucketAttrs{
+			Location:         options[flags.FLAG_LOCATION],
+			StorageClass:     options[flags.FLAG_BUCKET_STORAGE_CLASS],
+			BucketPolicyOnly: storage.BucketPolicyOnly{Enabled: flags.IsTrue(options, flags.FLAG_UNIFORM_BUCKET_LEVEL_ACCESS)},
+			Labels:           labels,
+			// ACL of objects written without one, e.g. so the bucket owner can read what other accounts write
+			PredefinedDefaultObjectACL: options[flags.FLAG_DEFAULT_OBJECT_ACL],
+		}
+		if kmsKeyId := options[flags.FLAG_KMS_KEY_ID]; kmsKeyId != "" {
+			bucketAttrs.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: kmsKeyId}
+		}
+		if days, found := options[flags.FLAG_LIFECYCLE_DELETE_AFTER_DAYS]; found {
+			// Already validated
+			age, _ := strconv.ParseInt(days, 10, 64)
+			bucketAttrs.Lifecycle = storage.Lifecycle{Rules: []storage.LifecycleRule{{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: age},
+			}}}
+		}
+		if days, found := options[flags.FLAG_RETENTION_PERIOD_DAYS]; found {
+			period, _ := strconv.ParseInt(days, 10, 64)
+			bucketAttrs.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: time.Duration(period) * 24 * time.Hour}
+		}
+		if err := bucket.Create(ctx, projectId, bucketAttrs); err != nil {
+			if isAlreadyExists(err) && templated {
+				// The label check of the next call tells whether it was this volume
+				return nil, status.Errorf(codes.Aborted, "Bucket '%s' was created concurrently, possibly for another volume", options[flags.FLAG_BUCKET])
+			} else if isAlreadyExists(err) {
+				// Another call created it in the meantime
+				klog.V(2).Infof("Bucket '%s' was created concurrently", options[flags.FLAG_BUCKET])
+			} else {
+				return nil, bucketCreateError(options[flags.FLAG_BUCKET], projectId, err)
+			}
 		}
 	}
 
@@ -135,86 +203,147 @@ func (d *GCSDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReque
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with smaller size already exist", options[flags.FLAG_BUCKET]))
 	}
 
+	var accessibleTopology []*csi.Topology
+	if d.topology {
+		accessibleTopology = locationTopology(bucketAttrs.Location)
+		if accessibleTopology == nil {
+			klog.Warningf("Bucket '%s' is in the unknown location %s, it will be accessible from every node", options[flags.FLAG_BUCKET], bucketAttrs.Location)
+		}
+		if !meetsRequirements(accessibleTopology, req.GetAccessibilityRequirements()) {
+			return nil, status.Errorf(codes.InvalidArgument, "Bucket '%s' in location %s is not accessible from any node the volume may be used on", options[flags.FLAG_BUCKET], bucketAttrs.Location)
+		}
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      options[flags.FLAG_BUCKET],
-			VolumeContext: options,
-			CapacityBytes: newCapacity,
+			VolumeId:           options[flags.FLAG_BUCKET],
+			VolumeContext:      options,
+			CapacityBytes:      newCapacity,
+			AccessibleTopology: accessibleTopology,
 		},
 	}, nil
 }
 
-func (d *GCSDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func (d *GCSDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (response *csi.DeleteVolumeResponse, err error) {
 	klog.V(4).Infof("Method DeleteVolume called with: %s", protosanitizer.StripSecrets(req))
 
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() {
+		err = withErrorInfo(contextError(ctx, err), map[string]string{ErrorMetadataBucket: req.VolumeId})
+	}()
+
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume id")
 	}
 
+	// Creates a client.
+	client, _, err := d.controllerClient(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Creates a Bucket instance.
+	bucket := bucketHandle(client, req.VolumeId, req.Secrets[flags.FLAG_BILLING_PROJECT])
+
+	// Only a bucket that is gone counts as deleted, anything else e.g. missing permissions is retried
+	bucketAttrs, err := bucket.Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		klog.V(2).Infof("Bucket '%s' does not exist, not deleting", req.VolumeId)
+	} else if err != nil {
+		return nil, bucketLookupError(req.VolumeId, err)
+	} else if !util.IsManagedBucket(bucketAttrs) {
+		// Buckets created by releases before the label lack it as well
+		klog.Warningf("Not deleting bucket '%s' as it lacks the label %s: %s, add it if the driver created the bucket", req.VolumeId, util.ManagedByLabel, util.ManagedByLabelValue)
+	} else if err := deleteBucket(ctx, bucket, bucketAttrs); err != nil {
+		return nil, err
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// Creates a client authenticated with the key in secrets or else the default credentials, and returns the project
+// of those credentials if known. Against an emulator no credentials are needed.
+func (d *GCSDriver) controllerClient(ctx context.Context, secrets map[string]string) (client *storage.Client, projectId string, err error) {
+	if d.storageEmulatorHost != "" {
+		client, err = d.newStorageClient(ctx)
+		if err != nil {
+			return nil, "", status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		}
+		// Emulators do not care about projects
+		return client, "emulator", nil
+	}
+
 	var clientOpt option.ClientOption
-	if len(req.Secrets) == 0 {
+	if len(secrets) == 0 {
 		// Find default credentials
 		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		clientOpt = option.WithCredentials(creds)
+		projectId = creds.ProjectID
 	} else {
 		// Retrieve Secret Key
-		keyFile, err := util.GetKey(req.Secrets, KeyStoragePath)
+		keyFile, err := util.GetKey(secrets, d.keyStoragePath)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		clientOpt = option.WithCredentialsFile(keyFile)
-		defer util.CleanupKey(keyFile, KeyStoragePath)
-	}
+		defer util.CleanupKey(keyFile, d.keyStoragePath)
 
-	// Creates a client.
-	client, err := storage.NewClient(ctx, clientOpt)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		if creds, err := google.CredentialsFromJSON(ctx, []byte(secrets["key"])); err == nil {
+			projectId = creds.ProjectID
+		}
 	}
 
-	// Creates a Bucket instance.
-	bucket := client.Bucket(req.VolumeId)
-
-	_, err = bucket.Attrs(ctx)
-	if err == nil {
-		if err := bucket.Delete(ctx); err != nil {
-			return nil, status.Errorf(codes.Internal, "Error deleting bucket %s, %v", req.VolumeId, err)
-		}
-	} else {
-		klog.V(2).Infof("Bucket '%s' does not exist, not deleting", req.VolumeId)
+	client, err = d.newStorageClient(ctx, clientOpt)
+	if err != nil {
+		return nil, "", status.Errorf(codes.Internal, "Failed to create client: %v", err)
 	}
+	return client, projectId, nil
+}
 
-	return &csi.DeleteVolumeResponse{}, nil
+// Capabilities whose RPCs are implemented, only enabled ones are advertised so sidecars do not call stubs
+var controllerCapabilities = []struct {
+	rpc     csi.ControllerServiceCapability_RPC_Type
+	enabled bool
+}{
+	{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME, true},
+	{csi.ControllerServiceCapability_RPC_EXPAND_VOLUME, true},
+	{csi.ControllerServiceCapability_RPC_LIST_VOLUMES, true},
+	{csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, true},
+	{csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS, true},
+	{csi.ControllerServiceCapability_RPC_GET_VOLUME, true},
+	{csi.ControllerServiceCapability_RPC_VOLUME_CONDITION, true},
 }
 
 func (d *GCSDriver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	klog.V(4).Infof("Method ControllerGetCapabilities called with: %s", protosanitizer.StripSecrets(req))
 
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
-			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-					},
+	capabilities := []*csi.ControllerServiceCapability{}
+	for _, capability := range controllerCapabilities {
+		if !capability.enabled {
+			continue
+		}
+
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: capability.rpc,
 				},
 			},
-		},
-	}, nil
+		})
+	}
+
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
-func (d *GCSDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+func (d *GCSDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (response *csi.ValidateVolumeCapabilitiesResponse, err error) {
 	klog.V(4).Infof("Method ValidateVolumeCapabilities called with: %s", protosanitizer.StripSecrets(req))
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
 
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume id")
@@ -225,28 +354,10 @@ func (d *GCSDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Val
 
 	bucketName := req.VolumeId
 
-	var clientOpt option.ClientOption
-	if len(req.Secrets) == 0 {
-		// Find default credentials
-		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
-		if err != nil {
-			return nil, err
-		}
-		clientOpt = option.WithCredentials(creds)
-	} else {
-		// Retrieve Secret Key
-		keyFile, err := util.GetKey(req.Secrets, KeyStoragePath)
-		if err != nil {
-			return nil, err
-		}
-		clientOpt = option.WithCredentialsFile(keyFile)
-		defer util.CleanupKey(keyFile, KeyStoragePath)
-	}
-
 	// Creates a client.
-	client, err := storage.NewClient(ctx, clientOpt)
+	client, _, err := d.controllerClient(ctx, req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		return nil, err
 	}
 
 	// Creates a Bucket instance.
@@ -258,16 +369,12 @@ func (d *GCSDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Val
 		return nil, status.Error(codes.NotFound, "volume does not exist")
 	}
 
-	for _, capability := range req.GetVolumeCapabilities() {
-		if capability.GetMount() != nil && capability.GetBlock() == nil {
-			continue
-		}
-		return &csi.ValidateVolumeCapabilitiesResponse{Message: "Only volumeMode Filesystem is supported"}, nil
+	if message := unsupportedCapabilityMessage(req.GetVolumeCapabilities()); message != "" {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: message}, nil
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-
 			VolumeContext:      req.GetVolumeContext(),
 			VolumeCapabilities: req.GetVolumeCapabilities(),
 			Parameters:         req.GetParameters(),
@@ -275,6 +382,27 @@ func (d *GCSDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Val
 	}, nil
 }
 
+// Any number of nodes may mount a bucket, but nothing stops more than one of them from writing to it
+var unsupportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]string{
+	csi.VolumeCapability_AccessMode_UNKNOWN:                  "an access mode is required",
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: "a bucket cannot be limited to a single writer across nodes",
+}
+
+// Explains why the capabilities cannot be satisfied, empty if they can
+func unsupportedCapabilityMessage(capabilities []*csi.VolumeCapability) string {
+	for _, capability := range capabilities {
+		if capability.GetMount() == nil || capability.GetBlock() != nil {
+			return "Only volumeMode Filesystem is supported"
+		}
+
+		mode := capability.GetAccessMode().GetMode()
+		if reason, found := unsupportedAccessModes[mode]; found {
+			return fmt.Sprintf("Access mode %s is not supported: %s", mode, reason)
+		}
+	}
+	return ""
+}
+
 func (d *GCSDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	klog.V(4).Infof("Method ControllerPublishVolume called with: %s", protosanitizer.StripSecrets(req))
 
@@ -293,63 +421,83 @@ func (d *GCSDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (d *GCSDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+func (d *GCSDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (response *csi.ListVolumesResponse, err error) {
 	klog.V(4).Infof("Method ListVolumes called with: %s", protosanitizer.StripSecrets(req))
 
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
 
-func (d *GCSDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	klog.V(4).Infof("Method CreateSnapshot called with: %s", protosanitizer.StripSecrets(req))
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	// There are no secrets, buckets are listed in the project of the driver's own credentials
+	client, projectId, err := d.controllerClient(ctx, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to find default credentials: %v", err)
+	}
+	if projectId == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Default credentials are not associated with a project")
+	}
+
+	buckets := client.Buckets(ctx, projectId)
+	return listManagedVolumes(buckets.Next, req.StartingToken, req.MaxEntries)
 }
 
-func (d *GCSDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	klog.V(4).Infof("Method DeleteSnapshot called with: %s", protosanitizer.StripSecrets(req))
+// Buckets are listed in lexicographical order so the name of the last returned one is used as the token
+func listManagedVolumes(next func() (*storage.BucketAttrs, error), startingToken string, maxEntries int32) (*csi.ListVolumesResponse, error) {
+	resp := &csi.ListVolumesResponse{}
 
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	for {
+		bucketAttrs, err := next()
+		if err == iterator.Done {
+			return resp, nil
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to list buckets: %v", err)
+		}
 
-func (d *GCSDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	klog.V(4).Infof("Method ListSnapshots called with: %s", protosanitizer.StripSecrets(req))
+		if bucketAttrs.Name <= startingToken || !util.IsManagedBucket(bucketAttrs) {
+			continue
+		}
 
-	return nil, status.Error(codes.Unimplemented, "")
+		if maxEntries > 0 && len(resp.Entries) == int(maxEntries) {
+			resp.NextToken = resp.Entries[len(resp.Entries)-1].Volume.VolumeId
+			return resp, nil
+		}
+
+		capacity, err := util.BucketCapacity(bucketAttrs)
+		if err != nil {
+			klog.Warningf("Bucket '%s' has an invalid capacity: %v", bucketAttrs.Name, err)
+		}
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      bucketAttrs.Name,
+				CapacityBytes: capacity,
+			},
+		})
+	}
 }
 
-func (d *GCSDriver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+func (d *GCSDriver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (response *csi.ControllerExpandVolumeResponse, err error) {
 	klog.V(4).Infof("Method ControllerExpandVolume called with: %s", protosanitizer.StripSecrets(req))
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
 
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "missing volume id")
 	}
 
-	var clientOpt option.ClientOption
-	if len(req.Secrets) == 0 {
-		// Find default credentials
-		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
-		if err != nil {
-			return nil, err
-		}
-		clientOpt = option.WithCredentials(creds)
-	} else {
-		// Retrieve Secret Key
-		keyFile, err := util.GetKey(req.Secrets, KeyStoragePath)
-		if err != nil {
-			return nil, err
-		}
-		clientOpt = option.WithCredentialsFile(keyFile)
-		defer util.CleanupKey(keyFile, KeyStoragePath)
-	}
-
 	// Creates a client.
-	client, err := storage.NewClient(ctx, clientOpt)
+	client, _, err := d.controllerClient(ctx, req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		return nil, err
 	}
 
 	// Creates a Bucket instance.
-	bucket := client.Bucket(req.VolumeId)
+	bucket := bucketHandle(client, req.VolumeId, req.Secrets[flags.FLAG_BILLING_PROJECT])
 
 	// Check if Bucket Exists
 	_, err = bucket.Attrs(ctx)
@@ -384,3 +532,182 @@ func (d *GCSDriver) ControllerExpandVolume(ctx context.Context, req *csi.Control
 		NodeExpansionRequired: false,
 	}, nil
 }
+
+func (d *GCSDriver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (response *csi.ControllerGetVolumeResponse, err error) {
+	klog.V(4).Infof("Method ControllerGetVolume called with: %s", protosanitizer.StripSecrets(req))
+
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
+
+	// There are no secrets, like ListVolumes the driver's own credentials are used
+	client, _, err := d.controllerClient(ctx, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to find default credentials: %v", err)
+	}
+
+	volume := &csi.Volume{VolumeId: req.VolumeId}
+	condition := &csi.VolumeCondition{Message: fmt.Sprintf("Bucket '%s' is accessible", req.VolumeId)}
+
+	bucketAttrs, err := client.Bucket(req.VolumeId).Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		return nil, status.Errorf(codes.NotFound, "Bucket '%s' no longer exists", req.VolumeId)
+	} else if err != nil {
+		lookupErr := bucketLookupError(req.VolumeId, err)
+		if status.Code(lookupErr) != codes.PermissionDenied {
+			return nil, lookupErr
+		}
+		condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("Access to bucket '%s' was lost: %v", req.VolumeId, err)}
+	} else if capacity, err := util.BucketCapacity(bucketAttrs); err == nil {
+		volume.CapacityBytes = capacity
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition},
+	}, nil
+}
+
+// Tries the names a bucket name template with a random part produces until one is free or belongs to the volume
+func freeBucketName(ctx context.Context, client *storage.Client, req *csi.CreateVolumeRequest, options map[string]string) (string, error) {
+	template := options[flags.FLAG_BUCKET_NAME_TEMPLATE]
+	for attempt := 0; attempt < MaxBucketNameAttempts; attempt++ {
+		bucketName, err := templatedBucketName(template, req.Name, req.Parameters, attempt)
+		if err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		bucketAttrs, err := bucketHandle(client, bucketName, options[flags.FLAG_BILLING_PROJECT]).Attrs(ctx)
+		if err == storage.ErrBucketNotExist {
+			return bucketName, nil
+		} else if err == nil && bucketAttrs.Labels[util.VolumeLabel] == req.Name {
+			// Created by an earlier call for the same volume
+			return bucketName, nil
+		} else if err != nil && status.Code(bucketLookupError(bucketName, err)) != codes.PermissionDenied {
+			return "", bucketLookupError(bucketName, err)
+		}
+
+		// Buckets of other projects are not even visible
+		klog.V(2).Infof("Bucket name '%s' of volume %s is taken, trying another one", bucketName, req.Name)
+	}
+	return "", reasonError(codes.ResourceExhausted, ReasonBucketNamesTaken, "All %d bucket names tried for %s %s are taken", MaxBucketNameAttempts, flags.FLAG_BUCKET_NAME_TEMPLATE, template)
+}
+
+// Maps failures to create a bucket to codes the external-provisioner turns into events on the PersistentVolumeClaim
+func bucketCreateError(bucketName string, projectId string, err error) error {
+	if isQuotaError(err) {
+		return status.Errorf(codes.ResourceExhausted, "Project '%s' exceeded its quota, bucket '%s' can't be created now: %v", projectId, bucketName, err)
+	}
+	if e, ok := err.(*googleapi.Error); ok {
+		switch e.Code {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return status.Errorf(codes.PermissionDenied, "Credentials may not create bucket '%s' in project '%s', they need storage.buckets.create: %v", bucketName, projectId, err)
+		case http.StatusNotFound:
+			return status.Errorf(codes.InvalidArgument, "Project '%s' does not exist, bucket '%s' can't be created: %v", projectId, bucketName, err)
+		case http.StatusBadRequest:
+			return status.Errorf(codes.InvalidArgument, "Bucket '%s' can't be created in project '%s', check its name, location, storage class and KMS key: %v", bucketName, projectId, err)
+		}
+	}
+	return status.Errorf(codes.Internal, "Failed to create bucket '%s' in project '%s': %v", bucketName, projectId, err)
+}
+
+// Only mistakes in the request are normal, anything else needs attention
+func provisioningEvent(err error) (eventType string, reason string) {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists:
+		return corev1.EventTypeNormal, "InvalidVolumeParameters"
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return corev1.EventTypeWarning, "BucketAccessDenied"
+	}
+	return corev1.EventTypeWarning, "BucketProvisioningFailed"
+}
+
+// The external-provisioner only logs most failures, app teams need them on the PersistentVolumeClaim
+func reportProvisioningFailure(req *csi.CreateVolumeRequest, err error) {
+	pvcName, pvcNamespace := req.GetParameters()["csi.storage.k8s.io/pvc/name"], req.GetParameters()["csi.storage.k8s.io/pvc/namespace"]
+	if pvcName == "" || pvcNamespace == "" {
+		return
+	}
+
+	eventType, reason := provisioningEvent(err)
+	if eventErr := util.CreatePvcEvent(pvcName, pvcNamespace, eventType, reason, status.Convert(err).Message()); eventErr != nil {
+		klog.Warningf("Could not record event on PersistentVolumeClaim %s/%s: %v", pvcNamespace, pvcName, eventErr)
+	}
+}
+
+// Maps failures to read the metadata of an existing bucket
+func bucketLookupError(bucketName string, err error) error {
+	if isRequesterPaysError(err) {
+		return requesterPaysError(bucketName)
+	}
+	if isQuotaError(err) {
+		return status.Errorf(codes.ResourceExhausted, "Quota exceeded getting bucket '%s': %v", bucketName, err)
+	}
+	if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusForbidden || e.Code == http.StatusUnauthorized) {
+		return status.Errorf(codes.PermissionDenied, "Credentials may not get bucket '%s', they need storage.buckets.get: %v", bucketName, err)
+	}
+	return status.Errorf(codes.Internal, "Failed to get bucket '%s': %v", bucketName, err)
+}
+
+// Refuses to delete buckets holding objects unless they were created with allowNonEmptyDelete, whose objects
+// are deleted first
+func deleteBucket(ctx context.Context, bucket *storage.BucketHandle, bucketAttrs *storage.BucketAttrs) error {
+	// Noncurrent versions keep a bucket from being deleted as well
+	query := &storage.Query{Versions: true}
+
+	if bucketAttrs.Labels[util.AllowNonEmptyDeleteLabel] != "true" {
+		_, err := bucket.Objects(ctx, query).Next()
+		if err == nil {
+			return reasonError(codes.FailedPrecondition, ReasonBucketNotEmpty, "Bucket '%s' still holds objects, delete them or create volumes with %s to delete them along with the volume", bucketAttrs.Name, flags.FLAG_ALLOW_NON_EMPTY_DELETE)
+		} else if err != iterator.Done {
+			return status.Errorf(codes.Internal, "Failed to list objects of bucket '%s': %v", bucketAttrs.Name, err)
+		}
+	} else {
+		// Counted while deleting, as listing large buckets twice costs as much again and takes the time to delete
+		count := 0
+		objects := bucket.Objects(ctx, query)
+		for {
+			objectAttrs, err := objects.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return status.Errorf(codes.Internal, "Failed to list objects of bucket '%s' after deleting %d: %v", bucketAttrs.Name, count, err)
+			}
+			err = bucket.Object(objectAttrs.Name).Generation(objectAttrs.Generation).Delete(ctx)
+			if err != nil && err != storage.ErrObjectNotExist {
+				return status.Errorf(codes.Internal, "Failed to delete object '%s' of bucket '%s' after deleting %d: %v", objectAttrs.Name, bucketAttrs.Name, count, err)
+			}
+			count++
+		}
+		if count > 0 {
+			klog.Infof("Deleted %d objects of bucket '%s' along with its volume", count, bucketAttrs.Name)
+		}
+	}
+
+	if err := bucket.Delete(ctx); err != nil {
+		return bucketDeleteError(bucketAttrs.Name, err)
+	}
+	return nil
+}
+
+func bucketDeleteError(bucketName string, err error) error {
+	if isQuotaError(err) {
+		return status.Errorf(codes.ResourceExhausted, "Quota exceeded deleting bucket '%s': %v", bucketName, err)
+	}
+	if e, ok := err.(*googleapi.Error); ok && (e.Code == http.StatusForbidden || e.Code == http.StatusUnauthorized) {
+		return status.Errorf(codes.PermissionDenied, "Credentials may not delete bucket '%s', they need storage.buckets.delete: %v", bucketName, err)
+	}
+	return status.Errorf(codes.Internal, "Error deleting bucket %s, %v", bucketName, err)
+}
+
+func isAlreadyExists(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == http.StatusConflict
+	}
+	return false
+}
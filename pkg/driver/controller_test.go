@@ -0,0 +1,659 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/iterator"
+	raw "google.golang.org/api/storage/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("Controller", func() {
+	var d *GCSDriver
+
+	BeforeEach(func() {
+		d = &GCSDriver{name: CSIDriverName}
+	})
+
+	Describe("ControllerGetCapabilities", func() {
+		advertised := func() []csi.ControllerServiceCapability_RPC_Type {
+			resp, err := d.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+
+			rpcs := []csi.ControllerServiceCapability_RPC_Type{}
+			for _, capability := range resp.GetCapabilities() {
+				rpcs = append(rpcs, capability.GetRpc().GetType())
+			}
+			return rpcs
+		}
+
+		It("Should Only Advertise Enabled Features", func() {
+			Expect(advertised()).To(ConsistOf(
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			))
+		})
+		It("Should Not Advertise Unimplemented RPCs", func() {
+			_, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+			Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+			Expect(advertised()).NotTo(ContainElement(csi.ControllerServiceCapability_RPC_GET_CAPACITY))
+		})
+		It("Should Not Create Volumes From Snapshots", func() {
+			_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+				VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshots/snapshot-1"},
+				}},
+			})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(advertised()).NotTo(ContainElement(csi.ControllerServiceCapability_RPC_CLONE_VOLUME))
+		})
+	})
+	Describe("listManagedVolumes", func() {
+		var buckets []*storage.BucketAttrs
+
+		BeforeEach(func() {
+			managed := map[string]string{util.ManagedByLabel: util.ManagedByLabelValue}
+			buckets = []*storage.BucketAttrs{
+				{Name: "a", Labels: map[string]string{util.ManagedByLabel: util.ManagedByLabelValue, "capacity": "1024"}},
+				{Name: "b"},
+				{Name: "c", Labels: managed},
+				{Name: "d", Labels: managed},
+			}
+		})
+
+		list := func(startingToken string, maxEntries int32) *csi.ListVolumesResponse {
+			remaining := buckets
+			next := func() (*storage.BucketAttrs, error) {
+				if len(remaining) == 0 {
+					return nil, iterator.Done
+				}
+				bucketAttrs := remaining[0]
+				remaining = remaining[1:]
+				return bucketAttrs, nil
+			}
+
+			resp, err := listManagedVolumes(next, startingToken, maxEntries)
+			Expect(err).NotTo(HaveOccurred())
+			return resp
+		}
+		volumeIds := func(resp *csi.ListVolumesResponse) []string {
+			ids := []string{}
+			for _, entry := range resp.GetEntries() {
+				ids = append(ids, entry.GetVolume().GetVolumeId())
+			}
+			return ids
+		}
+
+		It("Should Only List Managed Buckets", func() {
+			resp := list("", 0)
+			Expect(volumeIds(resp)).To(Equal([]string{"a", "c", "d"}))
+			Expect(resp.GetEntries()[0].GetVolume().GetCapacityBytes()).To(Equal(int64(1024)))
+			Expect(resp.GetNextToken()).To(BeEmpty())
+		})
+		It("Should Paginate", func() {
+			resp := list("", 2)
+			Expect(volumeIds(resp)).To(Equal([]string{"a", "c"}))
+			Expect(resp.GetNextToken()).To(Equal("c"))
+
+			resp = list(resp.GetNextToken(), 2)
+			Expect(volumeIds(resp)).To(Equal([]string{"d"}))
+			Expect(resp.GetNextToken()).To(BeEmpty())
+		})
+	})
+
+	Describe("Requests To GCS", func() {
+		var (
+			server      *httptest.Server
+			statusCodes map[string]int
+			delay       time.Duration
+			created     *raw.Bucket
+			createdAcl  string
+			message     string
+			reason      string
+			userProject string
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(delay)
+				userProject = r.URL.Query().Get("userProject")
+				if r.Method == http.MethodPost {
+					created = &raw.Bucket{}
+					createdAcl = r.URL.Query().Get("predefinedDefaultObjectAcl")
+					json.NewDecoder(r.Body).Decode(created)
+				}
+				w.WriteHeader(statusCodes[r.Method])
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": statusCodes[r.Method], "message": message, "errors": []map[string]string{{"reason": reason}}}})
+			}))
+			d.storageEmulatorHost = server.URL
+			message = "test"
+		})
+
+		AfterEach(func() {
+			delay = 0
+			message = "test"
+			reason = ""
+			server.Close()
+		})
+
+		create := func(parameters map[string]string) error {
+			_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name: "pvc-test",
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				}},
+				Parameters: parameters,
+			})
+			return err
+		}
+
+		It("Should Fail Early For Missing Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound}
+			err := create(map[string]string{"bucket": "typo", "provisionBucket": "false"})
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+			Expect(err.Error()).To(ContainSubstring("typo"))
+		})
+		It("Should Accept Any Spelling Of Booleans", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			err := create(map[string]string{"bucket": "typo", "provisionBucket": "False"})
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "uniformBucketLevelAccess": "1"})
+			Expect(created.IamConfiguration.BucketPolicyOnly.Enabled).To(BeTrue())
+		})
+		It("Should Fail Early Without Access To Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusForbidden}
+			err := create(map[string]string{"bucket": "typo", "provisionBucket": "false"})
+			Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+			Expect(err.Error()).To(ContainSubstring("storage.buckets.get"))
+		})
+		It("Should Only Consider Missing Buckets Deleted", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound}
+			_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "gone"})
+			Expect(err).NotTo(HaveOccurred())
+
+			statusCodes = map[string]int{http.MethodGet: http.StatusForbidden}
+			_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "hidden"})
+			Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+		})
+		It("Should Create Buckets Where The Volume Is Preferably Used", func() {
+			d.topology = true
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			requirements := &csi.TopologyRequirement{Preferred: []*csi.Topology{{Segments: map[string]string{TopologyKeyRegion: "europe-west4", TopologyKeyMultiRegion: "europe"}}}}
+			createIn := func(parameters map[string]string) error {
+				_, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:                      "pvc-test",
+					VolumeCapabilities:        []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+					Parameters:                parameters,
+					AccessibilityRequirements: requirements,
+				})
+				return err
+			}
+
+			createIn(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(created.Location).To(Equal("EUROPE-WEST4"))
+
+			err := createIn(map[string]string{"bucket": "test", "projectId": "my-project", "location": "US"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+		It("Should Name The Project When Creation Is Denied", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			err := create(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+			Expect(err.Error()).To(And(ContainSubstring("'test'"), ContainSubstring("'my-project'"), ContainSubstring("storage.buckets.create")))
+		})
+		It("Should Explain Failures With ErrorInfo", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound}
+			err := create(map[string]string{"bucket": "typo", "provisionBucket": "false", "projectId": "my-project"})
+			Expect(status.Convert(err).Proto().GetDetails()).To(HaveLen(1))
+			Expect(status.Convert(err).Proto().GetDetails()[0].GetTypeUrl()).To(Equal("type.googleapis.com/google.rpc.ErrorInfo"))
+			Expect(errorInfo(err)).To(Equal(&ErrorInfo{
+				Reason:   ReasonBucketNotFound,
+				Domain:   ErrorDomain,
+				Metadata: map[string]string{"volume": "pvc-test", "bucket": "typo", "project": "my-project"},
+			}))
+
+			_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{})
+			Expect(errorInfo(err).Reason).To(Equal(ReasonInvalidParameters))
+			Expect(errorInfo(err).Metadata).To(BeEmpty())
+		})
+		It("Should Tell Exceeded Quotas Apart", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			reason = "quotaExceeded"
+			err := create(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(errorInfo(err).Reason).To(Equal(ReasonQuotaExceeded))
+			Expect(errorInfo(err).Metadata).To(HaveKeyWithValue("project", "my-project"))
+
+			reason = ""
+			err = create(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(errorInfo(err).Reason).To(Equal(ReasonPermissionDenied))
+		})
+		It("Should Bill Requester Pays Buckets To The Billing Project", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound}
+			create(map[string]string{"bucket": "shared", "provisionBucket": "false", "billingProject": "my-project"})
+			Expect(userProject).To(Equal("my-project"))
+		})
+		It("Should Ask For A Billing Project For Requester Pays Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusBadRequest}
+			message = "Bucket is a requester pays bucket but no user project provided."
+			err := create(map[string]string{"bucket": "shared", "provisionBucket": "false"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring("billingProject"))
+		})
+		It("Should Reject Invalid Billing Projects", func() {
+			err := create(map[string]string{"bucket": "shared", "billingProject": "My Project"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+		It("Should Label Created Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "bucketLabels": "team=a,managed-by=me"})
+			Expect(created.Labels).To(Equal(map[string]string{"team": "a", "managed-by": "csi-gcs"}))
+		})
+		It("Should Remember To Delete Objects Along With Created Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "allowNonEmptyDelete": "true"})
+			Expect(created.Labels).To(HaveKeyWithValue("csi-gcs-allow-non-empty-delete", "true"))
+
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "allowNonEmptyDelete": "True"})
+			Expect(created.Labels).To(HaveKeyWithValue("csi-gcs-allow-non-empty-delete", "true"))
+
+			create(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(created.Labels).NotTo(HaveKey("csi-gcs-allow-non-empty-delete"))
+		})
+		It("Should Set The Default Object ACL Of Created Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "defaultObjectAcl": "bucketOwnerFullControl"})
+			Expect(createdAcl).To(Equal("bucketOwnerFullControl"))
+
+			create(map[string]string{"bucket": "test", "projectId": "my-project"})
+			Expect(createdAcl).To(BeEmpty())
+		})
+		It("Should Expire And Retain Objects Of Created Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusForbidden}
+			create(map[string]string{"bucket": "test", "projectId": "my-project", "lifecycleDeleteAfterDays": "7", "retentionPeriodDays": "2"})
+			Expect(created.Lifecycle.Rule).To(HaveLen(1))
+			Expect(created.Lifecycle.Rule[0].Action.Type).To(Equal(storage.DeleteAction))
+			Expect(created.Lifecycle.Rule[0].Condition.Age).To(Equal(int64(7)))
+			Expect(created.RetentionPolicy.RetentionPeriod).To(Equal(int64(2 * 24 * 60 * 60)))
+		})
+		It("Should Only Expire Objects Of Created Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusOK}
+			created = nil
+			create(map[string]string{"bucket": "test", "lifecycleDeleteAfterDays": "7"})
+			Expect(created).To(BeNil())
+		})
+		It("Should Reject Ages That Are Not Positive", func() {
+			for _, parameters := range []map[string]string{{"lifecycleDeleteAfterDays": "0"}, {"retentionPeriodDays": "-1"}, {"retentionPeriodDays": "forever"}} {
+				parameters["bucket"] = "test"
+				Expect(status.Code(create(parameters))).To(Equal(codes.InvalidArgument), fmt.Sprint(parameters))
+			}
+		})
+		It("Should Reject Invalid Bucket Labels", func() {
+			err := create(map[string]string{"bucket": "test", "bucketLabels": "Team=A"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+		It("Should Report Accessible Buckets As Healthy", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusOK}
+			resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "test"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetVolume().GetVolumeId()).To(Equal("test"))
+			Expect(resp.GetStatus().GetVolumeCondition().GetAbnormal()).To(BeFalse())
+		})
+		It("Should Report Buckets Without Access As Abnormal", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusForbidden}
+			resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "test"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetStatus().GetVolumeCondition().GetAbnormal()).To(BeTrue())
+		})
+		It("Should Not Find Deleted Buckets", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound}
+			_, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "test"})
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+		})
+		It("Should Give Up On Slow Requests", func() {
+			d.gcsRequestTimeout = 20 * time.Millisecond
+			d.gcsRetryTimeout = 200 * time.Millisecond
+			delay = 100 * time.Millisecond
+			statusCodes = map[string]int{http.MethodGet: http.StatusOK}
+
+			start := time.Now()
+			err := create(map[string]string{"bucket": "test"})
+			Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+		It("Should Stop Once The Call Is Cancelled", func() {
+			delay = 100 * time.Millisecond
+			statusCodes = map[string]int{http.MethodGet: http.StatusOK}
+
+			expand := &csi.ControllerExpandVolumeRequest{VolumeId: "test", CapacityRange: &csi.CapacityRange{RequiredBytes: 1}}
+
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			start := time.Now()
+			_, err := d.CreateVolume(cancelled, &csi.CreateVolumeRequest{
+				Name:               "pvc-test",
+				VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+				Parameters:         map[string]string{"bucket": "test"},
+			})
+			Expect(status.Code(err)).To(Equal(codes.Canceled))
+			_, err = d.ControllerExpandVolume(cancelled, expand)
+			Expect(status.Code(err)).To(Equal(codes.Canceled))
+			Expect(time.Since(start)).To(BeNumerically("<", delay))
+
+			expired, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err = d.ControllerExpandVolume(expired, expand)
+			Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+		})
+		It("Should Blame Invalid Parameters", func() {
+			statusCodes = map[string]int{http.MethodGet: http.StatusNotFound, http.MethodPost: http.StatusBadRequest}
+			err := create(map[string]string{"bucket": "test", "projectId": "my-project", "location": "nowhere"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+	})
+
+	Describe("Deleting Buckets", func() {
+		var (
+			server  *httptest.Server
+			mu      sync.Mutex
+			buckets map[string]*raw.Bucket
+			objects map[string][]string
+		)
+
+		BeforeEach(func() {
+			buckets = map[string]*raw.Bucket{}
+			objects = map[string][]string{}
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				// b/<bucket>, b/<bucket>/o or b/<bucket>/o/<object>
+				parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/", 3)
+				bucket, found := buckets[parts[0]]
+				if !found {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": http.StatusNotFound}})
+					return
+				}
+				switch {
+				case len(parts) == 1 && r.Method == http.MethodDelete:
+					if len(objects[bucket.Name]) > 0 {
+						w.WriteHeader(http.StatusConflict)
+						json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": http.StatusConflict}})
+						return
+					}
+					delete(buckets, bucket.Name)
+					w.WriteHeader(http.StatusNoContent)
+				case len(parts) == 1:
+					json.NewEncoder(w).Encode(bucket)
+				case len(parts) == 2:
+					var items []*raw.Object
+					for _, name := range objects[bucket.Name] {
+						items = append(items, &raw.Object{Bucket: bucket.Name, Name: name, Generation: 1})
+					}
+					json.NewEncoder(w).Encode(&raw.Objects{Items: items})
+				default:
+					Expect(r.URL.Query().Get("generation")).To(Equal("1"))
+					var remaining []string
+					for _, name := range objects[bucket.Name] {
+						if name != parts[2] {
+							remaining = append(remaining, name)
+						}
+					}
+					objects[bucket.Name] = remaining
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			d.storageEmulatorHost = server.URL
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		deleteVolume := func(bucketName string) error {
+			_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: bucketName})
+			return err
+		}
+
+		It("Should Only Delete Buckets Created By The Driver", func() {
+			buckets["mine"] = &raw.Bucket{Name: "mine", Labels: map[string]string{"managed-by": "csi-gcs"}}
+			buckets["theirs"] = &raw.Bucket{Name: "theirs"}
+
+			Expect(deleteVolume("mine")).To(Succeed())
+			Expect(deleteVolume("theirs")).To(Succeed())
+			Expect(buckets).To(HaveKey("theirs"))
+			Expect(buckets).NotTo(HaveKey("mine"))
+		})
+		It("Should Refuse To Delete Buckets Holding Objects", func() {
+			buckets["mine"] = &raw.Bucket{Name: "mine", Labels: map[string]string{"managed-by": "csi-gcs"}}
+			objects["mine"] = []string{"data.csv"}
+
+			err := deleteVolume("mine")
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			Expect(err.Error()).To(ContainSubstring("allowNonEmptyDelete"))
+			Expect(errorInfo(err).Reason).To(Equal(ReasonBucketNotEmpty))
+			Expect(buckets).To(HaveKey("mine"))
+			Expect(objects["mine"]).To(ConsistOf("data.csv"))
+		})
+		It("Should Delete Objects Of Buckets Allowing It", func() {
+			buckets["mine"] = &raw.Bucket{Name: "mine", Labels: map[string]string{"managed-by": "csi-gcs", "csi-gcs-allow-non-empty-delete": "true"}}
+			objects["mine"] = []string{"data.csv", "logs/today.txt"}
+
+			Expect(deleteVolume("mine")).To(Succeed())
+			Expect(objects["mine"]).To(BeEmpty())
+			Expect(buckets).NotTo(HaveKey("mine"))
+		})
+	})
+
+	Describe("Bucket Name Templates", func() {
+		var (
+			server  *httptest.Server
+			mu      sync.Mutex
+			buckets map[string]*raw.Bucket
+		)
+
+		BeforeEach(func() {
+			buckets = map[string]*raw.Bucket{}
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Method == http.MethodPost {
+					bucket := &raw.Bucket{}
+					json.NewDecoder(r.Body).Decode(bucket)
+					buckets[bucket.Name] = bucket
+					json.NewEncoder(w).Encode(bucket)
+					return
+				}
+				bucket, found := buckets[path.Base(r.URL.Path)]
+				if !found {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": http.StatusNotFound}})
+					return
+				}
+				json.NewEncoder(w).Encode(bucket)
+			}))
+			d.storageEmulatorHost = server.URL
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		create := func(template string) (string, error) {
+			resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+				Parameters:         map[string]string{"bucketNameTemplate": template, "projectId": "my-project"},
+			})
+			return resp.GetVolume().GetVolumeId(), err
+		}
+		expand := func(template string, attempt int) string {
+			bucketName, err := templatedBucketName(template, "pvc-1", map[string]string{
+				"csi.storage.k8s.io/pvc/name":      "data.v1",
+				"csi.storage.k8s.io/pvc/namespace": "team-a",
+			}, attempt)
+			Expect(err).NotTo(HaveOccurred())
+			return bucketName
+		}
+
+		It("Should Expand Placeholders", func() {
+			Expect(expand("${pvc.namespace}-${pvc.name}", 0)).To(Equal("team-a-data-v1"))
+			Expect(expand("${pv.name}", 0)).To(Equal("pvc-1"))
+			Expect(expand("data-${random}", 0)).To(MatchRegexp(`^data-[0-9a-f]{8}$`))
+			Expect(expand("data-${random}", 0)).To(Equal(expand("data-${random}", 0)))
+			Expect(expand("data-${random}", 0)).NotTo(Equal(expand("data-${random}", 1)))
+		})
+		It("Should Reject Names GCS Would Reject", func() {
+			_, err := templatedBucketName("${pvc.name}", "pvc-1", map[string]string{}, 0)
+			Expect(err).To(MatchError(ContainSubstring("extra-create-metadata")))
+			_, err = templatedBucketName("${pv.name}-"+strings.Repeat("x", 60), "pvc-1", map[string]string{}, 0)
+			Expect(err).To(MatchError(ContainSubstring("3 to 63")))
+		})
+		It("Should Prefer A Chosen Bucket", func() {
+			options, err := provisioningOptions("pvc-1", nil, nil, map[string]string{"bucket": "chosen", "bucketNameTemplate": "${pv.name}"}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("bucket", "chosen"))
+			Expect(options).NotTo(HaveKey("bucketNameTemplate"))
+		})
+		It("Should Take The Bucket Of The Claim", func() {
+			annotations := map[string]string{"gcs.csi.ofek.dev/bucket": "team-data", "gcs.csi.ofek.dev/provision-bucket": "false"}
+			options, err := provisioningOptions("pvc-1", nil, nil, map[string]string{"bucketPrefix": "ignored"}, annotations)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("bucket", "team-data"))
+			Expect(options).To(HaveKeyWithValue("provisionBucket", "false"))
+
+			_, err = provisioningOptions("pvc-1", nil, nil, nil, map[string]string{"gcs.csi.ofek.dev/bucket": "Team Data"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+		It("Should Not Let Claims Override Parameters", func() {
+			annotations := map[string]string{"gcs.csi.ofek.dev/provision-bucket": "true", "gcs.csi.ofek.dev/allow-non-empty-delete": "true"}
+			parameters := map[string]string{"provisionBucket": "false", "gcs.csi.ofek.dev/allow-non-empty-delete": "false"}
+			options, err := provisioningOptions("pvc-1", nil, nil, parameters, annotations)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("provisionBucket", "false"))
+			Expect(options).To(HaveKeyWithValue("allowNonEmptyDelete", "false"))
+		})
+		It("Should Try Another Random Name When One Is Taken", func() {
+			taken := expand("data-${random}", 0)
+			buckets[taken] = &raw.Bucket{Name: taken}
+
+			bucketName, err := create("data-${random}")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bucketName).To(Equal(expand("data-${random}", 1)))
+			Expect(buckets[bucketName].Labels).To(HaveKeyWithValue(util.VolumeLabel, "pvc-1"))
+
+			// Retried calls find the bucket of the volume
+			again, err := create("data-${random}")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(Equal(bucketName))
+			Expect(buckets).To(HaveLen(2))
+		})
+		It("Should Not Share Templated Buckets Between Volumes", func() {
+			bucketName, err := create("${pv.name}")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buckets[bucketName].Labels).To(HaveKeyWithValue(util.VolumeLabel, "pvc-1"))
+
+			// Retried calls find the bucket of the volume
+			_, err = create("${pv.name}")
+			Expect(err).NotTo(HaveOccurred())
+
+			buckets[bucketName].Labels[util.VolumeLabel] = "pvc-2"
+			_, err = create("${pv.name}")
+			Expect(status.Code(err)).To(Equal(codes.AlreadyExists))
+		})
+		It("Should Give Up When Every Random Name Is Taken", func() {
+			for attempt := 0; attempt < MaxBucketNameAttempts; attempt++ {
+				taken := expand("data-${random}", attempt)
+				buckets[taken] = &raw.Bucket{Name: taken}
+			}
+
+			_, err := create("data-${random}")
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(errorInfo(err).Reason).To(Equal(ReasonBucketNamesTaken))
+		})
+	})
+	Describe("provisioningEvent", func() {
+		It("Should Only Warn About Problems Beyond The Request", func() {
+			eventType, _ := provisioningEvent(status.Error(codes.InvalidArgument, ""))
+			Expect(eventType).To(Equal(corev1.EventTypeNormal))
+			eventType, reason := provisioningEvent(status.Error(codes.PermissionDenied, ""))
+			Expect(eventType).To(Equal(corev1.EventTypeWarning))
+			Expect(reason).To(Equal("BucketAccessDenied"))
+			eventType, _ = provisioningEvent(status.Error(codes.Internal, ""))
+			Expect(eventType).To(Equal(corev1.EventTypeWarning))
+		})
+	})
+
+	Describe("unsupportedCapabilityMessage", func() {
+		capability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+			return &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}
+		}
+
+		for mode, supported := range map[csi.VolumeCapability_AccessMode_Mode]bool{
+			csi.VolumeCapability_AccessMode_UNKNOWN:                  false,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       true,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:  true,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:   true,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: false,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  true,
+		} {
+			mode, supported := mode, supported
+			It("Should Decide On "+mode.String(), func() {
+				message := unsupportedCapabilityMessage([]*csi.VolumeCapability{capability(mode)})
+				if supported {
+					Expect(message).To(BeEmpty())
+				} else {
+					Expect(message).To(ContainSubstring(mode.String()))
+				}
+			})
+		}
+		It("Should Cover Every Access Mode", func() {
+			Expect(csi.VolumeCapability_AccessMode_Mode_name).To(HaveLen(6))
+		})
+		It("Should Reject Block Volumes", func() {
+			block := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			}
+			Expect(unsupportedCapabilityMessage([]*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), block})).To(ContainSubstring("Filesystem"))
+		})
+	})
+})
+
+// The ErrorInfo among the details of err, nil if there is none
+func errorInfo(err error) *ErrorInfo {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"k8s.io/klog"
+)
+
+// How long the outcome of checking a key is reused, kubelet asks for volume stats every minute
+const credentialCheckInterval = 5 * time.Minute
+
+// Tells whether the keys that mounts were started with are still accepted. gcsfuse reads its key only once,
+// so a rotated or deleted key breaks the mount until the pod is recreated.
+type credentialChecker struct {
+	mu      sync.Mutex
+	results map[string]credentialCheck
+	// Defaults to exchanging the key for an access token
+	check func(ctx context.Context, keyFile string) error
+}
+
+type credentialCheck struct {
+	err       error
+	checkedAt time.Time
+}
+
+// Returns an error if the key has been rejected
+func (c *credentialChecker) Check(ctx context.Context, keyFile string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if result, found := c.results[keyFile]; found && time.Since(result.checkedAt) < credentialCheckInterval {
+		return result.err
+	}
+
+	check := c.check
+	if check == nil {
+		check = checkKeyFile
+	}
+
+	err := check(ctx, keyFile)
+	if err != nil && !isCredentialRejected(err) {
+		// Only a definite rejection makes the mount unhealthy, the check is repeated next time
+		klog.V(4).Infof("Could not check key %s: %v", keyFile, err)
+		return nil
+	}
+
+	if c.results == nil {
+		c.results = map[string]credentialCheck{}
+	}
+	c.results[keyFile] = credentialCheck{err: err, checkedAt: time.Now()}
+	return err
+}
+
+func (c *credentialChecker) Forget(keyFile string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.results, keyFile)
+}
+
+func checkKeyFile(ctx context.Context, keyFile string) error {
+	contents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, contents, storage.ScopeReadOnly)
+	if err != nil {
+		return err
+	}
+
+	_, err = creds.TokenSource.Token()
+	return err
+}
+
+func isCredentialRejected(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return false
+	}
+
+	return retrieveErr.Response.StatusCode == http.StatusBadRequest || retrieveErr.Response.StatusCode == http.StatusUnauthorized
+}
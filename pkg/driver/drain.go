@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+// Whether the node refuses new mounts, e.g. while it is drained. The zero value is not draining.
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+}
+
+func (s *drainState) Set(draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = draining
+}
+
+func (s *drainState) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.draining
+}
+
+// SIGUSR1 starts draining the node and SIGUSR2 stops it, until stopCh is closed
+func (d *GCSDriver) watchDrainSignals(stopCh <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case sig := <-signals:
+			draining := sig == syscall.SIGUSR1
+			d.drain.Set(draining)
+			if draining {
+				klog.V(1).Infof("Received %v, refusing to publish volumes until SIGUSR2", sig)
+			} else {
+				klog.V(1).Infof("Received %v, publishing volumes again", sig)
+			}
+		}
+	}
+}
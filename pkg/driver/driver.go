@@ -3,7 +3,13 @@ package driver
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
@@ -15,25 +21,189 @@ import (
 )
 
 type GCSDriver struct {
-	name               string
-	nodeName           string
-	endpoint           string
-	mountPoint         string
-	version            string
-	server             *grpc.Server
-	mounter            mount.Interface
+	name           string
+	nodeName       string
+	endpoint       string
+	mountPoint     string
+	keyStoragePath string
+	// Applied to the gRPC socket once it is bound, 0 and -1 leave the mode and IDs as they are
+	socketMode os.FileMode
+	socketUID  int
+	socketGID  int
+	// The only directory key files of volumes may be read from, empty means none
+	authFileRoot     string
+	cacheRootPath    string
+	logStoragePath   string
+	version          string
+	server           *grpc.Server
+	stopCh           chan struct{}
+	mounter          mount.Interface
+	targetLocks      keyedMutex
+	credentials      credentialChecker
+	logFollowers     followers
+	supervisors      followers
+	remountFailures  remountFailures
+	mountBreakers    mountBreakers
+	mountRegistry    mountRegistry
+	stateStoragePath string
+	stagedTargets    stagedTargets
+	components       components
+	publishedTargets publishedTargets
+	// Counting the objects of volumes for their stats is disabled without an interval
+	volumeStats           volumeStats
+	volumeStatsInterval   time.Duration
+	volumeStatsMaxObjects int64
+	// Refuses new mounts while set, unmounting goes on
+	drain        drainState
+	gcsfuseLogs  bool
+	stageVolumes bool
+	// Report where nodes are and volumes are accessible from
+	topology bool
+	// Let the user of the pod own its mounts as well, and nobody else access them
+	podOwnership       bool
 	deleteOrphanedPods bool
+	orphanReapInterval time.Duration
+	mountRetryTimeout  time.Duration
+	// How long gcsfuse may take to exit after unmounting before it is killed
+	unmountGracePeriod time.Duration
+	// Consecutive permanent mount failures of a volume after which it is not mounted for the cooldown, 0 means never
+	mountFailureThreshold int
+	mountFailureCooldown  time.Duration
+	// Bounds how many gcsfuse processes start at once, nil means no limit
+	mountSlots      chan struct{}
+	healthAddress   string
+	metricsAddress  string
+	readinessBucket string
+	selfTestBucket  string
+	// Where snapshots go unless their class names a bucket
+	snapshotBucket string
+	// Set once before the health server starts
+	selfTestErr       error
+	gcsfusePath       string
+	gcsfuseVersion    string
+	gcsDialTimeout    time.Duration
+	gcsRequestTimeout time.Duration
+	gcsRetryTimeout   time.Duration
+	// Set for testing against an emulator such as fake-gcs-server
+	storageEmulatorHost string
+	// Host to reach GCS at e.g. for Private Google Access, empty means the default
+	gcsEndpoint string
 }
 
-func NewGCSDriver(name, node, endpoint string, version string, deleteOrphanedPods bool) (*GCSDriver, error) {
+// Settings of the driver, which cmd/main.go fills from its flags
+type Config struct {
+	Name     string
+	NodeName string
+	// Where to serve CSI e.g. unix:///csi/csi.sock
+	Endpoint string
+	// Octal mode and UID:GID of the socket, empty leaves them as they are
+	SocketMode  string
+	SocketOwner string
+	Version     string
+	// Comma-separated CSI services to serve
+	Components         string
+	DeleteOrphanedPods bool
+	OrphanReapInterval time.Duration
+	HealthAddress      string
+	MetricsAddress     string
+	ReadinessBucket    string
+	SelfTestBucket     string
+	SnapshotBucket     string
+	GCSEndpoint        string
+	// For testing against an emulator such as fake-gcs-server
+	StorageEmulatorHost string
+	Topology            bool
+	PodOwnership        bool
+	AuthFileRoot        string
+	StateStoragePath    string
+	KeyStoragePath      string
+	GcsfusePath         string
+	GcsfuseLogs         bool
+	StageVolumes        bool
+	MountRetryTimeout   time.Duration
+	GCSDialTimeout      time.Duration
+	GCSRequestTimeout   time.Duration
+	GCSRetryTimeout     time.Duration
+	UnmountGracePeriod  time.Duration
+	// 0 disables the breaker of volumes that keep failing to mount
+	MountFailureThreshold int
+	MountFailureCooldown  time.Duration
+	// 0 reports what gcsfuse does
+	VolumeStatsInterval   time.Duration
+	VolumeStatsMaxObjects int64
+	// 0 means no limit
+	MaxConcurrentMounts int
+}
+
+func NewGCSDriver(config Config) (*GCSDriver, error) {
+	if err := validateEndpointHost(config.GCSEndpoint); err != nil {
+		return nil, fmt.Errorf("--gcs-endpoint %v", err)
+	}
+	components, err := parseComponents(config.Components)
+	if err != nil {
+		return nil, fmt.Errorf("--components %v", err)
+	}
+	parsedSocketMode, err := parseSocketMode(config.SocketMode)
+	if err != nil {
+		return nil, fmt.Errorf("--csi-endpoint-mode %v", err)
+	}
+	socketUID, socketGID, err := parseSocketOwner(config.SocketOwner)
+	if err != nil {
+		return nil, fmt.Errorf("--csi-endpoint-owner %v", err)
+	}
+
+	// Only kept in memory without a place to keep it
+	var registryPath string
+	if config.StateStoragePath != "" {
+		registryPath = filepath.Join(config.StateStoragePath, mountRegistryFile)
+	}
+
+	var mountSlots chan struct{}
+	if config.MaxConcurrentMounts > 0 {
+		mountSlots = make(chan struct{}, config.MaxConcurrentMounts)
+	}
+
 	return &GCSDriver{
-		name:               name,
-		nodeName:           node,
-		endpoint:           endpoint,
-		mountPoint:         BucketMountPath,
-		version:            version,
-		mounter:            mount.New(""),
-		deleteOrphanedPods: deleteOrphanedPods,
+		name:                  config.Name,
+		nodeName:              config.NodeName,
+		endpoint:              config.Endpoint,
+		socketMode:            parsedSocketMode,
+		socketUID:             socketUID,
+		socketGID:             socketGID,
+		mountPoint:            BucketMountPath,
+		keyStoragePath:        config.KeyStoragePath,
+		authFileRoot:          config.AuthFileRoot,
+		components:            components,
+		cacheRootPath:         CacheRootPath,
+		logStoragePath:        LogStoragePath,
+		version:               config.Version,
+		mounter:               mount.New(""),
+		deleteOrphanedPods:    config.DeleteOrphanedPods,
+		orphanReapInterval:    config.OrphanReapInterval,
+		mountRetryTimeout:     config.MountRetryTimeout,
+		unmountGracePeriod:    config.UnmountGracePeriod,
+		mountFailureThreshold: config.MountFailureThreshold,
+		mountFailureCooldown:  config.MountFailureCooldown,
+		mountSlots:            mountSlots,
+		volumeStatsInterval:   config.VolumeStatsInterval,
+		volumeStatsMaxObjects: config.VolumeStatsMaxObjects,
+		mountRegistry:         mountRegistry{path: registryPath},
+		stateStoragePath:      config.StateStoragePath,
+		healthAddress:         config.HealthAddress,
+		metricsAddress:        config.MetricsAddress,
+		readinessBucket:       config.ReadinessBucket,
+		selfTestBucket:        config.SelfTestBucket,
+		snapshotBucket:        config.SnapshotBucket,
+		gcsfusePath:           config.GcsfusePath,
+		gcsfuseLogs:           config.GcsfuseLogs,
+		stageVolumes:          config.StageVolumes,
+		topology:              config.Topology,
+		podOwnership:          config.PodOwnership,
+		gcsDialTimeout:        config.GCSDialTimeout,
+		gcsRequestTimeout:     config.GCSRequestTimeout,
+		gcsRetryTimeout:       config.GCSRetryTimeout,
+		storageEmulatorHost:   config.StorageEmulatorHost,
+		gcsEndpoint:           config.GCSEndpoint,
 	}, nil
 }
 
@@ -42,6 +212,16 @@ func (d *GCSDriver) Run() error {
 		return errors.New("--bucket-mount-path is required")
 	}
 
+	// Only the node mounts anything
+	if d.components.node {
+		if err := d.checkGcsfuse(); err != nil {
+			return err
+		}
+		if err := d.loadMountRegistry(); err != nil {
+			klog.Errorf("Loading the mount registry failed with error: %v", err)
+		}
+	}
+
 	scheme, address, err := util.ParseEndpoint(d.endpoint)
 	if err != nil {
 		return err
@@ -51,6 +231,10 @@ func (d *GCSDriver) Run() error {
 	if err != nil {
 		return err
 	}
+	if err := d.prepareSocket(address); err != nil {
+		listener.Close()
+		return err
+	}
 
 	logHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		resp, err := handler(ctx, req)
@@ -62,7 +246,7 @@ func (d *GCSDriver) Run() error {
 		return resp, err
 	}
 
-	if d.deleteOrphanedPods {
+	if d.components.node && d.deleteOrphanedPods {
 		err = d.RunPodCleanup()
 
 		if err != nil {
@@ -70,15 +254,56 @@ func (d *GCSDriver) Run() error {
 		}
 	}
 
-	klog.V(1).Infof("Starting Google Cloud Storage CSI Driver - driver: `%s`, version: `%s`, gRPC socket: `%s`", d.name, d.version, d.endpoint)
+	// Keys of a previous run outlive it when the directory is a volume, their mounts did not
+	util.CleanupKeys(d.keyStoragePath)
+
+	d.stopCh = make(chan struct{})
+	if d.components.node && d.orphanReapInterval > 0 {
+		go d.RunOrphanReaper(d.stopCh)
+	}
+	if d.components.node {
+		go d.watchDrainSignals(d.stopCh)
+	}
+	if d.components.node && d.volumeStatsInterval > 0 {
+		go d.RunVolumeStatsRefresher(d.stopCh)
+	}
+
+	if d.selfTestBucket != "" {
+		d.selfTestErr = d.runSelfTest(context.Background())
+	}
+
+	if d.healthAddress != "" {
+		go d.RunHealthServer(d.healthAddress)
+	}
+
+	if d.metricsAddress != "" {
+		go d.RunMetricsServer(d.metricsAddress)
+	}
+
+	klog.V(1).Infof("Starting Google Cloud Storage CSI Driver - driver: `%s`, version: `%s`, commit: `%s`, gRPC socket: `%s`, components: `%s`", d.name, d.version, gitCommit, d.endpoint, d.components)
 	d.server = grpc.NewServer(grpc.UnaryInterceptor(logHandler))
 	csi.RegisterIdentityServer(d.server, d)
-	csi.RegisterNodeServer(d.server, d)
-	csi.RegisterControllerServer(d.server, d)
-	return d.server.Serve(listener)
+	if d.components.node {
+		csi.RegisterNodeServer(d.server, d)
+	}
+	if d.components.controller {
+		csi.RegisterControllerServer(d.server, d)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		klog.V(1).Infof("Received %v, stopping CSI driver", <-signals)
+		d.stop()
+	}()
+
+	err = d.server.Serve(listener)
+	util.CleanupKeys(d.keyStoragePath)
+	return err
 }
 
 func (d *GCSDriver) stop() {
+	close(d.stopCh)
 	d.server.Stop()
 	klog.V(1).Info("CSI driver stopped")
 }
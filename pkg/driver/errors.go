@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Domain of the ErrorInfo of controller errors
+const ErrorDomain = "gcs.csi.ofek.dev"
+
+// Reasons of the ErrorInfo of controller errors, which automation may rely on unlike messages
+const (
+	ReasonInvalidParameters   = "INVALID_PARAMETERS"
+	ReasonBucketNotFound      = "BUCKET_NOT_FOUND"
+	ReasonPermissionDenied    = "PERMISSION_DENIED"
+	ReasonQuotaExceeded       = "QUOTA_EXCEEDED"
+	ReasonBucketNamesTaken    = "BUCKET_NAMES_TAKEN"
+	ReasonBucketNotEmpty      = "BUCKET_NOT_EMPTY"
+	ReasonConcurrentOperation = "CONCURRENT_OPERATION"
+	ReasonCapacityMismatch    = "CAPACITY_MISMATCH"
+	ReasonDeadlineExceeded    = "DEADLINE_EXCEEDED"
+	ReasonCanceled            = "CANCELED"
+	ReasonInternal            = "INTERNAL"
+)
+
+// Keys of the metadata of the ErrorInfo of controller errors, only present when known
+const (
+	ErrorMetadataVolume  = "volume"
+	ErrorMetadataBucket  = "bucket"
+	ErrorMetadataProject = "project"
+)
+
+// Wire compatible with google.rpc.ErrorInfo, which the vendored genproto predates, so clients can decode it with
+// errdetails.ErrorInfo
+type ErrorInfo struct {
+	Reason   string            `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"`
+	Domain   string            `protobuf:"bytes,2,opt,name=domain,proto3" json:"domain,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,3,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *ErrorInfo) Reset()         { *m = ErrorInfo{} }
+func (m *ErrorInfo) String() string { return proto.CompactTextString(m) }
+func (*ErrorInfo) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*ErrorInfo)(nil), "google.rpc.ErrorInfo")
+}
+
+// Errors whose reason is more specific than their code tells
+func reasonError(code codes.Code, reason string, format string, args ...interface{}) error {
+	st, err := status.Newf(code, format, args...).WithDetails(&ErrorInfo{Reason: reason, Domain: ErrorDomain})
+	if err != nil {
+		return status.Errorf(code, format, args...)
+	}
+	return st.Err()
+}
+
+func codeReason(code codes.Code) string {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return ReasonInvalidParameters
+	case codes.NotFound:
+		return ReasonBucketNotFound
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return ReasonPermissionDenied
+	case codes.ResourceExhausted:
+		return ReasonQuotaExceeded
+	case codes.Aborted:
+		return ReasonConcurrentOperation
+	case codes.AlreadyExists:
+		return ReasonCapacityMismatch
+	case codes.DeadlineExceeded:
+		return ReasonDeadlineExceeded
+	case codes.Canceled:
+		return ReasonCanceled
+	}
+	return ReasonInternal
+}
+
+// Attaches an ErrorInfo with the metadata to err, keeping its code and message as well as the reason of an
+// ErrorInfo it already has
+func withErrorInfo(err error, metadata map[string]string) error {
+	if err == nil {
+		return nil
+	}
+
+	st := status.Convert(err)
+	info := &ErrorInfo{Reason: codeReason(st.Code()), Domain: ErrorDomain, Metadata: map[string]string{}}
+	for _, detail := range st.Details() {
+		if existing, ok := detail.(*ErrorInfo); ok {
+			info.Reason = existing.Reason
+			for key, value := range existing.Metadata {
+				info.Metadata[key] = value
+			}
+		}
+	}
+	for key, value := range metadata {
+		if value != "" {
+			info.Metadata[key] = value
+		}
+	}
+
+	detailed, detailsErr := status.New(st.Code(), st.Message()).WithDetails(info)
+	if detailsErr != nil {
+		return err
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"github.com/ofek/csi-gcs/pkg/util"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Kubelet passes the tokens asked for by tokenRequests of the CSIDriver as JSON keyed by audience
+	serviceAccountTokensKey = "csi.storage.k8s.io/serviceAccount.tokens"
+	federationTokenURL      = "https://sts.googleapis.com/v1/token"
+	federationScope         = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// Replaced in tests
+var impersonationURL = googleImpersonationURL
+
+func googleImpersonationURL(serviceAccount string) string {
+	return fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", serviceAccount)
+}
+
+type serviceAccountToken struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+// Picks the token for the audience, or the only one kubelet passed
+func podServiceAccountToken(volumeContext map[string]string, audience string) (string, error) {
+	contents, found := volumeContext[serviceAccountTokensKey]
+	if !found {
+		return "", fmt.Errorf("kubelet passed no service account token, add tokenRequests to the CSIDriver %s", CSIDriverName)
+	}
+
+	var tokens map[string]serviceAccountToken
+	if err := json.Unmarshal([]byte(contents), &tokens); err != nil {
+		return "", fmt.Errorf("could not parse service account tokens: %v", err)
+	}
+	if token, found := tokens[audience]; found {
+		return token.Token, nil
+	}
+	if len(tokens) == 1 {
+		for _, token := range tokens {
+			return token.Token, nil
+		}
+	}
+	return "", fmt.Errorf("kubelet passed no service account token for audience %s", audience)
+}
+
+// The credential configuration of an external account, which gcsfuse reads as its key file. It reads the token from
+// tokenFile whenever it exchanges it, so replacing the file on republish keeps the mount working.
+func federationConfig(audience string, tokenURL string, serviceAccount string, tokenFile string) ([]byte, error) {
+	config := map[string]interface{}{
+		"type":               "external_account",
+		"audience":           audience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          tokenURL,
+		"credential_source":  map[string]string{"file": tokenFile},
+	}
+	if serviceAccount != "" {
+		config["service_account_impersonation_url"] = impersonationURL(serviceAccount)
+	}
+	return json.Marshal(config)
+}
+
+// Writes the token of the pod and the configuration pointing at it for gcsfuse, the driver itself exchanges the token
+// directly as our version of oauth2 predates external accounts
+func (driver *GCSDriver) federatedCredentials(req *csi.NodePublishVolumeRequest, options map[string]string) (clientOpt option.ClientOption, keyFile string, err error) {
+	audience := options[flags.FLAG_AUDIENCE]
+	token, err := podServiceAccountToken(req.GetVolumeContext(), audience)
+	if err != nil {
+		return nil, "", status.Errorf(codes.FailedPrecondition, "Volume %s needs a token of the pod for %s %s: %v", req.GetVolumeId(), flags.FLAG_AUTH_TYPE, flags.AUTH_TYPE_FEDERATION, err)
+	}
+
+	tokenURL := federationTokenURL
+	if value := options[flags.FLAG_TOKEN_URL]; value != "" {
+		tokenURL = value
+	}
+
+	tokenFile, err := util.GetMountToken(token, driver.keyStoragePath, req.GetTargetPath())
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := federationConfig(audience, tokenURL, options[flags.FLAG_SERVICE_ACCOUNT], tokenFile)
+	if err != nil {
+		return nil, "", status.Errorf(codes.Internal, "Failed to create credential configuration: %v", err)
+	}
+	keyFile, err = util.GetMountKey(map[string]string{"key": string(config)}, driver.keyStoragePath, req.GetTargetPath())
+	if err != nil {
+		return nil, "", err
+	}
+
+	source := &federatedTokenSource{
+		audience:         audience,
+		tokenURL:         tokenURL,
+		serviceAccount:   options[flags.FLAG_SERVICE_ACCOUNT],
+		subjectTokenFile: tokenFile,
+	}
+	return option.WithTokenSource(oauth2.ReuseTokenSource(nil, source)), keyFile, nil
+}
+
+// Exchanges a token of a Kubernetes service account for an access token with the Security Token Service and, given
+// a service account, that one for an access token of the service account. Like gcsfuse, it reads the token from the
+// file every time.
+type federatedTokenSource struct {
+	audience         string
+	tokenURL         string
+	serviceAccount   string
+	subjectTokenFile string
+}
+
+func (s *federatedTokenSource) Token() (*oauth2.Token, error) {
+	subjectToken, err := ioutil.ReadFile(s.subjectTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {s.audience},
+		"scope":                {federationScope},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {string(subjectToken)},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:jwt"},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var exchanged struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := doTokenRequest(req, &exchanged); err != nil {
+		return nil, fmt.Errorf("could not exchange the token of the pod: %w", err)
+	}
+	token := &oauth2.Token{AccessToken: exchanged.AccessToken, TokenType: exchanged.TokenType, Expiry: time.Now().Add(time.Duration(exchanged.ExpiresIn) * time.Second)}
+	if s.serviceAccount == "" {
+		return token, nil
+	}
+
+	body, err := json.Marshal(map[string][]string{"scope": {federationScope}})
+	if err != nil {
+		return nil, err
+	}
+	req, err = http.NewRequest(http.MethodPost, impersonationURL(s.serviceAccount), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(req)
+
+	var impersonated struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := doTokenRequest(req, &impersonated); err != nil {
+		return nil, fmt.Errorf("could not impersonate %s: %w", s.serviceAccount, err)
+	}
+	return &oauth2.Token{AccessToken: impersonated.AccessToken, TokenType: "Bearer", Expiry: impersonated.ExpireTime}, nil
+}
+
+// Token sources get no context, so the client bounds how long they may take
+var tokenClient = &http.Client{Timeout: 30 * time.Second}
+
+func doTokenRequest(req *http.Request, result interface{}) error {
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Lets the credential checks tell a rejected token from an unreachable endpoint
+	if resp.StatusCode != http.StatusOK {
+		return &oauth2.RetrieveError{Response: resp, Body: body}
+	}
+	return json.Unmarshal(body, result)
+}
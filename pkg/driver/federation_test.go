@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testAudience = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/eks"
+
+var _ = Describe("Workload Identity Federation", func() {
+	var (
+		d         *GCSDriver
+		keyDir    string
+		server    *httptest.Server
+		exchanged []string
+	)
+
+	var tokens = func(tokens map[string]string) map[string]string {
+		contents := map[string]serviceAccountToken{}
+		for audience, token := range tokens {
+			contents[audience] = serviceAccountToken{Token: token, ExpirationTimestamp: "2030-01-01T00:00:00Z"}
+		}
+		encoded, err := json.Marshal(contents)
+		Expect(err).NotTo(HaveOccurred())
+		return map[string]string{serviceAccountTokensKey: string(encoded)}
+	}
+
+	BeforeEach(func() {
+		var err error
+		keyDir, err = ioutil.TempDir("", "csi-gcs-federation")
+		Expect(err).NotTo(HaveOccurred())
+		d = &GCSDriver{keyStoragePath: keyDir}
+
+		exchanged = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.PostForm.Get("audience")).To(Equal(testAudience))
+				exchanged = append(exchanged, r.PostForm.Get("subject_token"))
+				json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "federated", "token_type": "Bearer", "expires_in": 3600})
+			case "/impersonate":
+				Expect(r.Header.Get("Authorization")).To(Equal("Bearer federated"))
+				json.NewEncoder(w).Encode(map[string]interface{}{"accessToken": "impersonated", "expireTime": "2030-01-01T00:00:00Z"})
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		impersonationURL = func(serviceAccount string) string {
+			return server.URL + "/impersonate"
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		impersonationURL = googleImpersonationURL
+		os.RemoveAll(keyDir)
+	})
+
+	It("Should Pick The Token Of The Audience", func() {
+		Expect(podServiceAccountToken(tokens(map[string]string{testAudience: "a", "other": "b"}), testAudience)).To(Equal("a"))
+		Expect(podServiceAccountToken(tokens(map[string]string{"sts.googleapis.com": "a"}), testAudience)).To(Equal("a"))
+
+		_, err := podServiceAccountToken(tokens(map[string]string{"one": "a", "two": "b"}), testAudience)
+		Expect(err).To(MatchError(ContainSubstring("no service account token for audience")))
+		_, err = podServiceAccountToken(nil, testAudience)
+		Expect(err).To(MatchError(ContainSubstring("add tokenRequests to the CSIDriver")))
+	})
+	It("Should Fail Without A Token Of The Pod", func() {
+		req := &csi.NodePublishVolumeRequest{VolumeId: "test", TargetPath: "/target"}
+		_, _, err := d.federatedCredentials(req, map[string]string{flags.FLAG_AUDIENCE: testAudience})
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+	})
+	It("Should Write A Credential Configuration For gcsfuse", func() {
+		req := &csi.NodePublishVolumeRequest{VolumeId: "test", TargetPath: "/target", VolumeContext: tokens(map[string]string{testAudience: "jwt"})}
+		options := map[string]string{flags.FLAG_AUDIENCE: testAudience, flags.FLAG_SERVICE_ACCOUNT: "csi-gcs@project.iam.gserviceaccount.com"}
+		_, keyFile, err := d.federatedCredentials(req, options)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyFile).To(Equal(util.MountKeyFile(keyDir, "/target")))
+
+		contents, err := ioutil.ReadFile(keyFile)
+		Expect(err).NotTo(HaveOccurred())
+		var config map[string]interface{}
+		Expect(json.Unmarshal(contents, &config)).To(Succeed())
+		Expect(config).To(HaveKeyWithValue("type", "external_account"))
+		Expect(config).To(HaveKeyWithValue("audience", testAudience))
+		Expect(config).To(HaveKeyWithValue("token_url", federationTokenURL))
+		Expect(config).To(HaveKeyWithValue("service_account_impersonation_url", server.URL+"/impersonate"))
+		Expect(config).To(HaveKeyWithValue("credential_source", map[string]interface{}{"file": util.MountTokenFile(keyDir, "/target")}))
+		Expect(ioutil.ReadFile(filepath.Join(keyDir, filepath.Base(util.MountTokenFile(keyDir, "/target"))))).To(Equal([]byte("jwt")))
+	})
+	It("Should Exchange The Token Of The Pod", func() {
+		tokenFile := filepath.Join(keyDir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("first"), 0600)).To(Succeed())
+		source := &federatedTokenSource{audience: testAudience, tokenURL: server.URL + "/token", subjectTokenFile: tokenFile}
+
+		token, err := source.Token()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("federated"))
+
+		// Kubelet replaces the token on republish
+		Expect(ioutil.WriteFile(tokenFile, []byte("second"), 0600)).To(Succeed())
+		source.serviceAccount = "csi-gcs@project.iam.gserviceaccount.com"
+		token, err = source.Token()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.AccessToken).To(Equal("impersonated"))
+		Expect(exchanged).To(Equal([]string{"first", "second"}))
+
+		source.tokenURL = server.URL + "/rejected"
+		_, err = source.Token()
+		Expect(isCredentialRejected(err)).To(BeTrue())
+	})
+})
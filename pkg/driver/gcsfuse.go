@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+var gcsfuseVersionPattern = regexp.MustCompile(`gcsfuse version (\d+\.\d+\.\d+)`)
+
+// Logs the version of gcsfuse and refuses versions that do not understand all of our flags.
+// Failing to determine the version is only a warning as development builds report a commit instead.
+func (d *GCSDriver) checkGcsfuse() error {
+	// The mount helper looks gcsfuse up in PATH, which would find another binary than the one whose version we check
+	if filepath.Base(d.gcsfusePath) != "gcsfuse" {
+		return fmt.Errorf("gcsfuse path must name a binary called gcsfuse, got: %s", d.gcsfusePath)
+	}
+	if strings.Contains(d.gcsfusePath, "/") {
+		if err := os.Setenv("PATH", filepath.Dir(d.gcsfusePath)+string(os.PathListSeparator)+os.Getenv("PATH")); err != nil {
+			return err
+		}
+	}
+
+	output, err := exec.Command(d.gcsfusePath, "--version").CombinedOutput()
+	if err != nil {
+		klog.Warningf("Could not run %s --version: %v", d.gcsfusePath, err)
+		return nil
+	}
+
+	version, err := parseGcsfuseVersion(string(output))
+	if err != nil {
+		klog.Warningf("Could not determine the version of %s: %v", d.gcsfusePath, err)
+		return nil
+	}
+	d.gcsfuseVersion = version
+	klog.V(1).Infof("Using gcsfuse %s from %s", version, d.gcsfusePath)
+
+	if compareVersions(version, MinGcsfuseVersion) < 0 {
+		return fmt.Errorf("gcsfuse %s is older than the minimum supported version %s", version, MinGcsfuseVersion)
+	}
+	if d.gcsfuseLogs && compareVersions(version, MinGcsfuseLogFileVersion) < 0 {
+		klog.Warningf("Not streaming gcsfuse logs since gcsfuse %s is older than %s", version, MinGcsfuseLogFileVersion)
+		d.gcsfuseLogs = false
+	}
+	return nil
+}
+
+// Flags of volumes that only newer releases than MinGcsfuseVersion understand, for any value unless one is given
+var gcsfuseFlagVersions = []struct {
+	flag    string
+	value   string
+	version string
+}{
+	{flags.FLAG_AUTH_TYPE, flags.AUTH_TYPE_NONE, MinGcsfuseAnonymousAccessVersion},
+	{flags.FLAG_AUTH_TYPE, flags.AUTH_TYPE_FEDERATION, MinGcsfuseExternalAccountVersion},
+	{flags.FLAG_CACHE_DIR, "", MinGcsfuseFileCacheVersion},
+	{flags.FLAG_CACHE_MAX_SIZE_MB, "", MinGcsfuseFileCacheVersion},
+	{flags.FLAG_KERNEL_LIST_CACHE_TTL, "", MinGcsfuseKernelListCacheVersion},
+	{flags.FLAG_METADATA_PREFETCH_ON_MOUNT, "", MinGcsfuseMetadataPrefetchVersion},
+}
+
+// Rejects volumes whose flags gcsfuse does not understand, which would otherwise fail to mount with a usage error.
+// Nothing is rejected when the version is unknown, like the log file is used then.
+func (driver *GCSDriver) checkGcsfuseFlags(options map[string]string) error {
+	if driver.gcsfuseVersion == "" {
+		return nil
+	}
+
+	for _, gated := range gcsfuseFlagVersions {
+		value, found := options[gated.flag]
+		if !found || (gated.value != "" && value != gated.value) {
+			continue
+		}
+		if compareVersions(driver.gcsfuseVersion, gated.version) < 0 {
+			return status.Errorf(codes.InvalidArgument, "%s %s needs gcsfuse %s or newer, the node has %s", gated.flag, value, gated.version, driver.gcsfuseVersion)
+		}
+	}
+	return nil
+}
+
+func parseGcsfuseVersion(output string) (string, error) {
+	match := gcsfuseVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("unexpected output: %s", strings.TrimSpace(output))
+	}
+
+	return match[1], nil
+}
+
+// Compares versions of the form MAJOR.MINOR.PATCH
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aPart, _ := strconv.Atoi(aParts[i])
+		bPart, _ := strconv.Atoi(bParts[i])
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return len(aParts) - len(bParts)
+}
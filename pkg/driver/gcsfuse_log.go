@@ -0,0 +1,347 @@
+package driver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"github.com/ofek/csi-gcs/pkg/util"
+	"k8s.io/klog"
+)
+
+// How often to check log files for new lines
+var gcsfuseLogPollInterval = time.Second
+
+// How many of the last lines gcsfuse logged explain a failed mount
+const gcsfuseLogTailLines = 5
+
+// How large log files may grow before what was followed is truncated, as gcsfuse keeps appending for as long as mounted
+var gcsfuseLogTruncateBytes int64 = 1 << 20
+
+// gcsfuse detaches from the mount helper, so it writes its logs to a file per mount which the driver follows.
+// Named after the target like keys and caches so it can be found again on unpublish.
+func (driver *GCSDriver) gcsfuseLogFile(targetPath string) string {
+	hash := sha256.Sum256([]byte(targetPath))
+	return filepath.Join(driver.logStoragePath, hex.EncodeToString(hash[:])+".log")
+}
+
+// The last lines gcsfuse logged for a mount, as its output is gone once it has detached. Empty without a log file.
+func (driver *GCSDriver) gcsfuseLogTail(targetPath string) string {
+	if driver.logStoragePath == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(driver.gcsfuseLogFile(targetPath))
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) > gcsfuseLogTailLines {
+		lines = lines[len(lines)-gcsfuseLogTailLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Volumes with logFile get a log of their own on the host instead, which outlives the container of the driver
+func (driver *GCSDriver) dedicatedGcsfuseLogFile(targetPath string) string {
+	hash := sha256.Sum256([]byte(targetPath))
+	return filepath.Join(driver.stateStoragePath, "logs", hex.EncodeToString(hash[:])+".log")
+}
+
+// Whether the log of a mount is streamed, which volumes being debugged always are unless gcsfuse is too old
+func (driver *GCSDriver) streamsGcsfuseLog(debug bool) bool {
+	if driver.gcsfuseLogs {
+		return true
+	}
+	return debug && driver.writesGcsfuseLogFile()
+}
+
+func (driver *GCSDriver) writesGcsfuseLogFile() bool {
+	return driver.gcsfuseVersion == "" || compareVersions(driver.gcsfuseVersion, MinGcsfuseLogFileVersion) >= 0
+}
+
+// How the dedicated log of a mount is rotated
+type logRotation struct {
+	maxBytes int64
+	backups  int
+}
+
+// Returns nil unless the volume asks for a dedicated log, the options are validated beforehand
+func gcsfuseLogRotation(options map[string]string) *logRotation {
+	if !flags.IsTrue(options, flags.FLAG_LOG_FILE) {
+		return nil
+	}
+
+	rotation := &logRotation{maxBytes: DefaultLogRotateMaxFileSizeMB << 20, backups: DefaultLogRotateBackupFileCount}
+	if value, err := strconv.ParseInt(options[flags.FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB], 10, 64); err == nil {
+		rotation.maxBytes = value << 20
+	}
+	if value, err := strconv.Atoi(options[flags.FLAG_LOG_ROTATE_BACKUPS]); err == nil {
+		rotation.backups = value
+	}
+	return rotation
+}
+
+// Creates the log file for a mount and returns the gcsfuse options writing to it, or nothing if disabled.
+// A non-nil rotation gives the mount a dedicated log.
+func (driver *GCSDriver) prepareGcsfuseLog(targetPath string, debug bool, rotation *logRotation) ([]string, error) {
+	dedicated := rotation != nil && driver.writesGcsfuseLogFile()
+	if !driver.streamsGcsfuseLog(debug) && !dedicated {
+		return nil, nil
+	}
+
+	if dedicated {
+		if err := os.MkdirAll(filepath.Dir(driver.dedicatedGcsfuseLogFile(targetPath)), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(driver.logStoragePath, 0700); err != nil {
+		return nil, err
+	}
+	// Not truncated as gcsfuse may already be writing to it if the target is mounted
+	logFile := driver.gcsfuseLogFile(targetPath)
+	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	return []string{"log_file=" + logFile}, nil
+}
+
+// Streams the log of a mount into ours, or its dedicated log if it has a rotation, until it is unmounted
+func (driver *GCSDriver) startGcsfuseLog(volumeID string, targetPath string, debug bool, rotation *logRotation) {
+	logFile := driver.gcsfuseLogFile(targetPath)
+
+	if rotation != nil && driver.writesGcsfuseLogFile() {
+		dedicated := &rotatingLog{path: driver.dedicatedGcsfuseLogFile(targetPath), maxBytes: rotation.maxBytes, backups: rotation.backups}
+		util.InfoS(2, "Writing gcsfuse log to a dedicated file", "volumeID", volumeID, "targetPath", targetPath, "logFile", dedicated.path)
+		driver.logFollowers.Start(targetPath, func(stop <-chan struct{}) {
+			defer dedicated.Close()
+			err := followLog(logFile, stop, func(line string) {
+				if err := dedicated.WriteLine(line); err != nil {
+					klog.Warningf("Could not write gcsfuse log %s: %v", dedicated.path, err)
+				}
+			})
+			if err != nil {
+				klog.Warningf("Could not follow gcsfuse log %s: %v", logFile, err)
+			}
+		})
+		return
+	}
+
+	if !driver.streamsGcsfuseLog(debug) {
+		return
+	}
+
+	driver.logFollowers.Start(targetPath, func(stop <-chan struct{}) {
+		if err := followLog(logFile, stop, gcsfuseLogEmitter(volumeID, targetPath)); err != nil {
+			klog.Warningf("Could not follow gcsfuse log %s: %v", logFile, err)
+		}
+	})
+}
+
+// Stops streaming the log of a mount, emitting whatever is left, and removes it
+func (driver *GCSDriver) stopGcsfuseLog(volumeID string, targetPath string) {
+	logFile := driver.gcsfuseLogFile(targetPath)
+
+	if !driver.logFollowers.Stop(targetPath) {
+		// Nothing followed it e.g. because mounting failed, so show what gcsfuse had to say
+		if _, err := os.Stat(logFile); err == nil {
+			stop := make(chan struct{})
+			close(stop)
+			followLog(logFile, stop, gcsfuseLogEmitter(volumeID, targetPath))
+		}
+	}
+
+	if err := os.Remove(logFile); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Could not remove gcsfuse log %s: %v", logFile, err)
+	}
+
+	if driver.stateStoragePath == "" {
+		return
+	}
+	dedicated := driver.dedicatedGcsfuseLogFile(targetPath)
+	backups, _ := filepath.Glob(dedicated + ".*")
+	for _, file := range append([]string{dedicated}, backups...) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Could not remove gcsfuse log %s: %v", file, err)
+		}
+	}
+}
+
+// Appends lines to a file, which becomes path.1 once it would grow beyond maxBytes while path.1 becomes path.2 and
+// so on, keeping that many backups. Only used by one goroutine.
+type rotatingLog struct {
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+func (l *rotatingLog) WriteLine(line string) error {
+	if l.file != nil && l.size > 0 && l.size+int64(len(line))+1 > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if l.file == nil {
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		l.file, l.size = file, info.Size()
+	}
+
+	written, err := l.file.WriteString(line + "\n")
+	l.size += int64(written)
+	return err
+}
+
+func (l *rotatingLog) rotate() error {
+	l.Close()
+
+	if l.backups == 0 {
+		return os.Remove(l.path)
+	}
+	for i := l.backups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.path+".1")
+}
+
+func (l *rotatingLog) Close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func gcsfuseLogEmitter(volumeID string, targetPath string) func(line string) {
+	return func(line string) {
+		klog.Infof("gcsfuse [volume %s, target %s]: %s", volumeID, targetPath, line)
+	}
+}
+
+// Calls emit for every line of the file, including those appended later, until stop is closed.
+// Lines are emitted only once complete, except for what is left at the end. Once everything of a file larger than
+// gcsfuseLogTruncateBytes was emitted it is truncated, gcsfuse appends so it goes on writing at the start.
+func followLog(path string, stop <-chan struct{}, emit func(line string)) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	pending := ""
+	var offset int64
+	for {
+		data, err := reader.ReadString('\n')
+		pending += data
+		offset += int64(len(data))
+		if err == nil {
+			emit(strings.TrimRight(pending, "\r\n"))
+			pending = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if pending == "" && offset >= gcsfuseLogTruncateBytes {
+			if err := truncateFollowedLog(file, offset); err != nil {
+				return err
+			}
+			reader.Reset(file)
+			offset = 0
+		}
+
+		select {
+		case <-stop:
+			if pending != "" {
+				emit(pending)
+			}
+			return nil
+		case <-time.After(gcsfuseLogPollInterval):
+		}
+	}
+}
+
+// Empties a log that was read up to offset, unless more was written in the meantime
+func truncateFollowedLog(file *os.File, offset int64) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() != offset {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Background work per key which can be stopped and waited for. The zero value is ready to use.
+type followers struct {
+	mu      sync.Mutex
+	entries map[string]*follower
+}
+
+type follower struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Runs fn in the background unless it already runs for key
+func (f *followers) Start(key string, fn func(stop <-chan struct{})) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.entries == nil {
+		f.entries = map[string]*follower{}
+	}
+	if _, found := f.entries[key]; found {
+		return
+	}
+
+	entry := &follower{stop: make(chan struct{}), done: make(chan struct{})}
+	f.entries[key] = entry
+	go func() {
+		defer close(entry.done)
+		fn(entry.stop)
+	}()
+}
+
+// Stops the work of key and waits for it to finish, returns false if there was none
+func (f *followers) Stop(key string) bool {
+	f.mu.Lock()
+	entry, found := f.entries[key]
+	delete(f.entries, key)
+	f.mu.Unlock()
+
+	if !found {
+		return false
+	}
+	close(entry.stop)
+	<-entry.done
+	return true
+}
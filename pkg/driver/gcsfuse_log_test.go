@@ -0,0 +1,197 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/flags"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GcsfuseLog", func() {
+	var logDir string
+
+	BeforeEach(func() {
+		var err error
+		logDir, err = ioutil.TempDir("", "csi-gcs-logs")
+		Expect(err).NotTo(HaveOccurred())
+
+		gcsfuseLogPollInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		gcsfuseLogPollInterval = time.Second
+		os.RemoveAll(logDir)
+	})
+
+	Describe("followLog", func() {
+		It("Should Emit Lines Appended Later", func() {
+			logFile := filepath.Join(logDir, "test.log")
+			Expect(ioutil.WriteFile(logFile, []byte("first\nsec"), 0600)).To(Succeed())
+
+			var mu sync.Mutex
+			lines := []string{}
+			emitted := func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]string{}, lines...)
+			}
+
+			stop := make(chan struct{})
+			done := make(chan error)
+			go func() {
+				done <- followLog(logFile, stop, func(line string) {
+					mu.Lock()
+					defer mu.Unlock()
+					lines = append(lines, line)
+				})
+			}()
+			Eventually(emitted).Should(Equal([]string{"first"}))
+
+			file, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString("ond\nthird")
+			Expect(err).NotTo(HaveOccurred())
+			file.Close()
+			Eventually(emitted).Should(Equal([]string{"first", "second"}))
+
+			close(stop)
+			Expect(<-done).To(Succeed())
+			Expect(emitted()).To(Equal([]string{"first", "second", "third"}))
+		})
+		It("Should Truncate What Was Followed", func() {
+			gcsfuseLogTruncateBytes = 10
+			defer func() { gcsfuseLogTruncateBytes = 1 << 20 }()
+
+			logFile := filepath.Join(logDir, "test.log")
+			Expect(ioutil.WriteFile(logFile, []byte("first line\n"), 0600)).To(Succeed())
+
+			var mu sync.Mutex
+			lines := []string{}
+			emitted := func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]string{}, lines...)
+			}
+
+			stop := make(chan struct{})
+			done := make(chan error)
+			go func() {
+				done <- followLog(logFile, stop, func(line string) {
+					mu.Lock()
+					defer mu.Unlock()
+					lines = append(lines, line)
+				})
+			}()
+			Eventually(func() (int64, error) {
+				info, err := os.Stat(logFile)
+				if err != nil {
+					return -1, err
+				}
+				return info.Size(), nil
+			}).Should(BeZero())
+
+			file, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString("second\n")
+			Expect(err).NotTo(HaveOccurred())
+			file.Close()
+			Eventually(emitted).Should(Equal([]string{"first line", "second"}))
+
+			close(stop)
+			Expect(<-done).To(Succeed())
+			Expect(ioutil.ReadFile(logFile)).To(Equal([]byte("second\n")))
+		})
+	})
+
+	Describe("rotatingLog", func() {
+		It("Should Keep A Number Of Backups", func() {
+			logFile := filepath.Join(logDir, "test.log")
+			l := &rotatingLog{path: logFile, maxBytes: 8, backups: 2}
+			defer l.Close()
+
+			for _, line := range []string{"one", "two", "three", "four", "five"} {
+				Expect(l.WriteLine(line)).To(Succeed())
+			}
+			Expect(ioutil.ReadFile(logFile)).To(Equal([]byte("five\n")))
+			Expect(ioutil.ReadFile(logFile + ".1")).To(Equal([]byte("four\n")))
+			Expect(ioutil.ReadFile(logFile + ".2")).To(Equal([]byte("three\n")))
+			Expect(logFile + ".3").NotTo(BeAnExistingFile())
+		})
+		It("Should Drop Rotated Lines Without Backups", func() {
+			logFile := filepath.Join(logDir, "test.log")
+			l := &rotatingLog{path: logFile, maxBytes: 8, backups: 0}
+			defer l.Close()
+
+			Expect(l.WriteLine("one")).To(Succeed())
+			Expect(l.WriteLine("two")).To(Succeed())
+			Expect(l.WriteLine("three")).To(Succeed())
+			Expect(ioutil.ReadFile(logFile)).To(Equal([]byte("three\n")))
+			Expect(logFile + ".1").NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("GCSDriver", func() {
+		It("Should Follow Logs Until Unpublished", func() {
+			d := &GCSDriver{logStoragePath: logDir, gcsfuseLogs: true}
+
+			options, err := d.prepareGcsfuseLog("/target", false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(Equal([]string{"log_file=" + d.gcsfuseLogFile("/target")}))
+			Expect(d.gcsfuseLogFile("/target")).To(BeAnExistingFile())
+			Expect(d.gcsfuseLogFile("/other")).NotTo(Equal(d.gcsfuseLogFile("/target")))
+
+			d.startGcsfuseLog("test", "/target", false, nil)
+			d.startGcsfuseLog("test", "/target", false, nil)
+			Expect(d.logFollowers.entries).To(HaveLen(1))
+
+			d.stopGcsfuseLog("test", "/target")
+			Expect(d.logFollowers.entries).To(BeEmpty())
+			Expect(d.gcsfuseLogFile("/target")).NotTo(BeAnExistingFile())
+		})
+		It("Should Do Nothing When Disabled", func() {
+			d := &GCSDriver{logStoragePath: logDir}
+
+			Expect(d.prepareGcsfuseLog("/target", false, nil)).To(BeEmpty())
+			d.startGcsfuseLog("test", "/target", false, nil)
+			Expect(d.logFollowers.entries).To(BeEmpty())
+		})
+		It("Should Follow Logs Of Debugged Volumes When Disabled", func() {
+			d := &GCSDriver{logStoragePath: logDir, gcsfuseVersion: MinGcsfuseLogFileVersion}
+
+			Expect(d.prepareGcsfuseLog("/target", true, nil)).To(Equal([]string{"log_file=" + d.gcsfuseLogFile("/target")}))
+			d.startGcsfuseLog("test", "/target", true, nil)
+			Expect(d.logFollowers.entries).To(HaveLen(1))
+			d.stopGcsfuseLog("test", "/target")
+
+			d.gcsfuseVersion = "0.38.0"
+			Expect(d.prepareGcsfuseLog("/target", true, nil)).To(BeEmpty())
+		})
+		It("Should Write Logs Of Volumes With logFile To Their Own File", func() {
+			d := &GCSDriver{logStoragePath: logDir, stateStoragePath: filepath.Join(logDir, "state"), gcsfuseVersion: MinGcsfuseLogFileVersion}
+			rotation := gcsfuseLogRotation(map[string]string{flags.FLAG_LOG_FILE: "true", flags.FLAG_LOG_ROTATE_BACKUPS: "1"})
+			Expect(rotation).To(Equal(&logRotation{maxBytes: DefaultLogRotateMaxFileSizeMB << 20, backups: 1}))
+
+			Expect(d.prepareGcsfuseLog("/target", false, rotation)).To(Equal([]string{"log_file=" + d.gcsfuseLogFile("/target")}))
+			dedicated := d.dedicatedGcsfuseLogFile("/target")
+			Expect(filepath.Dir(dedicated)).To(Equal(filepath.Join(logDir, "state", "logs")))
+			Expect(filepath.Dir(dedicated)).To(BeADirectory())
+
+			Expect(ioutil.WriteFile(d.gcsfuseLogFile("/target"), []byte("mounted\n"), 0600)).To(Succeed())
+			d.startGcsfuseLog("test", "/target", false, rotation)
+			Eventually(func() ([]byte, error) { return ioutil.ReadFile(dedicated) }).Should(Equal([]byte("mounted\n")))
+
+			Expect(ioutil.WriteFile(dedicated+".1", nil, 0600)).To(Succeed())
+			d.stopGcsfuseLog("test", "/target")
+			Expect(dedicated).NotTo(BeAnExistingFile())
+			Expect(dedicated + ".1").NotTo(BeAnExistingFile())
+		})
+		It("Should Not Write Dedicated Logs Without logFile", func() {
+			Expect(gcsfuseLogRotation(map[string]string{flags.FLAG_LOG_FILE: "false", flags.FLAG_LOG_ROTATE_BACKUPS: "1"})).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"github.com/ofek/csi-gcs/pkg/flags"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Gcsfuse", func() {
+	Describe("parseGcsfuseVersion", func() {
+		It("Should Parse Release Versions", func() {
+			Expect(parseGcsfuseVersion("gcsfuse version 0.34.1 (Go version go1.15.6)\n")).To(Equal("0.34.1"))
+		})
+		It("Should Reject Development Builds", func() {
+			_, err := parseGcsfuseVersion("gcsfuse version unknown (Go version go1.15.6)\n")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("checkGcsfuse", func() {
+		It("Should Reject Binaries The Mount Helper Would Not Find", func() {
+			d := &GCSDriver{gcsfusePath: "/opt/gcsfuse-2/bin/gcsfuse2"}
+			Expect(d.checkGcsfuse()).To(MatchError(ContainSubstring("gcsfuse2")))
+		})
+	})
+	Describe("compareVersions", func() {
+		It("Should Compare Numerically", func() {
+			Expect(compareVersions("0.34.1", "0.34.1")).To(Equal(0))
+			Expect(compareVersions("0.9.0", "0.28.0")).To(BeNumerically("<", 0))
+			Expect(compareVersions("1.0.0", "0.28.0")).To(BeNumerically(">", 0))
+		})
+	})
+	Describe("checkGcsfuseFlags", func() {
+		It("Should Reject Flags Newer Than gcsfuse", func() {
+			d := &GCSDriver{gcsfuseVersion: "0.34.1"}
+			err := d.checkGcsfuseFlags(map[string]string{flags.FLAG_KERNEL_LIST_CACHE_TTL: "1m"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring(MinGcsfuseKernelListCacheVersion))
+
+			d.gcsfuseVersion = MinGcsfuseKernelListCacheVersion
+			Expect(d.checkGcsfuseFlags(map[string]string{flags.FLAG_KERNEL_LIST_CACHE_TTL: "1m"})).To(Succeed())
+		})
+		It("Should Reject The File Cache Before gcsfuse 2", func() {
+			d := &GCSDriver{gcsfuseVersion: "1.4.2"}
+			err := d.checkGcsfuseFlags(map[string]string{flags.FLAG_CACHE_MAX_SIZE_MB: "512"})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring(flags.FLAG_CACHE_MAX_SIZE_MB))
+		})
+		It("Should Only Reject Gated Values", func() {
+			d := &GCSDriver{gcsfuseVersion: "0.34.1"}
+			err := d.checkGcsfuseFlags(map[string]string{flags.FLAG_AUTH_TYPE: flags.AUTH_TYPE_NONE})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(d.checkGcsfuseFlags(map[string]string{flags.FLAG_AUTH_TYPE: flags.AUTH_TYPE_KEY})).To(Succeed())
+		})
+		It("Should Allow Anything When The Version Is Unknown", func() {
+			d := &GCSDriver{}
+			Expect(d.checkGcsfuseFlags(map[string]string{flags.FLAG_METADATA_PREFETCH_ON_MOUNT: "sync"})).To(Succeed())
+		})
+	})
+})
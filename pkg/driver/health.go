@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	"google.golang.org/api/option"
+	"k8s.io/klog"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// Serves /healthz, which only tells that the process is up, and /readyz, which tells whether GCS is reachable
+func (d *GCSDriver) RunHealthServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", d.handleReadiness)
+
+	klog.V(1).Infof("Serving health checks on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Health server failed with error: %v", err)
+	}
+}
+
+func (d *GCSDriver) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	bucketName, keyFile, err := d.readinessTarget()
+	if d.selfTestErr != nil {
+		// Credentials that failed the self-test are not going to mount anything either
+		err = fmt.Errorf("self-test failed: %v", d.selfTestErr)
+	} else if err != nil {
+		klog.Warningf("Could not choose a bucket to check readiness: %v", err)
+	} else if bucketName != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		err = d.probeBucket(ctx, bucketName, keyFile)
+	}
+
+	if err != nil {
+		klog.Warningf("Readiness check failed: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// The configured bucket or else any mounted one along with the key it was mounted with, if any.
+// No bucket means there is nothing to check.
+func (d *GCSDriver) readinessTarget() (bucketName string, keyFile string, err error) {
+	if d.readinessBucket != "" {
+		return d.readinessBucket, "", nil
+	}
+
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, mountPoint := range mountPoints {
+		if !isGcsfuseMount(mountPoint) || !strings.HasPrefix(mountPoint.Path, d.mountPoint+"/") {
+			continue
+		}
+
+		keyFile = util.MountKeyFile(d.keyStoragePath, mountPoint.Path)
+		if _, err := os.Stat(keyFile); err != nil {
+			keyFile = ""
+		}
+		return mountPoint.Device, keyFile, nil
+	}
+
+	return "", "", nil
+}
+
+func (d *GCSDriver) probeBucket(ctx context.Context, bucketName string, keyFile string) error {
+	var clientOpts []option.ClientOption
+	if keyFile != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(keyFile))
+	}
+
+	client, err := d.newStorageClient(ctx, clientOpts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Bucket(bucketName).Attrs(ctx)
+	return err
+}
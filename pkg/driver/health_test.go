@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		d          *GCSDriver
+		mounter    *mount.FakeMounter
+		volumePath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "csi-gcs-health")
+		Expect(err).NotTo(HaveOccurred())
+
+		mounter = mount.NewFakeMounter(nil)
+		d = &GCSDriver{
+			name:           CSIDriverName,
+			nodeName:       "test-node",
+			mounter:        mounter,
+			mountPoint:     filepath.Join(volumePath, "pods"),
+			keyStoragePath: filepath.Join(volumePath, "keys"),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(volumePath)
+	})
+
+	Describe("readinessTarget", func() {
+		It("Should Prefer The Configured Bucket", func() {
+			d.readinessBucket = "configured"
+			Expect(mounter.Mount("mounted", filepath.Join(d.mountPoint, "pod", "volume"), "gcsfuse", nil)).To(Succeed())
+
+			bucketName, keyFile, err := d.readinessTarget()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bucketName).To(Equal("configured"))
+			Expect(keyFile).To(BeEmpty())
+		})
+		It("Should Fall Back To A Mounted Bucket And Its Key", func() {
+			targetPath := filepath.Join(d.mountPoint, "pod", "volume")
+			Expect(mounter.Mount("other", "/mnt/other", "ext4", nil)).To(Succeed())
+			Expect(mounter.Mount("mounted", targetPath, "gcsfuse", nil)).To(Succeed())
+			expectedKeyFile, err := util.GetMountKey(map[string]string{"key": "{}"}, d.keyStoragePath, targetPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			bucketName, keyFile, err := d.readinessTarget()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bucketName).To(Equal("mounted"))
+			Expect(keyFile).To(Equal(expectedKeyFile))
+		})
+	})
+
+	Describe("handleReadiness", func() {
+		It("Should Be Ready When There Is Nothing To Check", func() {
+			recorder := httptest.NewRecorder()
+			d.handleReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+		It("Should Not Be Ready When The Self-Test Failed", func() {
+			d.selfTestErr = errors.New("writing: 403")
+			recorder := httptest.NewRecorder()
+			d.handleReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Body.String()).To(ContainSubstring("self-test failed: writing: 403"))
+		})
+	})
+
+	Describe("runSelfTest", func() {
+		It("Should Fail When The Probe Object Cannot Be Written", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer server.Close()
+			d.storageEmulatorHost = server.URL
+			d.selfTestBucket = "probe"
+
+			err := d.runSelfTest(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("writing csi-gcs-self-test/"))
+		})
+	})
+})
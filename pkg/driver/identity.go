@@ -13,23 +13,37 @@ func (d *GCSDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReq
 	return &csi.GetPluginInfoResponse{
 		Name:          d.name,
 		VendorVersion: driverVersion,
+		Manifest: map[string]string{
+			"gitCommit":      gitCommit,
+			"gcsfuseVersion": d.gcsfuseVersion,
+		},
 	}, nil
 }
 
 func (d *GCSDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	klog.V(4).Infof("Method GetPluginCapabilities called with: %+v", req)
 
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	// Sidecars of the node plugin must not expect a controller when only the node is served
+	resp := &csi.GetPluginCapabilitiesResponse{}
+	if d.components.controller {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-		},
-	}, nil
+		})
+	}
+	if d.topology {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	return resp, nil
 }
 
 func (d *GCSDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
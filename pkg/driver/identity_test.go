@@ -0,0 +1,24 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identity", func() {
+	Describe("GetPluginInfo", func() {
+		It("Should Report The Build", func() {
+			defer func(version string, commit string) { driverVersion, gitCommit = version, commit }(driverVersion, gitCommit)
+			driverVersion, gitCommit = "v1.0.0", "0123abc"
+
+			d := &GCSDriver{name: CSIDriverName}
+			resp, err := d.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetVendorVersion()).To(Equal("v1.0.0"))
+			Expect(resp.GetManifest()).To(HaveKeyWithValue("gitCommit", "0123abc"))
+		})
+	})
+})
@@ -0,0 +1,42 @@
+package driver
+
+import "sync"
+
+// A mutex per key, entries are removed once nobody holds or waits for them. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// Blocks until the lock of key is acquired and returns the function releasing it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedMutexEntry{}
+	}
+	entry, found := k.locks[key]
+	if !found {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.waiters++
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+
+	return func() {
+		entry.mu.Unlock()
+
+		k.mu.Lock()
+		entry.waiters--
+		if entry.waiters == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
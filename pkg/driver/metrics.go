@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "csi_gcs"
+
+// Only holds our own metrics, the Go runtime ones are of little use for telling how mounts are doing
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_publish_duration_seconds",
+		Help:      "How long NodePublishVolume calls took, including failed ones.",
+		// Mounting takes seconds, and up to the mount timeout of a minute when GCS is slow
+		Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	})
+	mountSuccesses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_successes_total",
+		Help:      "NodePublishVolume calls that succeeded.",
+	})
+	mountFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "NodePublishVolume calls that failed, by the gRPC code of the error e.g. deadline_exceeded.",
+	}, []string{"class"})
+	orphanReaps = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphan_reaps_total",
+		Help:      "Orphaned gcsfuse mounts that were unmounted.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(publishDuration, mountSuccesses, mountFailures, orphanReaps)
+}
+
+func recordPublish(duration time.Duration, err error) {
+	publishDuration.Observe(duration.Seconds())
+	if err == nil {
+		mountSuccesses.Inc()
+	} else {
+		mountFailures.WithLabelValues(errorClass(err)).Inc()
+	}
+}
+
+// The gRPC code in snake case e.g. resource_exhausted, codes.Unknown for errors without one
+func errorClass(err error) string {
+	code := status.Code(err)
+	if code == codes.OK {
+		code = codes.Unknown
+	}
+
+	var b strings.Builder
+	for i, r := range code.String() {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Counts gcsfuse mounts on every scrape as publishes, unpublishes, remounts and the reaper all change them
+func (d *GCSDriver) activeMountsCollector() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_mounts",
+		Help:      "gcsfuse mounts on the node.",
+	}, func() float64 {
+		mountPoints, err := d.mounter.List()
+		if err != nil {
+			klog.Warningf("Could not list mounts: %v", err)
+			return 0
+		}
+
+		active := 0
+		for _, mountPoint := range mountPoints {
+			if isGcsfuseMount(mountPoint) && strings.HasPrefix(mountPoint.Path, d.mountPoint+"/") {
+				active++
+			}
+		}
+		return float64(active)
+	})
+}
+
+// Serves the metrics of the node plugin on /metrics
+func (d *GCSDriver) RunMetricsServer(address string) {
+	if err := metricsRegistry.Register(d.activeMountsCollector()); err != nil {
+		klog.Errorf("Could not register active mounts metric: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	klog.V(1).Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Metrics server failed with error: %v", err)
+	}
+}
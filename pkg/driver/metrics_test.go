@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Metrics", func() {
+	It("Should Classify Errors By Their Code", func() {
+		Expect(errorClass(status.Error(codes.DeadlineExceeded, "slow"))).To(Equal("deadline_exceeded"))
+		Expect(errorClass(status.Error(codes.Internal, "broken"))).To(Equal("internal"))
+		Expect(errorClass(errors.New("plain"))).To(Equal("unknown"))
+	})
+	It("Should Count Failed Publishes By Class", func() {
+		failures := testutil.ToFloat64(mountFailures.WithLabelValues("invalid_argument"))
+		successes := testutil.ToFloat64(mountSuccesses)
+
+		d := &GCSDriver{}
+		_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{})
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		Expect(testutil.ToFloat64(mountFailures.WithLabelValues("invalid_argument"))).To(Equal(failures + 1))
+		Expect(testutil.ToFloat64(mountSuccesses)).To(Equal(successes))
+	})
+	It("Should Count Successful Publishes", func() {
+		successes := testutil.ToFloat64(mountSuccesses)
+		recordPublish(time.Second, nil)
+		Expect(testutil.ToFloat64(mountSuccesses)).To(Equal(successes + 1))
+	})
+	It("Should Count Active gcsfuse Mounts", func() {
+		mountPoint, err := ioutil.TempDir("", "csi-gcs-metrics")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(mountPoint)
+
+		mounter := mount.NewFakeMounter(nil)
+		Expect(mounter.Mount("bucket", filepath.Join(mountPoint, "a"), "gcsfuse", nil)).To(Succeed())
+		Expect(mounter.Mount("bucket", filepath.Join(mountPoint, "b"), "fuse.gcsfuse", nil)).To(Succeed())
+		Expect(mounter.Mount("/dev/sda", filepath.Join(mountPoint, "c"), "ext4", nil)).To(Succeed())
+		Expect(mounter.Mount("bucket", "/elsewhere", "gcsfuse", nil)).To(Succeed())
+
+		d := &GCSDriver{mountPoint: mountPoint, mounter: mounter}
+		Expect(testutil.ToFloat64(d.activeMountsCollector())).To(Equal(2.0))
+	})
+})
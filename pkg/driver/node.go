@@ -2,10 +2,14 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -13,16 +17,27 @@ import (
 	"github.com/ofek/csi-gcs/pkg/flags"
 	"github.com/ofek/csi-gcs/pkg/util"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sys/unix"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/klog"
 	"k8s.io/utils/mount"
 )
 
-func (driver *GCSDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (driver *GCSDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (response *csi.NodePublishVolumeResponse, err error) {
 	klog.V(4).Infof("Method NodePublishVolume called with: %s", protosanitizer.StripSecrets(req))
 
+	start := time.Now()
+	defer func() { recordPublish(time.Since(start), err) }()
+
+	// Kubernetes keeps retrying, by then the pod has likely been scheduled elsewhere
+	if driver.drain.Draining() {
+		return nil, status.Error(codes.Unavailable, "Node is draining, no new volumes are published")
+	}
+
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
@@ -39,112 +54,424 @@ func (driver *GCSDriver) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		return nil, status.Error(codes.InvalidArgument, "Only volumeMode Filesystem is supported")
 	}
 
-	// Default Options
-	var options = map[string]string{
-		"bucket":   req.GetVolumeId(),
-		"gid":      strconv.FormatInt(DefaultGid, 10),
-		"dirMode":  "0" + strconv.FormatInt(DefaultDirMode, 8),
-		"fileMode": "0" + strconv.FormatInt(DefaultFileMode, 8),
+	// Publishing would otherwise succeed without mounting anything, or overwrite the key of the mount
+	owner, claimed := driver.publishedTargets.Claim(req.GetTargetPath(), req.GetVolumeId())
+	if owner != req.GetVolumeId() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Target path %s already holds volume %s", req.GetTargetPath(), owner)
 	}
 
-	// Merge Secret Options
-	options = flags.MergeSecret(options, req.Secrets)
+	if driver.stageVolumes {
+		err = driver.bindStagedVolume(ctx, req)
+	} else {
+		err = driver.mountBucket(ctx, req)
+	}
+	if err != nil {
+		if claimed {
+			driver.publishedTargets.Release(req.GetTargetPath())
+		}
+		return nil, err
+	}
 
-	// Merge MountFlag Options
-	options = flags.MergeMountOptions(options, req.GetVolumeCapability().GetMount().GetMountFlags())
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
-	// Merge Volume Context
-	if req.VolumeContext != nil {
-		options = flags.MergeFlags(options, req.VolumeContext)
+// Mounts the bucket with gcsfuse at the target of the request, which is the staging path when staging
+func (driver *GCSDriver) mountBucket(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	options := publishDefaults(req.GetVolumeId())
+
+	// Let the pod own all inodes unless an owner is chosen
+	podName, podNamespace := req.VolumeContext["csi.storage.k8s.io/pod.name"], req.VolumeContext["csi.storage.k8s.io/pod.namespace"]
+	if podName != "" && podNamespace != "" {
+		securityContext, err := util.GetPodSecurityContext(podName, podNamespace)
+		if err != nil {
+			klog.Warningf("Could not look up the security context of pod %s/%s: %v", podNamespace, podName, err)
+		} else {
+			podOwnership(options, securityContext, driver.podOwnership)
+		}
 	}
 
-	var clientOpt option.ClientOption
-	keyFile := ""
-	if len(req.Secrets) == 0 {
-		// Find default credentials
-		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
+	options, err := publishOptions(options, req.Secrets, req.GetVolumeCapability(), req.VolumeContext)
+	if err != nil {
+		return err
+	}
+
+	// gcsfuse has no use for the key as GCS decrypts transparently, but it is worth recording which one is in use
+	if kmsKeyId := options[flags.FLAG_KMS_KEY_ID]; kmsKeyId != "" {
+		util.InfoS(2, "Volume is encrypted with a KMS key", "volumeID", req.GetVolumeId(), "kmsKeyId", kmsKeyId)
+	}
+
+	if err := driver.checkGcsfuseFlags(options); err != nil {
+		return err
+	}
+
+	anonymous := options[flags.FLAG_AUTH_TYPE] == flags.AUTH_TYPE_NONE
+	if anonymous && !isReadOnly(req) {
+		return status.Errorf(codes.InvalidArgument, "Volumes with authType %s must be mounted read-only", flags.AUTH_TYPE_NONE)
+	}
+
+	clientOpt, keyFile, err := driver.nodeCredentials(ctx, req, options)
+	if err != nil {
+		return err
+	}
+
+	// Creates a client.
+	client, err := driver.newStorageClient(ctx, clientOpt)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to create client: %v", err)
+	}
+
+	// Creates a Bucket instance.
+	bucket := bucketHandle(client, options[flags.FLAG_BUCKET], options[flags.FLAG_BILLING_PROJECT])
+
+	// Only complete snapshots have a marker
+	if snapshotId := options[flags.FLAG_SNAPSHOT_ID]; snapshotId != "" {
+		_, name, _ := parseSnapshotId(snapshotId)
+		_, err := bucket.Object(name).Attrs(ctx)
+		if isRequesterPaysError(err) {
+			return requesterPaysError(options[flags.FLAG_BUCKET])
+		}
+		if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+			return status.Errorf(codes.NotFound, "Snapshot %s does not exist or is not complete", snapshotId)
+		}
 		if err != nil {
-			return nil, err
+			return status.Errorf(codes.Internal, "Failed to look up snapshot %s: %v", snapshotId, err)
+		}
+	} else if !anonymous {
+		// Public buckets rarely allow anonymous users to read their metadata
+		bucketExists, err := util.BucketExists(ctx, bucket)
+		if isRequesterPaysError(err) {
+			return requesterPaysError(options[flags.FLAG_BUCKET])
 		}
-		clientOpt = option.WithCredentials(creds)
-	} else {
-		// Retrieve Secret Key
-		var err error
-		keyFile, err = util.GetKey(req.Secrets, KeyStoragePath)
 		if err != nil {
-			return nil, err
+			return status.Errorf(codes.Internal, "Failed to check if bucket exists: %v", err)
+		}
+		if !bucketExists {
+			return status.Errorf(codes.NotFound, "Bucket %s does not exist", options[flags.FLAG_BUCKET])
 		}
-		clientOpt = option.WithCredentialsFile(keyFile)
 	}
 
-	// Creates a client.
-	client, err := storage.NewClient(ctx, clientOpt)
+	// Volumes that keep failing the same way are left alone for a while rather than starting gcsfuse each time
+	mountConfig := mountConfig(options, req.Secrets)
+	if err := driver.mountBreakers.Check(req.GetVolumeId(), mountConfig); err != nil {
+		return err
+	}
+
+	mountTimeout := DefaultMountTimeout
+	if value, err := time.ParseDuration(options[flags.FLAG_MOUNT_TIMEOUT]); err == nil && value > 0 {
+		mountTimeout = value
+	}
+	mountCtx, cancel := context.WithTimeout(ctx, mountTimeout)
+	defer cancel()
+
+	cacheOptions, err := driver.prepareCache(req.GetTargetPath(), options)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create client: %v", err)
+		return status.Errorf(codes.Internal, "Failed to prepare cache: %v", err)
 	}
 
-	// Creates a Bucket instance.
-	bucket := client.Bucket(options[flags.FLAG_BUCKET])
+	debug := flags.IsTrue(options, flags.FLAG_DEBUG)
+	rotation := gcsfuseLogRotation(options)
+	if rotation != nil && driver.stateStoragePath == "" {
+		return status.Errorf(codes.FailedPrecondition, "%s needs the node plugin to have a --state-storage-path", flags.FLAG_LOG_FILE)
+	}
+	logOptions, err := driver.prepareGcsfuseLog(req.GetTargetPath(), debug, rotation)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to prepare gcsfuse log: %v", err)
+	}
+	if (debug || rotation != nil) && logOptions == nil {
+		klog.Warningf("The gcsfuse log of volume %s at %s is lost as gcsfuse %s is older than %s", req.GetVolumeId(), req.GetTargetPath(), driver.gcsfuseVersion, MinGcsfuseLogFileVersion)
+	}
 
-	bucketExists, err := util.BucketExists(ctx, bucket)
+	mountOptions := append(gcsfuseMountOptions(req, keyFile, driver.gcsfuseEndpoint(), options), cacheOptions...)
+	mountOptions = append(mountOptions, logOptions...)
+	mounted, err := driver.mountTarget(mountCtx, options[flags.FLAG_BUCKET], req.TargetPath, mountOptions)
+	driver.mountBreakers.Record(req.GetVolumeId(), mountConfig, err, driver.mountFailureThreshold, driver.mountFailureCooldown)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to check if bucket exists: %v", err)
+		driver.stopGcsfuseLog(req.GetVolumeId(), req.GetTargetPath())
+		return err
+	}
+	driver.startGcsfuseLog(req.GetVolumeId(), req.GetTargetPath(), debug, rotation)
+	// Also when already mounted, as the registry may have been lost
+	pid, _ := findGcsfuseProcess(req.GetTargetPath())
+	driver.mountRegistry.Add(registeredMount{
+		VolumeID:     req.GetVolumeId(),
+		Bucket:       options[flags.FLAG_BUCKET],
+		TargetPath:   req.GetTargetPath(),
+		PID:          pid,
+		MountOptions: mountOptions,
+	})
+	if driver.volumeStatsInterval > 0 {
+		driver.volumeStats.Track(req.GetTargetPath(), options[flags.FLAG_BUCKET], objectPrefix(options[flags.FLAG_ONLY_DIR]), options[flags.FLAG_BILLING_PROJECT], clientOpt)
+	}
+	if flags.IsTrue(options, flags.FLAG_REMOUNT_ON_FAILURE) {
+		driver.superviseMount(req.GetVolumeId(), options[flags.FLAG_BUCKET], req.GetTargetPath(), mountOptions, mountTimeout)
 	}
-	if !bucketExists {
-		return nil, status.Errorf(codes.NotFound, "Bucket %s does not exist", options[flags.FLAG_BUCKET])
+	if !mounted {
+		return nil
+	}
+	util.InfoS(2, "Mounted volume",
+		"volumeID", req.GetVolumeId(),
+		"bucket", options[flags.FLAG_BUCKET],
+		"targetPath", req.GetTargetPath(),
+		"readOnly", isReadOnly(req),
+		"implicitDirs", flags.IsTrue(options, flags.FLAG_IMPLICIT_DIRS),
+		"debug", debug,
+		"podNamespace", req.VolumeContext["csi.storage.k8s.io/pod.namespace"],
+		"podName", req.VolumeContext["csi.storage.k8s.io/pod.name"],
+	)
+
+	// Staging mounts do not belong to any pod
+	if driver.deleteOrphanedPods && req.VolumeContext["csi.storage.k8s.io/pod.name"] != "" {
+		err = util.RegisterMount(
+			req.VolumeId,
+			req.TargetPath,
+			driver.nodeName,
+			req.VolumeContext["csi.storage.k8s.io/pod.namespace"],
+			req.VolumeContext["csi.storage.k8s.io/pod.name"],
+			options,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mounts the bucket unless the target already is a mount point, in which case mounted is false.
+// Calls for the same target are serialized so that concurrent publishes cannot start two gcsfuse processes.
+func (driver *GCSDriver) mountTarget(ctx context.Context, bucket string, targetPath string, mountOptions []string) (mounted bool, err error) {
+	defer driver.targetLocks.Lock(targetPath)()
+
+	notMnt, err := driver.prepareTarget(targetPath)
+	if err != nil || !notMnt {
+		return false, err
 	}
 
-	notMnt, err := driver.mounter.IsLikelyNotMountPoint(req.TargetPath)
+	release, err := driver.acquireMountSlot(ctx)
 	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(req.TargetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+		return false, err
+	}
+	defer release()
+
+	mountErr := driver.mountWithRetry(ctx, bucket, targetPath, mountOptions)
+	if mountErr != nil {
+		cause := mountErr.Last()
+		if errors.Is(cause, context.DeadlineExceeded) {
+			return false, status.Error(codes.DeadlineExceeded, mountErr.Error())
+		}
+		if errors.Is(cause, context.Canceled) {
+			return false, status.Error(codes.Canceled, mountErr.Error())
+		}
+		if os.IsPermission(cause) {
+			return false, status.Error(codes.PermissionDenied, mountErr.Error())
 		}
+		if strings.Contains(mountErrorCause(cause), "invalid argument") {
+			return false, status.Error(codes.InvalidArgument, mountErr.Error())
+		}
+		return false, status.Error(codes.Internal, mountErr.Error())
 	}
 
+	return true, nil
+}
+
+// Creates the target directory unless it exists, which some container runtimes leave to the driver. Its owner and
+// mode do not matter as the root of the mount takes the uid, gid and dirMode of the volume.
+func (driver *GCSDriver) prepareTarget(targetPath string) (notMnt bool, err error) {
+	notMnt, err = driver.mounter.IsLikelyNotMountPoint(targetPath)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(targetPath, 0750); err != nil {
+			return false, status.Error(codes.Internal, err.Error())
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
 	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+		return false, nil
 	}
 
+	// Files can be bind mounted over, but not mounted with gcsfuse, and are never what a pod expects
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
+	if !info.IsDir() {
+		return false, status.Errorf(codes.FailedPrecondition, "Target path %s exists but is not a directory", targetPath)
+	}
+	return true, nil
+}
+
+// Waits until fewer than the maximum number of mounts are in progress
+func (driver *GCSDriver) acquireMountSlot(ctx context.Context) (release func(), err error) {
+	if driver.mountSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case driver.mountSlots <- struct{}{}:
+		return func() { <-driver.mountSlots }, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return nil, status.Error(codes.Canceled, "Cancelled while waiting for a concurrent mount to finish")
+		}
+		return nil, status.Errorf(codes.ResourceExhausted, "Timed out waiting for one of %d concurrent mounts to finish", cap(driver.mountSlots))
+	}
+}
+
+// The fsGroup of the pod owns all inodes. With ownedByUser its user does too and nobody else has access, as gcsfuse
+// mounts with allow_other would otherwise be readable by every user of the node.
+func podOwnership(options map[string]string, securityContext *corev1.PodSecurityContext, ownedByUser bool) {
+	if securityContext == nil {
+		return
+	}
+	if securityContext.FSGroup != nil {
+		options[flags.FLAG_GID] = strconv.FormatInt(*securityContext.FSGroup, 10)
+	}
+	if !ownedByUser || (securityContext.FSGroup == nil && securityContext.RunAsUser == nil) {
+		return
+	}
+
+	if securityContext.RunAsUser != nil {
+		options[flags.FLAG_UID] = strconv.FormatInt(*securityContext.RunAsUser, 10)
+	}
+	options[flags.FLAG_DIR_MODE] = "0770"
+	options[flags.FLAG_FILE_MODE] = "0660"
+}
+
+func gcsfuseMountOptions(req *csi.NodePublishVolumeRequest, keyFile string, endpoint string, options map[string]string) []string {
 	mountOptions := []string{"allow_other"}
 	if keyFile != "" {
 		mountOptions = append(mountOptions, fmt.Sprintf("key_file=%s", keyFile))
 	}
+	if options[flags.FLAG_AUTH_TYPE] == flags.AUTH_TYPE_NONE {
+		mountOptions = append(mountOptions, "anonymous_access")
+	}
+	if endpoint != "" {
+		mountOptions = append(mountOptions, fmt.Sprintf("endpoint=%s", endpoint))
+	}
 	mountOptions = append(mountOptions, flags.ExtraFlags(options)...)
-	if req.GetReadonly() {
+	// Snapshots are never written to, whatever the pod asks for
+	if isReadOnly(req) || options[flags.FLAG_SNAPSHOT_ID] != "" {
 		mountOptions = append(mountOptions, "ro")
 	}
 
-	err = driver.mounter.Mount(options[flags.FLAG_BUCKET], req.TargetPath, "gcsfuse", mountOptions)
-	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
+	return mountOptions
+}
+
+// Empty unless an emulator or a custom endpoint is configured
+func (driver *GCSDriver) gcsfuseEndpoint() string {
+	if driver.storageEmulatorHost != "" {
+		return emulatorURL(driver.storageEmulatorHost)
+	}
+	if driver.gcsEndpoint != "" {
+		return endpointURL(driver.gcsEndpoint)
+	}
+
+	return ""
+}
+
+func isReadOnly(req *csi.NodePublishVolumeRequest) bool {
+	if req.GetReadonly() {
+		return true
+	}
+
+	// Enforce the access mode of the PersistentVolumeClaim even if the pod did not ask for it
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+func (driver *GCSDriver) nodeCredentials(ctx context.Context, req *csi.NodePublishVolumeRequest, options map[string]string) (clientOpt option.ClientOption, keyFile string, err error) {
+	secrets := req.GetSecrets()
+
+	if authFile, found := options[flags.FLAG_AUTH_FILE]; found {
+		if len(secrets) > 0 {
+			klog.Warningf("Ignoring secrets of volume %s because it has an %s", options[flags.FLAG_BUCKET], flags.FLAG_AUTH_FILE)
 		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		keyFile, err = driver.authFilePath(authFile)
+		if err != nil {
+			return nil, "", err
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return option.WithCredentialsFile(keyFile), keyFile, nil
 	}
 
-	if driver.deleteOrphanedPods {
-		err = util.RegisterMount(
-			req.VolumeId,
-			req.TargetPath,
-			driver.nodeName,
-			req.VolumeContext["csi.storage.k8s.io/pod.namespace"],
-			req.VolumeContext["csi.storage.k8s.io/pod.name"],
-			options,
-		)
+	// The emulator accepts anything, but gcsfuse still wants credentials unless the volume is anonymous
+	if driver.storageEmulatorHost != "" && len(secrets) == 0 {
+		return option.WithoutAuthentication(), "", nil
+	}
+
+	switch options[flags.FLAG_AUTH_TYPE] {
+	case flags.AUTH_TYPE_WORKLOAD_IDENTITY:
+		if _, keyExists := secrets["key"]; keyExists {
+			klog.Warningf("Ignoring secret 'key' of volume %s because authType is %s", options[flags.FLAG_BUCKET], flags.AUTH_TYPE_WORKLOAD_IDENTITY)
+		}
+
+		// gcsfuse will use the same identity through the metadata server
+		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
 		if err != nil {
-			return nil, err
+			return nil, "", status.Errorf(codes.Unauthenticated, "Workload identity credentials are unavailable: %v", err)
+		}
+		return option.WithCredentials(creds), "", nil
+	case flags.AUTH_TYPE_FEDERATION:
+		if len(secrets) > 0 {
+			klog.Warningf("Ignoring secrets of volume %s because authType is %s", options[flags.FLAG_BUCKET], flags.AUTH_TYPE_FEDERATION)
+		}
+		return driver.federatedCredentials(req, options)
+	case flags.AUTH_TYPE_NONE:
+		if len(secrets) > 0 {
+			klog.Warningf("Ignoring secrets of volume %s because authType is %s", options[flags.FLAG_BUCKET], flags.AUTH_TYPE_NONE)
 		}
+		return option.WithoutAuthentication(), "", nil
 	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	if len(secrets) == 0 {
+		// Find default credentials
+		creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
+		if err != nil {
+			return nil, "", err
+		}
+		return option.WithCredentials(creds), "", nil
+	}
+
+	// Retrieve Secret Key
+	keyFile, err = util.GetMountKey(secrets, driver.keyStoragePath, req.GetTargetPath())
+	if err != nil {
+		return nil, "", err
+	}
+	return option.WithCredentialsFile(keyFile), keyFile, nil
+}
+
+// Resolves a key file below the auth file root, which links may not lead out of as volumes could then read any file
+// the driver can. Fails unless the file can be read, as gcsfuse would only report that after it has daemonized.
+func (driver *GCSDriver) authFilePath(authFile string) (string, error) {
+	if driver.authFileRoot == "" {
+		return "", status.Errorf(codes.FailedPrecondition, "%s %s can't be used as the driver has no --auth-file-root", flags.FLAG_AUTH_FILE, authFile)
+	}
+
+	root, err := filepath.EvalSymlinks(driver.authFileRoot)
+	if err != nil {
+		return "", status.Errorf(codes.FailedPrecondition, "Auth file root %s is unavailable: %v", driver.authFileRoot, err)
+	}
+	keyFile, err := filepath.EvalSymlinks(filepath.Join(root, authFile))
+	if err != nil {
+		return "", status.Errorf(codes.FailedPrecondition, "%s %s is unavailable: %v", flags.FLAG_AUTH_FILE, authFile, err)
+	}
+	if !strings.HasPrefix(keyFile, root+string(filepath.Separator)) {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s leads out of the auth file root", flags.FLAG_AUTH_FILE, authFile)
+	}
+
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return "", status.Errorf(codes.FailedPrecondition, "%s %s is not readable: %v", flags.FLAG_AUTH_FILE, authFile, err)
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		return "", status.Errorf(codes.FailedPrecondition, "%s %s is not a file", flags.FLAG_AUTH_FILE, authFile)
+	}
+	return keyFile, nil
 }
 
 func (driver *GCSDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (response *csi.NodeUnpublishVolumeResponse, err error) {
@@ -158,48 +485,87 @@ func (driver *GCSDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeU
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	notMnt, err := driver.mounter.IsLikelyNotMountPoint(req.TargetPath)
+	if err := driver.unmountTarget(ctx, req.GetVolumeId(), req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+	driver.stagedTargets.Remove(req.GetTargetPath())
+	driver.publishedTargets.Release(req.GetTargetPath())
 
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &csi.NodeUnpublishVolumeResponse{}, nil
-		}
-		// This error happens when the node container is restarted and the connection is lost
-		if strings.Contains(err.Error(), "transport endpoint is not connected") {
-			notMnt = false
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+	if driver.deleteOrphanedPods {
+		err = util.UnregisterMount(req.VolumeId, req.TargetPath, driver.nodeName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Error(err)
 		}
 	}
-	if notMnt {
-		return &csi.NodeUnpublishVolumeResponse{}, nil
-	}
 
-	err = mount.CleanupMountPoint(req.GetTargetPath(), driver.mounter, false)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// Unmounts the target and removes everything that belonged to its mount, succeeding if there is nothing to do
+func (driver *GCSDriver) unmountTarget(ctx context.Context, volumeID string, targetPath string) error {
+	// Before locking the target as a remount in progress holds the lock
+	driver.stopSupervising(targetPath)
+	defer driver.targetLocks.Lock(targetPath)()
+
+	// Before unmounting as afterwards nothing ties gcsfuse to the target, bind mounts have none
+	pid, err := findGcsfuseProcess(targetPath)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		klog.Warningf("Could not find gcsfuse process of %s: %v", targetPath, err)
 	}
 
-	if driver.deleteOrphanedPods {
-		err = util.UnregisterMount(req.VolumeId, req.TargetPath, driver.nodeName)
-		if err != nil {
-			klog.Error(err)
+	// Also succeeds if the target is gone or no longer mounted e.g. after a node reboot
+	err = mount.CleanupMountPoint(targetPath, driver.mounter, false)
+	if err != nil {
+		notMnt, mntErr := driver.mounter.IsLikelyNotMountPoint(targetPath)
+		if mntErr != nil || !notMnt {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		klog.V(4).Infof("Target path %s was unmounted concurrently: %v", targetPath, err)
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return status.Error(codes.Internal, err.Error())
 		}
 	}
+	// Before removing the key and cache, which gcsfuse may still be using while it flushes
+	if pid != 0 {
+		driver.awaitGcsfuseExit(volumeID, targetPath, pid)
+	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	keyFile := util.MountKeyFile(driver.keyStoragePath, targetPath)
+	util.CleanupKey(keyFile, driver.keyStoragePath)
+	util.CleanupKey(util.MountTokenFile(driver.keyStoragePath, targetPath), driver.keyStoragePath)
+	driver.credentials.Forget(keyFile)
+	driver.cleanupCache(targetPath)
+	driver.stopGcsfuseLog(volumeID, targetPath)
+	driver.mountRegistry.Remove(targetPath)
+	driver.volumeStats.Untrack(targetPath)
+	util.InfoS(2, "Unmounted volume", "volumeID", volumeID, "targetPath", targetPath)
+
+	return nil
 }
 
 func (driver *GCSDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	klog.V(4).Infof("Method NodeGetInfo called with: %s", protosanitizer.StripSecrets(req))
 
-	return &csi.NodeGetInfoResponse{NodeId: driver.nodeName}, nil
+	resp := &csi.NodeGetInfoResponse{NodeId: driver.nodeName}
+	if driver.topology {
+		zone, err := gceZone()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to get the zone of the node from the metadata server: %v", err)
+		}
+		resp.AccessibleTopology, err = zoneTopology(zone)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return resp, nil
 }
 
 func (driver *GCSDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	klog.V(4).Infof("Method NodeGetCapabilities called with: %s", protosanitizer.StripSecrets(req))
 
-	return &csi.NodeGetCapabilitiesResponse{Capabilities: []*csi.NodeServiceCapability{
+	capabilities := []*csi.NodeServiceCapability{
 		{
 			Type: &csi.NodeServiceCapability_Rpc{
 				Rpc: &csi.NodeServiceCapability_RPC{
@@ -207,25 +573,212 @@ func (driver *GCSDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeG
 				},
 			},
 		},
-	}}, nil
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+	}
+
+	if driver.stageVolumes {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
+// With staging every bucket is mounted once per node at the staging path, which publishing bind mounts into each pod
 func (driver *GCSDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	klog.V(4).Infof("Method NodeStageVolume called with: %s", protosanitizer.StripSecrets(req))
 
-	return nil, status.Errorf(codes.Unimplemented, "NodeStageVolume: not implemented by %s", driver.name)
+	if !driver.stageVolumes {
+		return nil, status.Errorf(codes.Unimplemented, "NodeStageVolume: not implemented by %s", driver.name)
+	}
+
+	if driver.drain.Draining() {
+		return nil, status.Error(codes.Unavailable, "Node is draining, no new volumes are staged")
+	}
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
+	}
+
+	if req.GetVolumeCapability().GetMount() == nil || req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Only volumeMode Filesystem is supported")
+	}
+
+	// Left behind when gcsfuse exited and nothing remounted it
+	restaged, err := driver.unmountDeadStage(req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	// Pods are only known when publishing, so nothing pod specific such as the fsGroup applies to the mount
+	err = driver.mountBucket(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         req.GetVolumeId(),
+		TargetPath:       req.GetStagingTargetPath(),
+		VolumeCapability: req.GetVolumeCapability(),
+		Secrets:          req.GetSecrets(),
+		VolumeContext:    req.GetVolumeContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if restaged {
+		driver.rebindStagedTargets(req.GetStagingTargetPath())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (driver *GCSDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	klog.V(4).Infof("Method NodeUnstageVolume called with: %s", protosanitizer.StripSecrets(req))
 
-	return nil, status.Errorf(codes.Unimplemented, "NodeUnstageVolume: not implemented by %s", driver.name)
+	if !driver.stageVolumes {
+		return nil, status.Errorf(codes.Unimplemented, "NodeUnstageVolume: not implemented by %s", driver.name)
+	}
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	// The container orchestrator unpublishes every target first
+	if err := driver.unmountTarget(ctx, req.GetVolumeId(), req.GetStagingTargetPath()); err != nil {
+		return nil, err
+	}
+	driver.stagedTargets.RemoveStage(req.GetStagingTargetPath())
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (driver *GCSDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	klog.V(4).Infof("Method NodeGetVolumeStats called with: %s", protosanitizer.StripSecrets(req))
 
-	return nil, status.Errorf(codes.Unimplemented, "NodeGetVolumeStats: not implemented by %s", driver.name)
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	if message, failed := driver.remountFailures.Get(req.GetVolumePath()); failed {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+		}, nil
+	}
+
+	notMnt, err := driver.mounter.IsLikelyNotMountPoint(req.GetVolumePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, "Volume path not found")
+		}
+		// The mount is still registered but gcsfuse is gone
+		if strings.Contains(err.Error(), "transport endpoint is not connected") {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: err.Error()},
+			}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		return nil, status.Error(codes.NotFound, "Volume not mounted")
+	}
+
+	var stats unix.Statfs_t
+	if err := unix.Statfs(req.GetVolumePath(), &stats); err != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: err.Error()},
+		}, nil
+	}
+
+	volumeCondition := &csi.VolumeCondition{Abnormal: false, Message: "Volume is mounted"}
+	keyFile := util.MountKeyFile(driver.keyStoragePath, req.GetVolumePath())
+	if _, err := os.Stat(keyFile); err == nil {
+		if err := driver.credentials.Check(ctx, keyFile); err != nil {
+			volumeCondition = &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("The key the volume was mounted with has been rejected, recreate the pod to use a new one: %v", err),
+			}
+		}
+	}
+
+	blockSize := int64(stats.Bsize)
+	usage := []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(stats.Blocks) * blockSize,
+			Available: int64(stats.Bavail) * blockSize,
+			Used:      int64(stats.Blocks-stats.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(stats.Files),
+			Available: int64(stats.Ffree),
+			Used:      int64(stats.Files - stats.Ffree),
+		},
+	}
+
+	// gcsfuse makes up its numbers, the objects counted last time are closer to the truth even if stale
+	if counted, found := driver.countedVolumeUsage(req.GetVolumePath()); found {
+		usage[0].Used, usage[0].Available = counted.bytes, remaining(usage[0].Total, counted.bytes)
+		usage[1].Used, usage[1].Available = counted.objects, remaining(usage[1].Total, counted.objects)
+		if !volumeCondition.Abnormal {
+			atLeast := ""
+			if counted.truncated {
+				atLeast = " at least"
+			}
+			volumeCondition.Message = fmt.Sprintf("Volume is mounted, usage of%s %d objects counted %s ago", atLeast, counted.objects, time.Since(counted.countedAt).Round(time.Second))
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: volumeCondition,
+	}, nil
+}
+
+func remaining(total int64, used int64) int64 {
+	if used > total {
+		return 0
+	}
+	return total - used
+}
+
+// Objects of an onlyDir are below the directory and a slash
+func objectPrefix(onlyDir string) string {
+	onlyDir = strings.Trim(onlyDir, "/")
+	if onlyDir == "" {
+		return ""
+	}
+	return onlyDir + "/"
 }
 
 func (driver *GCSDriver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -252,5 +805,35 @@ func (driver *GCSDriver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 		return nil, status.Error(codes.NotFound, "Volume not mounted")
 	}
 
-	return &csi.NodeExpandVolumeResponse{}, nil
+	// Buckets are unbounded so there is nothing to resize, the capacity label is updated by the controller
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// The volume published at each target. Only tracks publishes since the driver started. The zero value is ready to use.
+type publishedTargets struct {
+	mu      sync.Mutex
+	volumes map[string]string
+}
+
+// Claims the target for the volume unless it holds another one, returns the volume holding it
+// and whether it was claimed just now
+func (p *publishedTargets) Claim(targetPath string, volumeID string) (owner string, claimed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if owner, found := p.volumes[targetPath]; found {
+		return owner, false
+	}
+	if p.volumes == nil {
+		p.volumes = map[string]string{}
+	}
+	p.volumes[targetPath] = volumeID
+	return volumeID, true
+}
+
+func (p *publishedTargets) Release(targetPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.volumes, targetPath)
 }
@@ -0,0 +1,803 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/mount"
+)
+
+// Takes a while to mount, like gcsfuse does
+type slowMounter struct {
+	*mount.FakeMounter
+}
+
+func (m *slowMounter) Mount(source string, target string, fstype string, options []string) error {
+	time.Sleep(100 * time.Millisecond)
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+var _ = Describe("Node", func() {
+	var (
+		d          *GCSDriver
+		mounter    *mount.FakeMounter
+		volumePath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "csi-gcs-node")
+		Expect(err).NotTo(HaveOccurred())
+
+		mounter = mount.NewFakeMounter(nil)
+		d = &GCSDriver{name: CSIDriverName, nodeName: "test-node", mounter: mounter, keyStoragePath: filepath.Join(volumePath, "keys")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(volumePath)
+	})
+
+	Describe("podOwnership", func() {
+		user, group := int64(1000), int64(2000)
+
+		It("Should Let The fsGroup Own Inodes", func() {
+			options := publishDefaults("test")
+			podOwnership(options, &corev1.PodSecurityContext{RunAsUser: &user, FSGroup: &group}, false)
+			Expect(options).To(HaveKeyWithValue("gid", "2000"))
+			Expect(options).NotTo(HaveKey("uid"))
+			Expect(options).To(HaveKeyWithValue("fileMode", "0664"))
+		})
+		It("Should Let The User Own Inodes When Enabled", func() {
+			options := publishDefaults("test")
+			podOwnership(options, &corev1.PodSecurityContext{RunAsUser: &user, FSGroup: &group}, true)
+			Expect(options).To(HaveKeyWithValue("uid", "1000"))
+			Expect(options).To(HaveKeyWithValue("gid", "2000"))
+			Expect(options).To(HaveKeyWithValue("dirMode", "0770"))
+			Expect(options).To(HaveKeyWithValue("fileMode", "0660"))
+
+			// Chosen owners and modes win
+			options, err := publishOptions(options, nil, &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}, map[string]string{"uid": "0", "fileMode": "0644"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("uid", "0"))
+			Expect(options).To(HaveKeyWithValue("fileMode", "0644"))
+			Expect(options).To(HaveKeyWithValue("dirMode", "0770"))
+		})
+		It("Should Keep The Defaults Without A Security Context", func() {
+			for _, securityContext := range []*corev1.PodSecurityContext{nil, {}} {
+				options := publishDefaults("test")
+				podOwnership(options, securityContext, true)
+				Expect(options).To(Equal(publishDefaults("test")))
+			}
+		})
+	})
+
+	Describe("NodeGetInfo", func() {
+		AfterEach(func() {
+			gceZone = metadata.Zone
+		})
+
+		It("Should Report The Zone, Region And Multi-Region Of The Node", func() {
+			d.topology = true
+			gceZone = func() (string, error) { return "us-central1-a", nil }
+
+			resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetNodeId()).To(Equal("test-node"))
+			Expect(resp.GetAccessibleTopology().GetSegments()).To(Equal(map[string]string{
+				TopologyKeyZone:        "us-central1-a",
+				TopologyKeyRegion:      "us-central1",
+				TopologyKeyMultiRegion: "us",
+			}))
+		})
+		It("Should Not Report Topology Unless Enabled", func() {
+			gceZone = func() (string, error) { return "", errors.New("not on GCE") }
+
+			resp, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetAccessibleTopology()).To(BeNil())
+		})
+		It("Should Fail Without The Metadata Server", func() {
+			d.topology = true
+			gceZone = func() (string, error) { return "", errors.New("not on GCE") }
+
+			_, err := d.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			Expect(status.Code(err)).To(Equal(codes.Internal))
+		})
+	})
+
+	Describe("NodeGetVolumeStats", func() {
+		It("Should Report Usage Of Mounted Volumes", func() {
+			Expect(mounter.Mount("test", volumePath, "gcsfuse", nil)).To(Succeed())
+
+			resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetUsage()).To(HaveLen(2))
+			Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeFalse())
+		})
+		It("Should Fail For Unmounted Volumes", func() {
+			_, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath})
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+		})
+		It("Should Report Rejected Keys As Abnormal", func() {
+			Expect(mounter.Mount("test", volumePath, "gcsfuse", nil)).To(Succeed())
+			_, err := util.GetMountKey(map[string]string{"key": "{}"}, d.keyStoragePath, volumePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			checks := 0
+			d.credentials.check = func(ctx context.Context, keyFile string) error {
+				checks++
+				return &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}
+			}
+
+			req := &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath}
+			for i := 0; i < 2; i++ {
+				resp, err := d.NodeGetVolumeStats(context.Background(), req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+				Expect(resp.GetVolumeCondition().GetMessage()).To(ContainSubstring("recreate the pod"))
+			}
+			Expect(checks).To(Equal(1))
+		})
+		It("Should Not Blame Keys For Network Errors", func() {
+			Expect(mounter.Mount("test", volumePath, "gcsfuse", nil)).To(Succeed())
+			_, err := util.GetMountKey(map[string]string{"key": "{}"}, d.keyStoragePath, volumePath)
+			Expect(err).NotTo(HaveOccurred())
+			d.credentials.check = func(ctx context.Context, keyFile string) error {
+				return errors.New("dial tcp: i/o timeout")
+			}
+
+			resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeFalse())
+		})
+		It("Should Report Broken Mounts As Abnormal", func() {
+			Expect(mounter.Mount("test", volumePath, "gcsfuse", nil)).To(Succeed())
+			mounter.MountCheckErrors = map[string]error{volumePath: os.NewSyscallError("stat", syscall.ENOTCONN)}
+
+			resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+		})
+	})
+
+	Describe("gcsfuseMountOptions", func() {
+		var capability = func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+			return &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}
+		}
+
+		It("Should Mount Read-Only Access Modes Read-Only", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{})).To(ContainElement("ro"))
+		})
+		It("Should Mount Writable Access Modes Read-Write", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{})).NotTo(ContainElement("ro"))
+		})
+		It("Should Honor The Readonly Field", func() {
+			req := &csi.NodePublishVolumeRequest{Readonly: true, VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{})).To(ContainElement("ro"))
+		})
+		It("Should Mount Anonymously Without Credentials", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{"authType": "none"})).To(ContainElement("anonymous_access"))
+		})
+		It("Should Pass The Billing Project To gcsfuse", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{"billingProject": "my-project"})).To(ContainElement("billing_project=my-project"))
+		})
+		It("Should Honor implicitDirs", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{"implicitDirs": "true"})).To(ContainElement("implicit_dirs"))
+			Expect(gcsfuseMountOptions(req, "", "", map[string]string{"implicitDirs": "false"})).NotTo(ContainElement("implicit_dirs"))
+		})
+		It("Should Only Debug The Volume Asking For It", func() {
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			debugged := gcsfuseMountOptions(req, "", "", map[string]string{"debug": "true"})
+			Expect(debugged).To(ContainElement("debug_fuse"))
+			Expect(debugged).To(ContainElement("debug_gcs"))
+			other := gcsfuseMountOptions(req, "", "", map[string]string{})
+			Expect(other).NotTo(ContainElement("debug_fuse"))
+			Expect(other).NotTo(ContainElement("debug_gcs"))
+		})
+		It("Should Point gcsfuse At The Emulator", func() {
+			d.storageEmulatorHost = "localhost:4443"
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", d.gcsfuseEndpoint(), map[string]string{})).To(ContainElement("endpoint=http://localhost:4443"))
+		})
+		It("Should Point gcsfuse At A Custom Endpoint", func() {
+			d.gcsEndpoint = "restricted.googleapis.com"
+			req := &csi.NodePublishVolumeRequest{VolumeCapability: capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+			Expect(gcsfuseMountOptions(req, "", d.gcsfuseEndpoint(), map[string]string{})).To(ContainElement("endpoint=https://restricted.googleapis.com"))
+		})
+		It("Should Only Accept Hosts As Endpoints", func() {
+			for _, host := range []string{"", "restricted.googleapis.com", "private.googleapis.com:443", "199.36.153.4", "[2001:db8::1]:443"} {
+				Expect(validateEndpointHost(host)).To(Succeed(), host)
+			}
+			for _, host := range []string{"https://restricted.googleapis.com", "restricted.googleapis.com/storage/v1", "user@restricted.googleapis.com", ":443", "2001:db8::1", "restricted.googleapis.com:https"} {
+				Expect(validateEndpointHost(host)).NotTo(Succeed(), host)
+			}
+		})
+		It("Should Keep The Emulator Scheme", func() {
+			Expect(emulatorURL("https://gcs.test:4443/")).To(Equal("https://gcs.test:4443"))
+		})
+	})
+
+	Describe("NodePublishVolume", func() {
+		It("Should Reject Writable Anonymous Volumes", func() {
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:   "test",
+				TargetPath: filepath.Join(volumePath, "target"),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+				VolumeContext: map[string]string{"authType": "none"},
+			})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+		It("Should Keep The Key Private Until Unpublished", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"kind": "storage#objects"}`))
+			}))
+			defer server.Close()
+			d.storageEmulatorHost = server.URL
+
+			targetPath := filepath.Join(volumePath, "target")
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:   "test",
+				TargetPath: targetPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+				Secrets: map[string]string{"key": "{}"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			keyFile := util.MountKeyFile(d.keyStoragePath, targetPath)
+			stat, err := os.Stat(keyFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			stat, err = os.Stat(d.keyStoragePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0700)))
+
+			_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keyFile).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("Overlapping Targets", func() {
+		It("Should Refuse To Publish Another Volume To A Target", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"kind": "storage#objects"}`))
+			}))
+			defer server.Close()
+			d.storageEmulatorHost = server.URL
+
+			targetPath := filepath.Join(volumePath, "target")
+			publish := func(volumeID string) error {
+				_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:   volumeID,
+					TargetPath: targetPath,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+					},
+					Secrets: map[string]string{"key": volumeID + "-key"},
+				})
+				return err
+			}
+
+			Expect(publish("bucket-a")).To(Succeed())
+			Expect(publish("bucket-a")).To(Succeed())
+			err := publish("bucket-b")
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			Expect(err.Error()).To(ContainSubstring("bucket-a"))
+			Expect(ioutil.ReadFile(util.MountKeyFile(d.keyStoragePath, targetPath))).To(Equal([]byte("bucket-a-key")))
+
+			mountPoints, err := mounter.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mountPoints).To(HaveLen(1))
+			Expect(mountPoints[0].Device).To(Equal("bucket-a"))
+
+			_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "bucket-a", TargetPath: targetPath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(publish("bucket-b")).To(Succeed())
+		})
+	})
+
+	Describe("Multiple Volumes In One Pod", func() {
+		It("Should Give Every Mount Its Own Key And Flags", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"kind": "storage#objects"}`))
+			}))
+			defer server.Close()
+			d.storageEmulatorHost = server.URL
+
+			podPath := filepath.Join(volumePath, "pod", "volumes", "kubernetes.io~csi")
+			buckets := []string{"bucket-a", "bucket-b", "bucket-c"}
+			for i, bucket := range buckets {
+				_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:   bucket,
+					TargetPath: filepath.Join(podPath, "pv-"+bucket, "mount"),
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+					},
+					Secrets:       map[string]string{"key": bucket + "-key"},
+					VolumeContext: map[string]string{"uid": strconv.Itoa(1000 + i)},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			mountPoints, err := mounter.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mountPoints).To(HaveLen(len(buckets)))
+
+			keyFiles := map[string]bool{}
+			for i, bucket := range buckets {
+				targetPath := filepath.Join(podPath, "pv-"+bucket, "mount")
+				var mountPoint mount.MountPoint
+				for _, candidate := range mountPoints {
+					if candidate.Path == targetPath {
+						mountPoint = candidate
+					}
+				}
+				Expect(mountPoint.Device).To(Equal(bucket))
+
+				keyFile := util.MountKeyFile(d.keyStoragePath, targetPath)
+				Expect(mountPoint.Opts).To(ContainElement("key_file=" + keyFile))
+				Expect(mountPoint.Opts).To(ContainElement("uid=" + strconv.Itoa(1000+i)))
+				Expect(ioutil.ReadFile(keyFile)).To(Equal([]byte(bucket + "-key")))
+				keyFiles[keyFile] = true
+			}
+			Expect(keyFiles).To(HaveLen(len(buckets)))
+		})
+	})
+
+	Describe("Staging", func() {
+		var (
+			server      *httptest.Server
+			stagingPath string
+			capability  *csi.VolumeCapability
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"kind": "storage#objects"}`))
+			}))
+			d.storageEmulatorHost = server.URL
+			d.stageVolumes = true
+
+			stagingPath = filepath.Join(volumePath, "globalmount")
+			capability = &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		publish := func(pod string, readOnly bool) (string, error) {
+			targetPath := filepath.Join(volumePath, pod, "mount")
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "test",
+				StagingTargetPath: stagingPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  capability,
+				Readonly:          readOnly,
+			})
+			return targetPath, err
+		}
+
+		It("Should Advertise Staging Only When Enabled", func() {
+			resp, err := d.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetCapabilities()).To(ContainElement(&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME}},
+			}))
+
+			d.stageVolumes = false
+			resp, err = d.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			for _, capability := range resp.GetCapabilities() {
+				Expect(capability.GetRpc().GetType()).NotTo(Equal(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME))
+			}
+			_, err = d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "test", StagingTargetPath: stagingPath, VolumeCapability: capability})
+			Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+		})
+		It("Should Mount Once And Bind Mount Into Every Pod", func() {
+			_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  capability,
+				Secrets:           map[string]string{"key": "test-key"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			keyFile := util.MountKeyFile(d.keyStoragePath, stagingPath)
+			Expect(keyFile).To(BeAnExistingFile())
+
+			writable, err := publish("pod-a", false)
+			Expect(err).NotTo(HaveOccurred())
+			readOnly, err := publish("pod-b", true)
+			Expect(err).NotTo(HaveOccurred())
+
+			mountPoints, err := mounter.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mountPoints).To(HaveLen(3))
+			for _, mountPoint := range mountPoints {
+				Expect(mountPoint.Device).To(Equal("test"))
+				switch mountPoint.Path {
+				case stagingPath:
+					Expect(mountPoint.Type).To(Equal("gcsfuse"))
+					Expect(mountPoint.Opts).To(ContainElement("key_file=" + keyFile))
+				case writable:
+					Expect(mountPoint.Opts).To(Equal([]string{"bind"}))
+				case readOnly:
+					Expect(mountPoint.Opts).To(Equal([]string{"bind", "ro"}))
+				default:
+					Fail("Unexpected mount at " + mountPoint.Path)
+				}
+			}
+
+			for _, targetPath := range []string{writable, readOnly} {
+				_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(targetPath).NotTo(BeAnExistingFile())
+			}
+			mountPoints, _ = mounter.List()
+			Expect(mountPoints).To(HaveLen(1))
+			Expect(keyFile).To(BeAnExistingFile())
+
+			_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "test", StagingTargetPath: stagingPath})
+			Expect(err).NotTo(HaveOccurred())
+			mountPoints, _ = mounter.List()
+			Expect(mountPoints).To(BeEmpty())
+			Expect(keyFile).NotTo(BeAnExistingFile())
+
+			_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "test", StagingTargetPath: stagingPath})
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("Should Rebind Pods When Staging Again After gcsfuse Exited", func() {
+			crashing := &crashingMounter{FakeMounter: mounter, dead: map[string]bool{}}
+			d.mounter = crashing
+			stage := &csi.NodeStageVolumeRequest{VolumeId: "test", StagingTargetPath: stagingPath, VolumeCapability: capability}
+			_, err := d.NodeStageVolume(context.Background(), stage)
+			Expect(err).NotTo(HaveOccurred())
+			writable, err := publish("pod-a", false)
+			Expect(err).NotTo(HaveOccurred())
+			readOnly, err := publish("pod-b", true)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Bind mounts die along with the mount they were made from
+			for _, path := range []string{stagingPath, writable, readOnly} {
+				crashing.Crash(path)
+			}
+			_, err = publish("pod-c", false)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+
+			mounter.ResetLog()
+			_, err = d.NodeStageVolume(context.Background(), stage)
+			Expect(err).NotTo(HaveOccurred())
+			for _, path := range []string{stagingPath, writable, readOnly} {
+				notMnt, err := crashing.IsLikelyNotMountPoint(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(notMnt).To(BeFalse())
+			}
+			Expect(mounter.GetLog()).To(ContainElement(mount.FakeAction{Action: mount.FakeActionUnmount, Target: readOnly}))
+
+			// Unpublished pods are not bound again
+			_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: writable})
+			Expect(err).NotTo(HaveOccurred())
+			crashing.Crash(stagingPath)
+			_, err = d.NodeStageVolume(context.Background(), stage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writable).NotTo(BeAnExistingFile())
+		})
+		It("Should Not Publish Volumes That Are Not Staged", func() {
+			_, err := publish("pod-a", false)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			Expect(mounter.GetLog()).To(BeEmpty())
+		})
+	})
+
+	Describe("NodeExpandVolume", func() {
+		It("Should Accept Any Size", func() {
+			Expect(mounter.Mount("test", volumePath, "gcsfuse", nil)).To(Succeed())
+
+			resp, err := d.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:      "test",
+				VolumePath:    volumePath,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 10 << 30},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.GetCapacityBytes()).To(Equal(int64(10 << 30)))
+		})
+	})
+
+	Describe("NodeUnpublishVolume", func() {
+		var targetPath string
+
+		BeforeEach(func() {
+			targetPath = filepath.Join(volumePath, "target")
+			Expect(os.Mkdir(targetPath, 0750)).To(Succeed())
+		})
+
+		It("Should Tolerate Double Unpublish", func() {
+			Expect(mounter.Mount("test", targetPath, "gcsfuse", nil)).To(Succeed())
+			keyFile, err := util.GetMountKey(map[string]string{"key": "{}"}, d.keyStoragePath, targetPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			req := &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath}
+			_, err = d.NodeUnpublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(targetPath).NotTo(BeAnExistingFile())
+			Expect(keyFile).NotTo(BeAnExistingFile())
+
+			_, err = d.NodeUnpublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("Should Remove Targets That Are No Longer Mounted", func() {
+			_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(targetPath).NotTo(BeAnExistingFile())
+		})
+	})
+	Describe("Pinned Snapshots", func() {
+		capability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+
+		It("Should Mount The Objects Of The Snapshot Read-Only", func() {
+			options, err := publishOptions(publishDefaults("test"), nil, capability, map[string]string{"bucket": "data", "snapshotId": "my-snapshots/snapshot-1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("bucket", "my-snapshots"))
+			Expect(options).To(HaveKeyWithValue("onlyDir", "snapshot-1"))
+
+			mountOptions := gcsfuseMountOptions(&csi.NodePublishVolumeRequest{VolumeCapability: capability}, "", "", options)
+			Expect(mountOptions).To(ContainElement("only_dir=snapshot-1"))
+			Expect(mountOptions).To(ContainElement("ro"))
+		})
+		It("Should Mount Directories Within The Snapshot", func() {
+			options, err := publishOptions(publishDefaults("test"), nil, capability, map[string]string{"snapshotId": "my-snapshots/snapshot-1", "onlyDir": "team-a"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(HaveKeyWithValue("onlyDir", "snapshot-1/team-a"))
+		})
+		It("Should Reject IDs Of Other Snapshots", func() {
+			for _, snapshotId := range []string{"snapshot-1", "my-snapshots/", "my-snapshots/a/b", "My Snapshots/snapshot-1"} {
+				_, err := publishOptions(publishDefaults("test"), nil, capability, map[string]string{"snapshotId": snapshotId})
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument), snapshotId)
+			}
+		})
+	})
+	Describe("Draining", func() {
+		It("Should Refuse To Publish But Keep Unpublishing", func() {
+			targetPath := filepath.Join(volumePath, "target")
+			Expect(os.Mkdir(targetPath, 0750)).To(Succeed())
+			Expect(mounter.Mount("test", targetPath, "gcsfuse", nil)).To(Succeed())
+
+			d.drain.Set(true)
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:         "other",
+				TargetPath:       filepath.Join(volumePath, "other"),
+				VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			})
+			Expect(status.Code(err)).To(Equal(codes.Unavailable))
+			Expect(filepath.Join(volumePath, "other")).NotTo(BeAnExistingFile())
+
+			_, err = d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(targetPath).NotTo(BeAnExistingFile())
+
+			d.drain.Set(false)
+			_, err = d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{VolumeId: "other", TargetPath: filepath.Join(volumePath, "other")})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+	})
+	Describe("Mount Breakers", func() {
+		var (
+			server  *httptest.Server
+			failing *failingMounter
+			publish func(volumeContext map[string]string) error
+			mounts  func() int
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"kind": "storage#objects"}`))
+			}))
+			d.storageEmulatorHost = server.URL
+
+			// Fails the way gcsfuse does for a misconfigured volume
+			failing = &failingMounter{FakeMounter: mounter}
+			for i := 0; i < 10; i++ {
+				failing.errs = append(failing.errs, errors.New("exit status 1: invalid argument"))
+			}
+			mounts = func() int { return 10 - len(failing.errs) }
+			d.mounter = failing
+			d.mountFailureThreshold = 2
+			d.mountFailureCooldown = time.Hour
+
+			publish = func(volumeContext map[string]string) error {
+				_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:   "test",
+					TargetPath: filepath.Join(volumePath, "target"),
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+					},
+					VolumeContext: volumeContext,
+					Secrets:       map[string]string{"key": "{}"},
+				})
+				return err
+			}
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Should Not Start gcsfuse During The Cooldown", func() {
+			for i := 0; i < 2; i++ {
+				Expect(status.Code(publish(nil))).To(Equal(codes.InvalidArgument))
+			}
+			Expect(mounts()).To(Equal(2))
+
+			err := publish(nil)
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(status.Convert(err).Message()).To(ContainSubstring("invalid argument"))
+			Expect(mounts()).To(Equal(2))
+		})
+		It("Should Try Again Once The Config Changes", func() {
+			for i := 0; i < 3; i++ {
+				publish(nil)
+			}
+			Expect(mounts()).To(Equal(2))
+
+			Expect(status.Code(publish(map[string]string{"implicitDirs": "false"}))).To(Equal(codes.InvalidArgument))
+			Expect(mounts()).To(Equal(3))
+		})
+		It("Should Never Open When Disabled", func() {
+			d.mountFailureThreshold = 0
+			for i := 0; i < 3; i++ {
+				publish(nil)
+			}
+			Expect(mounts()).To(Equal(3))
+		})
+	})
+	Describe("Auth Files", func() {
+		var root string
+
+		BeforeEach(func() {
+			root = filepath.Join(volumePath, "auth")
+			Expect(os.MkdirAll(filepath.Join(root, "team-a"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(root, "team-a", "key.json"), []byte("{}"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "other.json"), []byte("{}"), 0600)).To(Succeed())
+			d.authFileRoot = root
+		})
+
+		credentials := func(authFile string, secrets map[string]string) (string, error) {
+			_, keyFile, err := d.nodeCredentials(context.Background(), &csi.NodePublishVolumeRequest{TargetPath: filepath.Join(volumePath, "target"), Secrets: secrets}, map[string]string{"bucket": "test", "authFile": authFile})
+			return keyFile, err
+		}
+
+		It("Should Pass The Key File To gcsfuse Instead Of Secrets", func() {
+			keyFile, err := credentials("team-a/key.json", map[string]string{"key": "secret"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keyFile).To(Equal(filepath.Join(root, "team-a", "key.json")))
+			Expect(util.MountKeyFile(d.keyStoragePath, filepath.Join(volumePath, "target"))).NotTo(BeAnExistingFile())
+		})
+		It("Should Fail For Key Files That Can't Be Read", func() {
+			_, err := credentials("team-a/missing.json", nil)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			_, err = credentials("team-a", nil)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+
+			d.authFileRoot = ""
+			_, err = credentials("team-a/key.json", nil)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			Expect(err.Error()).To(ContainSubstring("--auth-file-root"))
+		})
+		It("Should Not Follow Links Out Of The Root", func() {
+			Expect(os.Symlink(filepath.Join(volumePath, "other.json"), filepath.Join(root, "team-a", "link.json"))).To(Succeed())
+			_, err := credentials("team-a/link.json", nil)
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+	})
+
+	Describe("mountTarget", func() {
+		It("Should Only Mount Once For Concurrent Publishes", func() {
+			d.mounter = &slowMounter{FakeMounter: mounter}
+			targetPath := filepath.Join(volumePath, "target")
+
+			var wg sync.WaitGroup
+			results := make(chan bool, 2)
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					mounted, err := d.mountTarget(context.Background(), "test", targetPath, nil)
+					Expect(err).NotTo(HaveOccurred())
+					results <- mounted
+				}()
+			}
+			wg.Wait()
+			close(results)
+
+			mountedResults := []bool{}
+			for mounted := range results {
+				mountedResults = append(mountedResults, mounted)
+			}
+
+			launches := 0
+			for _, action := range mounter.GetLog() {
+				if action.Action == mount.FakeActionMount {
+					launches++
+				}
+			}
+			Expect(launches).To(Equal(1))
+			Expect(mountedResults).To(ConsistOf(true, false))
+			Expect(d.targetLocks.locks).To(BeEmpty())
+		})
+		It("Should Queue Mounts Beyond The Limit", func() {
+			d.mountSlots = make(chan struct{}, 1)
+			d.mountSlots <- struct{}{}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := d.mountTarget(ctx, "test", filepath.Join(volumePath, "target"), nil)
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(mounter.GetLog()).To(BeEmpty())
+
+			<-d.mountSlots
+			mounted, err := d.mountTarget(context.Background(), "test", filepath.Join(volumePath, "target"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounted).To(BeTrue())
+			Expect(d.mountSlots).To(BeEmpty())
+		})
+		It("Should Create Missing Targets", func() {
+			targetPath := filepath.Join(volumePath, "pods", "uid", "target")
+
+			mounted, err := d.mountTarget(context.Background(), "test", targetPath, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounted).To(BeTrue())
+			info, err := os.Stat(targetPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IsDir()).To(BeTrue())
+		})
+		It("Should Refuse Targets That Are Not Directories", func() {
+			targetPath := filepath.Join(volumePath, "target")
+			Expect(ioutil.WriteFile(targetPath, nil, 0640)).To(Succeed())
+
+			_, err := d.mountTarget(context.Background(), "test", targetPath, nil)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			_, err = d.bindTarget(filepath.Join(volumePath, "staging"), targetPath, false)
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			Expect(mounter.GetLog()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"github.com/ofek/csi-gcs/pkg/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options of a new volume, the PersistentVolumeClaim annotations are looked up by the caller
+func provisioningOptions(name string, secrets map[string]string, capabilities []*csi.VolumeCapability, parameters map[string]string, pvcAnnotations map[string]string) (map[string]string, error) {
+	// Default Options
+	var options = map[string]string{
+		"kmsKeyId": "",
+	}
+
+	// Merge Secret Options
+	options = flags.MergeSecret(options, secrets)
+
+	// Merge MountFlag Options
+	for _, capability := range capabilities {
+		options = flags.MergeMountOptions(options, capability.GetMount().GetMountFlags())
+	}
+
+	// Merge PVC Annotation Options
+	options = flags.MergeAnnotations(options, pvcAnnotations)
+
+	// Merge Parameter Options, which claims may not override however they are spelled
+	options = flags.MergeSecret(options, parameters)
+	if parameters != nil {
+		options = flags.MergeAnnotations(options, parameters)
+	}
+
+	if err := flags.ValidateFlags(options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Generate a bucket name unless one was chosen
+	if _, bucketSelected := options[flags.FLAG_BUCKET]; bucketSelected {
+		// Only generated names follow the template
+		delete(options, flags.FLAG_BUCKET_NAME_TEMPLATE)
+	} else if template, found := options[flags.FLAG_BUCKET_NAME_TEMPLATE]; found {
+		bucketName, err := templatedBucketName(template, name, parameters, 0)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		options[flags.FLAG_BUCKET] = bucketName
+	} else {
+		options[flags.FLAG_BUCKET] = util.PrefixedBucketName(options[flags.FLAG_BUCKET_PREFIX], name)
+	}
+	if len(options[flags.FLAG_BUCKET]) > 63 {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is longer than 63 characters: %s", options[flags.FLAG_BUCKET])
+	}
+
+	return options, nil
+}
+
+// Expands the placeholders of a bucket name template. The random part is derived from the volume name so that retried
+// calls get the same names, the attempt picks another one when a name is taken.
+func templatedBucketName(template string, name string, parameters map[string]string, attempt int) (string, error) {
+	values := map[string]string{
+		flags.TEMPLATE_PVC_NAME:      parameters["csi.storage.k8s.io/pvc/name"],
+		flags.TEMPLATE_PVC_NAMESPACE: parameters["csi.storage.k8s.io/pvc/namespace"],
+		flags.TEMPLATE_PV_NAME:       name,
+		flags.TEMPLATE_RANDOM:        fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s/%d", name, attempt)))),
+	}
+
+	bucketName := template
+	for placeholder, value := range values {
+		if !strings.Contains(bucketName, placeholder) {
+			continue
+		}
+		if value == "" {
+			return "", fmt.Errorf("%s of %s is unknown, the provisioner needs --extra-create-metadata", placeholder, flags.FLAG_BUCKET_NAME_TEMPLATE)
+		}
+		// Names of Kubernetes objects may contain dots, which would need domain verification
+		bucketName = strings.Replace(bucketName, placeholder, strings.Replace(strings.ToLower(value), ".", "-", -1), -1)
+	}
+
+	if err := flags.ValidateBucketName(bucketName); err != nil {
+		return "", fmt.Errorf("%s %s: %v", flags.FLAG_BUCKET_NAME_TEMPLATE, template, err)
+	}
+	return bucketName, nil
+}
+
+func publishDefaults(volumeID string) map[string]string {
+	return map[string]string{
+		"bucket":   volumeID,
+		"gid":      strconv.FormatInt(DefaultGid, 10),
+		"dirMode":  "0" + strconv.FormatInt(DefaultDirMode, 8),
+		"fileMode": "0" + strconv.FormatInt(DefaultFileMode, 8),
+	}
+}
+
+// Options of a mount on top of the defaults, the volume context holds the options the volume was provisioned with
+func publishOptions(options map[string]string, secrets map[string]string, capability *csi.VolumeCapability, volumeContext map[string]string) (map[string]string, error) {
+	// Merge Secret Options
+	options = flags.MergeSecret(options, secrets)
+
+	// Merge MountFlag Options
+	options = flags.MergeMountOptions(options, capability.GetMount().GetMountFlags())
+
+	// Merge Volume Context
+	if volumeContext != nil {
+		options = flags.MergeFlags(options, volumeContext)
+	}
+
+	if err := flags.ValidateFlags(options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The objects of a snapshot are below its name in the snapshot bucket
+	if snapshotId := options[flags.FLAG_SNAPSHOT_ID]; snapshotId != "" {
+		snapshotBucketName, name, _ := parseSnapshotId(snapshotId)
+		options[flags.FLAG_BUCKET] = snapshotBucketName
+		if onlyDir := options[flags.FLAG_ONLY_DIR]; onlyDir != "" {
+			options[flags.FLAG_ONLY_DIR] = name + "/" + onlyDir
+		} else {
+			options[flags.FLAG_ONLY_DIR] = name
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	"k8s.io/klog"
+)
+
+// Overridden in tests
+var (
+	findGcsfuseProcess = util.FindGcsfuseProcess
+	// How often to check whether gcsfuse exited
+	exitPollInterval = 100 * time.Millisecond
+)
+
+// Whether the process is gone, zombies count as gone as they no longer hold any data
+func processExited(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	// The state follows the command, which is in parentheses and may contain anything
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// Unmounting makes gcsfuse finish the requests in flight and exit, like fusermount -u would. Gives it the grace
+// period to do so before killing it, as a gcsfuse that hangs would otherwise stay around until the node plugin restarts.
+// The wait outlasts the call if need be since killing gcsfuse early loses writes, while a retried call only cleans up.
+func (driver *GCSDriver) awaitGcsfuseExit(volumeID string, targetPath string, pid int) {
+	deadline := time.NewTimer(driver.unmountGracePeriod)
+	defer deadline.Stop()
+	for !processExited(pid) {
+		select {
+		case <-deadline.C:
+			klog.Warningf("gcsfuse of volume %s at %s did not exit within %v, killing process %d", volumeID, targetPath, driver.unmountGracePeriod, pid)
+		case <-time.After(exitPollInterval):
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			klog.Errorf("Could not kill gcsfuse process %d: %v", pid, err)
+		}
+		return
+	}
+
+	util.InfoS(2, "gcsfuse exited cleanly", "volumeID", volumeID, "targetPath", targetPath, "pid", pid)
+}
@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Unmount Grace Period", func() {
+	var (
+		d          *GCSDriver
+		mounter    *mount.FakeMounter
+		volumePath string
+		targetPath string
+		gcsfuse    *exec.Cmd
+	)
+
+	// Stands in for gcsfuse, exiting once it is done or when killed
+	start := func(args ...string) {
+		gcsfuse = exec.Command("sleep", args...)
+		Expect(gcsfuse.Start()).To(Succeed())
+		findGcsfuseProcess = func(path string) (int, error) {
+			if path == targetPath {
+				return gcsfuse.Process.Pid, nil
+			}
+			return 0, nil
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "csi-gcs-process")
+		Expect(err).NotTo(HaveOccurred())
+		targetPath = filepath.Join(volumePath, "target")
+		Expect(os.Mkdir(targetPath, 0750)).To(Succeed())
+
+		exitPollInterval = 10 * time.Millisecond
+		mounter = mount.NewFakeMounter(nil)
+		Expect(mounter.Mount("test", targetPath, "gcsfuse", nil)).To(Succeed())
+		d = &GCSDriver{name: CSIDriverName, nodeName: "test-node", mounter: mounter, keyStoragePath: filepath.Join(volumePath, "keys")}
+	})
+
+	AfterEach(func() {
+		findGcsfuseProcess = util.FindGcsfuseProcess
+		os.RemoveAll(volumePath)
+	})
+
+	unpublish := func() {
+		_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("Should Let gcsfuse Exit On Its Own", func() {
+		d.unmountGracePeriod = 5 * time.Second
+		start("0.1")
+
+		started := time.Now()
+		unpublish()
+		Expect(time.Since(started)).To(BeNumerically("<", d.unmountGracePeriod))
+		Expect(gcsfuse.Wait()).To(Succeed())
+	})
+	It("Should Kill gcsfuse After The Grace Period", func() {
+		d.unmountGracePeriod = 50 * time.Millisecond
+		start("60")
+
+		unpublish()
+		err := gcsfuse.Wait()
+		Expect(err).To(HaveOccurred())
+		Expect(gcsfuse.ProcessState.Sys().(syscall.WaitStatus).Signal()).To(Equal(syscall.SIGKILL))
+	})
+	It("Should Give gcsfuse The Grace Period When The Call Is Cancelled", func() {
+		d.unmountGracePeriod = 200 * time.Millisecond
+		start("0.1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gcsfuse.Wait()).To(Succeed())
+	})
+})
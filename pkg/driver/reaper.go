@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+func (d *GCSDriver) RunOrphanReaper(stopCh <-chan struct{}) {
+	klog.V(1).Infof("Reaping orphaned mounts every %s", d.orphanReapInterval)
+
+	ticker := time.NewTicker(d.orphanReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			podUIDs, err := util.GetNodePodUIDs(d.nodeName)
+			if err != nil {
+				// Still reap mounts whose target is gone
+				klog.Warningf("Could not list pods of node %s: %v", d.nodeName, err)
+				podUIDs = nil
+			}
+
+			if err := d.reapOrphanedMounts(podUIDs); err != nil {
+				klog.Errorf("Reaping orphaned mounts failed with error: %v", err)
+			}
+		}
+	}
+}
+
+// Unmounts gcsfuse mounts whose target no longer exists or whose pod is no longer on the node.
+// A nil podUIDs skips the latter check.
+func (d *GCSDriver) reapOrphanedMounts(podUIDs map[string]bool) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return err
+	}
+
+	for _, mountPoint := range mountPoints {
+		if !isGcsfuseMount(mountPoint) || !strings.HasPrefix(mountPoint.Path, d.mountPoint+"/") {
+			continue
+		}
+
+		_, err := os.Stat(mountPoint.Path)
+		targetExists := !os.IsNotExist(err)
+		podExists := podUIDs == nil || podUIDs[podUIDFromTargetPath(d.mountPoint, mountPoint.Path)]
+		if targetExists && podExists {
+			continue
+		}
+
+		d.reapMount(mountPoint, targetExists)
+	}
+
+	return nil
+}
+
+// Unmounts an orphaned mount and removes everything that belonged to it like unmountTarget does
+func (d *GCSDriver) reapMount(mountPoint mount.MountPoint, targetExists bool) {
+	// Before locking the target as a remount in progress holds the lock, otherwise it would mount the target again
+	d.stopSupervising(mountPoint.Path)
+	defer d.targetLocks.Lock(mountPoint.Path)()
+
+	// Unpublished while waiting for the lock
+	if targetExists {
+		if notMnt, err := d.mounter.IsLikelyNotMountPoint(mountPoint.Path); err != nil || notMnt {
+			return
+		}
+	}
+
+	pid, err := findGcsfuseProcess(mountPoint.Path)
+	if err != nil {
+		klog.Warningf("Could not find gcsfuse process of %s: %v", mountPoint.Path, err)
+	}
+	registered, _ := d.mountRegistry.Get(mountPoint.Path)
+	util.InfoS(4, "Reaping orphaned mount", "volumeID", registered.VolumeID, "bucket", mountPoint.Device, "targetPath", mountPoint.Path, "pid", pid)
+
+	if targetExists {
+		err = mount.CleanupMountPoint(mountPoint.Path, d.mounter, false)
+	} else {
+		err = d.mounter.Unmount(mountPoint.Path)
+	}
+	if err != nil {
+		klog.Errorf("Could not unmount orphaned mount %s: %v", mountPoint.Path, err)
+		return
+	}
+	orphanReaps.Inc()
+
+	if pid != 0 {
+		d.awaitGcsfuseExit(mountPoint.Device, mountPoint.Path, pid)
+	}
+
+	keyFile := util.MountKeyFile(d.keyStoragePath, mountPoint.Path)
+	util.CleanupKey(keyFile, d.keyStoragePath)
+	util.CleanupKey(util.MountTokenFile(d.keyStoragePath, mountPoint.Path), d.keyStoragePath)
+	d.credentials.Forget(keyFile)
+	d.cleanupCache(mountPoint.Path)
+	d.stopGcsfuseLog(mountPoint.Device, mountPoint.Path)
+	d.mountRegistry.Remove(mountPoint.Path)
+	d.volumeStats.Untrack(mountPoint.Path)
+	// Otherwise publishing to the target again would be refused
+	d.publishedTargets.Release(mountPoint.Path)
+}
+
+func isGcsfuseMount(mountPoint mount.MountPoint) bool {
+	return mountPoint.Type == "fuse.gcsfuse" || mountPoint.Type == "gcsfuse"
+}
+
+// Targets look like <mountPoint>/<pod UID>/volumes/kubernetes.io~csi/<volume>/mount
+func podUIDFromTargetPath(mountPoint string, targetPath string) string {
+	relativePath, err := filepath.Rel(mountPoint, targetPath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.Split(relativePath, string(filepath.Separator))[0]
+}
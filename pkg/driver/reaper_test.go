@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Reaper", func() {
+	var (
+		d          *GCSDriver
+		mounter    *mount.FakeMounter
+		mountPoint string
+	)
+
+	var target = func(podUID string) string {
+		targetPath := filepath.Join(mountPoint, podUID, "volumes", "kubernetes.io~csi", "pv", "mount")
+		Expect(os.MkdirAll(targetPath, 0750)).To(Succeed())
+		Expect(mounter.Mount("bucket", targetPath, "gcsfuse", nil)).To(Succeed())
+		return targetPath
+	}
+
+	BeforeEach(func() {
+		var err error
+		mountPoint, err = ioutil.TempDir("", "csi-gcs-reaper")
+		Expect(err).NotTo(HaveOccurred())
+
+		mounter = mount.NewFakeMounter(nil)
+		d = &GCSDriver{mountPoint: mountPoint, mounter: mounter, keyStoragePath: filepath.Join(mountPoint, "keys")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(mountPoint)
+	})
+
+	It("Should Reap Mounts Of Pods That Are Gone", func() {
+		alive := target("alive")
+		gone := target("gone")
+
+		reaps := testutil.ToFloat64(orphanReaps)
+		Expect(d.reapOrphanedMounts(map[string]bool{"alive": true})).To(Succeed())
+
+		mountPoints, _ := mounter.List()
+		Expect(mountPoints).To(HaveLen(1))
+		Expect(mountPoints[0].Path).To(Equal(alive))
+		Expect(gone).NotTo(BeAnExistingFile())
+		Expect(testutil.ToFloat64(orphanReaps)).To(Equal(reaps + 1))
+	})
+	It("Should Release The Targets It Reaps", func() {
+		gone := target("gone")
+		d.publishedTargets.Claim(gone, "pv")
+
+		Expect(d.reapOrphanedMounts(map[string]bool{})).To(Succeed())
+
+		owner, claimed := d.publishedTargets.Claim(gone, "other-pv")
+		Expect(claimed).To(BeTrue())
+		Expect(owner).To(Equal("other-pv"))
+	})
+	It("Should Only Reap Missing Targets When Pods Are Unknown", func() {
+		target("alive")
+		missing := filepath.Join(mountPoint, "missing", "mount")
+		Expect(mounter.Mount("bucket", missing, "gcsfuse", nil)).To(Succeed())
+
+		Expect(d.reapOrphanedMounts(nil)).To(Succeed())
+
+		mountPoints, _ := mounter.List()
+		Expect(mountPoints).To(HaveLen(1))
+	})
+	It("Should Ignore Other Mounts", func() {
+		other := filepath.Join(mountPoint, "gone", "other")
+		Expect(os.MkdirAll(other, 0750)).To(Succeed())
+		Expect(mounter.Mount("/dev/sda", other, "ext4", nil)).To(Succeed())
+
+		Expect(d.reapOrphanedMounts(map[string]bool{})).To(Succeed())
+
+		mountPoints, _ := mounter.List()
+		Expect(mountPoints).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// Name of the file of the mount registry in --state-storage-path
+const mountRegistryFile = "mounts.json"
+
+// The mounts of the node plugin, kept in a file so that a restarted plugin still knows which volume each target
+// holds. The zero value keeps nothing on disk.
+type mountRegistry struct {
+	mu     sync.Mutex
+	path   string
+	mounts map[string]registeredMount
+}
+
+// What a mount was made of, without any secrets
+type registeredMount struct {
+	// Unknown when the registry was rebuilt from the mount table
+	VolumeID   string `json:"volumeID,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	TargetPath string `json:"targetPath"`
+	// Of gcsfuse, 0 for bind mounts and once gcsfuse exited e.g. along with the previous container of the plugin
+	PID          int      `json:"pid,omitempty"`
+	MountOptions []string `json:"mountOptions,omitempty"`
+}
+
+type mountRegistryContents struct {
+	Mounts []registeredMount `json:"mounts"`
+}
+
+func (r *mountRegistry) Add(mount registeredMount) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.mounts == nil {
+		r.mounts = map[string]registeredMount{}
+	}
+	r.mounts[mount.TargetPath] = mount
+	r.save()
+}
+
+func (r *mountRegistry) Get(targetPath string) (mount registeredMount, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mount, found = r.mounts[targetPath]
+	return mount, found
+}
+
+func (r *mountRegistry) Remove(targetPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.mounts[targetPath]; !found {
+		return
+	}
+	delete(r.mounts, targetPath)
+	r.save()
+}
+
+// Replaces the file at once, so that a crash leaves either the previous or the new contents behind
+func (r *mountRegistry) save() {
+	if r.path == "" {
+		return
+	}
+
+	contents := mountRegistryContents{Mounts: []registeredMount{}}
+	for _, mount := range r.mounts {
+		contents.Mounts = append(contents.Mounts, mount)
+	}
+	sort.Slice(contents.Mounts, func(i, j int) bool { return contents.Mounts[i].TargetPath < contents.Mounts[j].TargetPath })
+
+	data, err := json.Marshal(contents)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.path), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(r.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(r.path+".tmp", r.path)
+	}
+	if err != nil {
+		klog.Warningf("Could not save mount registry %s: %v", r.path, err)
+	}
+}
+
+func readMountRegistry(path string) ([]registeredMount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents mountRegistryContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, err
+	}
+	return contents.Mounts, nil
+}
+
+// Reloads the registry of a previous run, forgetting targets that are no longer mounted, and lets publishing
+// know which volume every remaining target holds. A registry that is missing, e.g. after upgrading, or can't be read
+// is rebuilt from the gcsfuse mounts of the mount table, which tell the bucket but not the volume.
+func (driver *GCSDriver) loadMountRegistry() error {
+	if driver.mountRegistry.path == "" {
+		return nil
+	}
+
+	mountPoints, err := driver.mounter.List()
+	if err != nil {
+		return err
+	}
+	mounted := map[string]bool{}
+	for _, mountPoint := range mountPoints {
+		mounted[mountPoint.Path] = true
+	}
+
+	registered, err := readMountRegistry(driver.mountRegistry.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Rebuilding mount registry %s from the mount table as it could not be read: %v", driver.mountRegistry.path, err)
+		}
+		registered = nil
+		for _, mountPoint := range mountPoints {
+			if isGcsfuseMount(mountPoint) {
+				registered = append(registered, registeredMount{Bucket: mountPoint.Device, TargetPath: mountPoint.Path, MountOptions: mountPoint.Opts})
+			}
+		}
+	}
+
+	driver.mountRegistry.mu.Lock()
+	defer driver.mountRegistry.mu.Unlock()
+
+	driver.mountRegistry.mounts = map[string]registeredMount{}
+	for _, mount := range registered {
+		if !mounted[mount.TargetPath] {
+			klog.V(4).Infof("Forgetting mount of volume %s at %s as it is no longer mounted", mount.VolumeID, mount.TargetPath)
+			continue
+		}
+
+		mount.PID, err = findGcsfuseProcess(mount.TargetPath)
+		if err != nil {
+			klog.Warningf("Could not find gcsfuse process of %s: %v", mount.TargetPath, err)
+		}
+		driver.mountRegistry.mounts[mount.TargetPath] = mount
+		if mount.VolumeID != "" {
+			driver.publishedTargets.Claim(mount.TargetPath, mount.VolumeID)
+		}
+	}
+	driver.mountRegistry.save()
+
+	klog.V(1).Infof("Loaded %d mounts from mount registry %s", len(driver.mountRegistry.mounts), driver.mountRegistry.path)
+	return nil
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Mount Registry", func() {
+	var (
+		d            *GCSDriver
+		mounter      *mount.FakeMounter
+		statePath    string
+		registryPath string
+	)
+
+	var target = func(name string) string {
+		targetPath := filepath.Join(statePath, name)
+		Expect(os.MkdirAll(targetPath, 0750)).To(Succeed())
+		Expect(mounter.Mount("bucket", targetPath, "gcsfuse", nil)).To(Succeed())
+		return targetPath
+	}
+
+	// Like the node plugin coming back after its container restarted
+	var restart = func() *GCSDriver {
+		restarted := &GCSDriver{mounter: mounter, keyStoragePath: filepath.Join(statePath, "keys"), mountRegistry: mountRegistry{path: registryPath}}
+		Expect(restarted.loadMountRegistry()).To(Succeed())
+		return restarted
+	}
+
+	BeforeEach(func() {
+		var err error
+		statePath, err = ioutil.TempDir("", "csi-gcs-registry")
+		Expect(err).NotTo(HaveOccurred())
+		registryPath = filepath.Join(statePath, "state", mountRegistryFile)
+
+		mounter = mount.NewFakeMounter(nil)
+		d = &GCSDriver{mounter: mounter, keyStoragePath: filepath.Join(statePath, "keys"), mountRegistry: mountRegistry{path: registryPath}}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(statePath)
+	})
+
+	It("Should Remember Targets Across Restarts", func() {
+		mounted := target("mounted")
+		d.mountRegistry.Add(registeredMount{VolumeID: "a", Bucket: "bucket", TargetPath: mounted, MountOptions: []string{"implicit_dirs"}})
+		d.mountRegistry.Add(registeredMount{VolumeID: "b", Bucket: "bucket", TargetPath: filepath.Join(statePath, "gone")})
+
+		restarted := restart()
+		registered, found := restarted.mountRegistry.Get(mounted)
+		Expect(found).To(BeTrue())
+		Expect(registered).To(Equal(registeredMount{VolumeID: "a", Bucket: "bucket", TargetPath: mounted, MountOptions: []string{"implicit_dirs"}}))
+		_, found = restarted.mountRegistry.Get(filepath.Join(statePath, "gone"))
+		Expect(found).To(BeFalse())
+
+		owner, _ := restarted.publishedTargets.Claim(mounted, "other")
+		Expect(owner).To(Equal("a"))
+	})
+	It("Should Forget Unmounted Targets", func() {
+		mounted := target("mounted")
+		d.mountRegistry.Add(registeredMount{VolumeID: "a", Bucket: "bucket", TargetPath: mounted})
+
+		Expect(d.unmountTarget(context.Background(), "a", mounted)).To(Succeed())
+		_, found := d.mountRegistry.Get(mounted)
+		Expect(found).To(BeFalse())
+		_, found = restart().mountRegistry.Get(mounted)
+		Expect(found).To(BeFalse())
+	})
+	It("Should Rebuild A Corrupted Registry From The Mount Table", func() {
+		mounted := target("mounted")
+		Expect(os.MkdirAll(filepath.Dir(registryPath), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(registryPath, []byte(`{"mounts": [{"volumeID": "a",`), 0600)).To(Succeed())
+
+		restarted := restart()
+		registered, found := restarted.mountRegistry.Get(mounted)
+		Expect(found).To(BeTrue())
+		Expect(registered.Bucket).To(Equal("bucket"))
+		Expect(registered.VolumeID).To(BeEmpty())
+
+		contents, err := readMountRegistry(registryPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(HaveLen(1))
+	})
+	It("Should Build A Missing Registry From The Mount Table", func() {
+		mounted := target("mounted")
+		Expect(mounter.Mount("/dev/sda1", filepath.Join(statePath, "disk"), "ext4", nil)).To(Succeed())
+
+		restarted := restart()
+		Expect(restarted.mountRegistry.mounts).To(HaveLen(1))
+		_, found := restarted.mountRegistry.Get(mounted)
+		Expect(found).To(BeTrue())
+	})
+})
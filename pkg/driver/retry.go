@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// How long to wait for the FUSE mount to show up after gcsfuse has started
+var mountVerifyTimeout = 5 * time.Second
+
+// How long to wait for the mount helper to return once gcsfuse has been killed
+var mountAbortTimeout = 5 * time.Second
+
+// Substrings of errors that are expected to go away on their own, e.g. while the metadata server is still starting
+var transientMountErrors = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"timeout",
+	"temporarily unavailable",
+	"metadata",
+	"token",
+	"too many requests",
+	"internal error",
+	"service unavailable",
+	"bad gateway",
+}
+
+// Precedes the output of gcsfuse in errors of the mounter
+const mountOutputPrefix = "\nOutput: "
+
+// Substrings of errors that will never succeed when retried
+var permanentMountErrors = []string{
+	"permission denied",
+	"forbidden",
+	"not found",
+	"does not exist",
+	"invalid argument",
+}
+
+type mountRetryError struct {
+	errs []error
+}
+
+func (e *mountRetryError) Error() string {
+	messages := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		messages[i] = fmt.Sprintf("attempt %d: %v", i+1, err)
+	}
+
+	return fmt.Sprintf("mount failed after %d attempt(s): %s", len(e.errs), strings.Join(messages, "; "))
+}
+
+func (e *mountRetryError) Last() error {
+	return e.errs[len(e.errs)-1]
+}
+
+func isTransientMountError(err error) bool {
+	message := strings.ToLower(mountErrorCause(err))
+
+	for _, s := range permanentMountErrors {
+		if strings.Contains(message, s) {
+			return false
+		}
+	}
+	for _, s := range transientMountErrors {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// What a failed mount says about why it failed, i.e. the output of the mount helper or the cause that an error wraps.
+// The mount command, whose paths and options e.g. key_file=.../token could match anything, is left out.
+func mountErrorCause(err error) string {
+	if cause := errors.Unwrap(err); cause != nil {
+		return mountErrorCause(cause)
+	}
+
+	message := err.Error()
+	if i := strings.LastIndex(message, mountOutputPrefix); i >= 0 {
+		return message[i+len(mountOutputPrefix):]
+	}
+	return message
+}
+
+// Mounts the bucket, retrying transient errors with exponential backoff until driver.mountRetryTimeout is exceeded
+func (driver *GCSDriver) mountWithRetry(ctx context.Context, source string, target string, options []string) *mountRetryError {
+	backoff := wait.Backoff{
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    10,
+		Cap:      8 * time.Second,
+	}
+	deadline := time.Now().Add(driver.mountRetryTimeout)
+
+	retryErr := &mountRetryError{}
+	for {
+		// Starting gcsfuse only to kill it right away
+		if err := ctx.Err(); err != nil {
+			retryErr.errs = append(retryErr.errs, err)
+			return retryErr
+		}
+
+		err := driver.mountContext(ctx, source, target, options)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			retryErr.errs = append(retryErr.errs, err)
+			return retryErr
+		}
+		if err == nil {
+			err = driver.verifyMount(target)
+			if err == nil {
+				return nil
+			}
+		}
+		retryErr.errs = append(retryErr.errs, err)
+
+		if !isTransientMountError(err) {
+			return retryErr
+		}
+
+		delay := backoff.Step()
+		if time.Now().Add(delay).After(deadline) {
+			return retryErr
+		}
+
+		klog.Warningf("Mounting %s at %s failed, retrying in %s: %v", source, target, delay, err)
+		select {
+		case <-ctx.Done():
+			retryErr.errs = append(retryErr.errs, ctx.Err())
+			return retryErr
+		case <-time.After(delay):
+		}
+	}
+}
+
+// gcsfuse can die after daemonizing, in which case the mount helper still reports success
+func (driver *GCSDriver) verifyMount(target string) error {
+	err := wait.PollImmediate(100*time.Millisecond, mountVerifyTimeout, func() (bool, error) {
+		notMnt, err := driver.mounter.IsLikelyNotMountPoint(target)
+		return err == nil && !notMnt, nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	// Clean up whatever is left of the mount
+	pid, _ := util.FindGcsfuseProcess(target)
+	if unmountErr := driver.mounter.Unmount(target); unmountErr != nil {
+		klog.V(4).Infof("Could not unmount %s after failed verification: %v", target, unmountErr)
+	}
+	cause := errors.New("gcsfuse exited during initialization")
+	if pid != 0 {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			klog.Warningf("Could not kill gcsfuse process %d: %v", pid, err)
+		}
+		cause = fmt.Errorf("gcsfuse (pid %d) was hung and has been killed", pid)
+	}
+	if output := driver.gcsfuseLogTail(target); output != "" {
+		cause = fmt.Errorf("%v, its log ends with: %s", cause, output)
+	}
+	return fmt.Errorf("%s was not mounted after %s: %w", target, mountVerifyTimeout, cause)
+}
+
+// Mounting cannot be interrupted, so on expiry of the context gcsfuse is killed to make the mount helper return
+func (driver *GCSDriver) mountContext(ctx context.Context, source string, target string, options []string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- driver.mounter.Mount(source, target, "gcsfuse", options)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	klog.Warningf("Mounting %s at %s did not finish in time, aborting", source, target)
+	pid, err := util.FindGcsfuseProcess(target)
+	if err != nil {
+		klog.Warningf("Could not find gcsfuse process of %s: %v", target, err)
+	}
+	if pid != 0 {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			klog.Warningf("Could not kill gcsfuse process %d: %v", pid, err)
+		}
+	}
+
+	// The mount may have come up in the meantime, something other than gcsfuse hanging is left to the reaper
+	select {
+	case err := <-done:
+		if err == nil {
+			if err := driver.mounter.Unmount(target); err != nil {
+				klog.Warningf("Could not unmount %s after aborting: %v", target, err)
+			}
+		} else if output := strings.TrimSpace(mountErrorCause(err)); output != "" {
+			// What gcsfuse printed until then tells what it was waiting for
+			return fmt.Errorf("%w, gcsfuse was killed: %s", ctx.Err(), output)
+		}
+	case <-time.After(mountAbortTimeout):
+		klog.Warningf("Mounting %s at %s is still hanging after killing gcsfuse", source, target)
+	}
+
+	return ctx.Err()
+}
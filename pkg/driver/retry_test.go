@@ -0,0 +1,185 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// Fails the first len(errs) mounts with the given errors
+type failingMounter struct {
+	*mount.FakeMounter
+	errs []error
+	// Report success without mounting anything, like gcsfuse dying after daemonizing
+	detach bool
+}
+
+func (m *failingMounter) Mount(source string, target string, fstype string, options []string) error {
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return err
+	}
+	if m.detach {
+		return nil
+	}
+
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+// Blocks mounting until released, like gcsfuse stuck during initialization
+type hangingMounter struct {
+	*mount.FakeMounter
+	release chan struct{}
+}
+
+func (m *hangingMounter) Mount(source string, target string, fstype string, options []string) error {
+	<-m.release
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+// Fails after a while with what gcsfuse printed, like a mount helper whose gcsfuse gets killed
+type killedMounter struct {
+	*mount.FakeMounter
+	delay time.Duration
+	err   error
+}
+
+func (m *killedMounter) Mount(source string, target string, fstype string, options []string) error {
+	time.Sleep(m.delay)
+	return m.err
+}
+
+var _ = Describe("mountWithRetry", func() {
+	var (
+		d          *GCSDriver
+		mounter    *failingMounter
+		targetPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		targetPath, err = ioutil.TempDir("", "csi-gcs-mount")
+		Expect(err).NotTo(HaveOccurred())
+
+		mounter = &failingMounter{FakeMounter: mount.NewFakeMounter(nil)}
+		d = &GCSDriver{name: CSIDriverName, nodeName: "test-node", mounter: mounter, mountRetryTimeout: 10 * time.Second}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(targetPath)
+	})
+
+	It("Should Retry Transient Errors", func() {
+		mounter.errs = []error{errors.New("dial tcp 169.254.169.254:80: connect: connection refused")}
+
+		Expect(d.mountWithRetry(context.Background(), "test", targetPath, nil)).To(BeNil())
+		Expect(mounter.MountPoints).To(HaveLen(1))
+	})
+	It("Should Fail Fast On Permanent Errors", func() {
+		mounter.errs = []error{errors.New("bucket test does not exist")}
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.errs).To(HaveLen(1))
+		Expect(mounter.MountPoints).To(BeEmpty())
+	})
+	It("Should Only Classify The Output Of gcsfuse", func() {
+		mounter.errs = []error{errors.New("mount failed: exit status 1\nMounting command: mount\nMounting arguments: -t gcsfuse -o key_file=/tmp/keys/token test /var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/metadata/mount\nOutput: unknown flag: --foo")}
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.errs).To(HaveLen(1))
+
+		Expect(isTransientMountError(errors.New("mount failed: exit status 1\nMounting command: mount\nMounting arguments: -o key_file=/tmp/not-found/key test /target\nOutput: oauth2: cannot fetch token: connection reset"))).To(BeTrue())
+		Expect(isTransientMountError(fmt.Errorf("/pods/token/mount was not mounted after 5s: %w", errors.New("gcsfuse exited during initialization")))).To(BeFalse())
+	})
+	It("Should Give Up Once The Timeout Is Exceeded", func() {
+		d.mountRetryTimeout = 0
+		mounter.errs = []error{errors.New("i/o timeout"), errors.New("i/o timeout")}
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("after 1 attempt(s)"))
+	})
+	It("Should Report All Attempts", func() {
+		mounter.errs = []error{errors.New("i/o timeout"), errors.New("permission denied")}
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err.Error()).To(ContainSubstring("attempt 1: i/o timeout; attempt 2: permission denied"))
+	})
+	It("Should Fail When Nothing Was Mounted", func() {
+		defer func(timeout time.Duration) { mountVerifyTimeout = timeout }(mountVerifyTimeout)
+		mountVerifyTimeout = 200 * time.Millisecond
+		mounter.detach = true
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("gcsfuse exited during initialization"))
+		Expect(err.errs).To(HaveLen(1))
+	})
+	It("Should Tell What gcsfuse Logged When Nothing Was Mounted", func() {
+		defer func(timeout time.Duration) { mountVerifyTimeout = timeout }(mountVerifyTimeout)
+		mountVerifyTimeout = 200 * time.Millisecond
+		mounter.detach = true
+		d.mountRetryTimeout = 0
+		d.logStoragePath = filepath.Join(targetPath, "logs")
+		Expect(os.Mkdir(d.logStoragePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(d.gcsfuseLogFile(targetPath), []byte("Opening GCS connection\nbucket test: connection refused\n"), 0600)).To(Succeed())
+
+		err := d.mountWithRetry(context.Background(), "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("its log ends with: Opening GCS connection\nbucket test: connection refused"))
+		Expect(isTransientMountError(err.Last())).To(BeTrue())
+	})
+	It("Should Abort Mounts That Take Too Long", func() {
+		defer func(timeout time.Duration) { mountAbortTimeout = timeout }(mountAbortTimeout)
+		mountAbortTimeout = 100 * time.Millisecond
+
+		hanging := &hangingMounter{FakeMounter: mount.NewFakeMounter(nil), release: make(chan struct{})}
+		defer close(hanging.release)
+		d.mounter = hanging
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := d.mountWithRetry(ctx, "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Last()).To(Equal(context.DeadlineExceeded))
+	})
+	It("Should Tell What gcsfuse Printed Before It Was Aborted", func() {
+		d.mounter = &killedMounter{
+			FakeMounter: mount.NewFakeMounter(nil),
+			delay:       100 * time.Millisecond,
+			err:         errors.New("mount failed: signal: killed\nMounting command: mount\nMounting arguments: -t gcsfuse test /target\nOutput: Opening GCS connection..."),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := d.mountWithRetry(ctx, "test", targetPath, nil)
+		Expect(err).NotTo(BeNil())
+		Expect(errors.Is(err.Last(), context.DeadlineExceeded)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("gcsfuse was killed: Opening GCS connection..."))
+		Expect(err.errs).To(HaveLen(1))
+	})
+	It("Should Not Mount Once The Call Is Cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		mounted, err := d.mountTarget(ctx, "test", targetPath, nil)
+		Expect(mounted).To(BeFalse())
+		Expect(status.Code(err)).To(Equal(codes.Canceled))
+		Expect(mounter.GetLog()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const selfTestTimeout = 30 * time.Second
+
+// Writes, reads back and deletes an object in the self-test bucket with the driver's own credentials so that
+// broken IAM or networking shows up at rollout rather than when the first Pod mounts a volume
+func (d *GCSDriver) runSelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	err := d.selfTest(ctx)
+	if err != nil {
+		klog.Errorf("Self-test against bucket %s: FAIL: %v", d.selfTestBucket, err)
+	} else {
+		klog.V(1).Infof("Self-test against bucket %s: PASS", d.selfTestBucket)
+	}
+	return err
+}
+
+func (d *GCSDriver) selfTest(ctx context.Context) error {
+	client, err := d.newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("creating client: %v", err)
+	}
+	defer client.Close()
+
+	objectName := fmt.Sprintf("csi-gcs-self-test/%s-%d", d.nodeName, time.Now().UnixNano())
+	object := client.Bucket(d.selfTestBucket).Object(objectName)
+	contents := []byte(fmt.Sprintf("csi-gcs self-test of node %s", d.nodeName))
+
+	writer := object.NewWriter(ctx)
+	if _, err := writer.Write(contents); err != nil {
+		writer.Close()
+		return fmt.Errorf("writing %s: %v", objectName, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("writing %s: %v", objectName, err)
+	}
+
+	reader, err := object.NewReader(ctx)
+	if err == nil {
+		var read []byte
+		read, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err == nil && !bytes.Equal(read, contents) {
+			err = fmt.Errorf("got %d unexpected bytes", len(read))
+		}
+	}
+	if err != nil {
+		// Still try to clean up
+		object.Delete(ctx)
+		return fmt.Errorf("reading %s: %v", objectName, err)
+	}
+
+	if err := object.Delete(ctx); err != nil {
+		return fmt.Errorf("deleting %s: %v", objectName, err)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package driver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"github.com/ofek/csi-gcs/pkg/util"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	// VolumeSnapshotClass parameter choosing where snapshots are copied to, defaults to --snapshot-bucket
+	snapshotBucketParameter = "snapshotBucket"
+
+	// Metadata of the object marking a complete snapshot
+	snapshotSourceVolumeMetadata = "csi-gcs-source-volume"
+	snapshotSizeMetadata         = "csi-gcs-size-bytes"
+)
+
+// Looks up the volume attributes of the PersistentVolumes of a volume
+var sourceVolumeAttributes = util.GetVolumeAttributes
+
+// A snapshot is a copy of every object of a bucket under <name>/ in the snapshot bucket. Once all objects are
+// copied an empty object named <name> is written, recording the source volume and size, which makes the snapshot
+// complete. Its ID is <snapshot bucket>/<name>.
+func (d *GCSDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (response *csi.CreateSnapshotResponse, err error) {
+	klog.V(4).Infof("Method CreateSnapshot called with: %s", protosanitizer.StripSecrets(req))
+
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
+
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing name")
+	}
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing source volume id")
+	}
+
+	snapshotBucketName := req.Parameters[snapshotBucketParameter]
+	if snapshotBucketName == "" {
+		snapshotBucketName = d.snapshotBucket
+	}
+	if snapshotBucketName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Set the %s parameter of the VolumeSnapshotClass or --snapshot-bucket", snapshotBucketParameter)
+	}
+	if snapshotBucketName == req.SourceVolumeId {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket '%s' can't hold snapshots of itself", snapshotBucketName)
+	}
+
+	// The volume ID only names the bucket, the rest is known to the PersistentVolumes using it
+	volumes, err := sourceVolumeAttributes(d.name, req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to look up the PersistentVolumes of volume %s: %v", req.SourceVolumeId, err)
+	}
+	billingProject := req.Secrets[flags.FLAG_BILLING_PROJECT]
+	for _, attributes := range volumes {
+		// Copying the bucket would hand the objects of every volume sharing it to whoever mounts the snapshot
+		if attributes[flags.FLAG_ONLY_DIR] != "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s shares its bucket with other volumes through %s, which can't be snapshotted", req.SourceVolumeId, flags.FLAG_ONLY_DIR)
+		}
+		if project := attributes[flags.FLAG_BILLING_PROJECT]; project != "" {
+			billingProject = project
+		}
+	}
+
+	client, _, err := d.controllerClient(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	sourceBucket := bucketHandle(client, req.SourceVolumeId, billingProject)
+	snapshotBucket := client.Bucket(snapshotBucketName)
+
+	// Objects can't tell a missing bucket from a missing object
+	if _, err := snapshotBucket.Attrs(ctx); err == storage.ErrBucketNotExist {
+		return nil, status.Errorf(codes.InvalidArgument, "Snapshot bucket '%s' does not exist", snapshotBucketName)
+	} else if err != nil {
+		return nil, bucketLookupError(snapshotBucketName, err)
+	}
+
+	// Repeated calls return the snapshot made by the first one
+	marker := snapshotBucket.Object(req.Name)
+	markerAttrs, err := marker.Attrs(ctx)
+	if err == nil {
+		if markerAttrs.Metadata[snapshotSourceVolumeMetadata] != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", req.Name, markerAttrs.Metadata[snapshotSourceVolumeMetadata])
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: snapshotFromMarker(markerAttrs)}, nil
+	} else if err != storage.ErrObjectNotExist {
+		return nil, status.Errorf(codes.Internal, "Failed to look up snapshot %s: %v", req.Name, err)
+	}
+
+	// Objects copied by a call that failed midway are simply copied again
+	var size int64
+	objects := sourceBucket.Objects(ctx, nil)
+	for {
+		objectAttrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err == storage.ErrBucketNotExist {
+			return nil, status.Errorf(codes.NotFound, "Bucket '%s' does not exist", req.SourceVolumeId)
+		}
+		if isRequesterPaysError(err) {
+			return nil, requesterPaysError(req.SourceVolumeId)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to list objects of bucket '%s': %v", req.SourceVolumeId, err)
+		}
+
+		copier := snapshotBucket.Object(req.Name + "/" + objectAttrs.Name).CopierFrom(sourceBucket.Object(objectAttrs.Name).Generation(objectAttrs.Generation))
+		if _, err := copier.Run(ctx); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to copy object '%s' of bucket '%s': %v", objectAttrs.Name, req.SourceVolumeId, err)
+		}
+		size += objectAttrs.Size
+	}
+
+	writer := marker.NewWriter(ctx)
+	writer.Metadata = map[string]string{
+		snapshotSourceVolumeMetadata: req.SourceVolumeId,
+		snapshotSizeMetadata:         strconv.FormatInt(size, 10),
+	}
+	if err := writer.Close(); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to complete snapshot %s: %v", req.Name, err)
+	}
+	util.InfoS(2, "Created snapshot", "snapshotID", snapshotBucketName+"/"+req.Name, "sourceVolumeID", req.SourceVolumeId, "sizeBytes", size)
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshotFromMarker(writer.Attrs())}, nil
+}
+
+func (d *GCSDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (response *csi.DeleteSnapshotResponse, err error) {
+	klog.V(4).Infof("Method DeleteSnapshot called with: %s", protosanitizer.StripSecrets(req))
+
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
+
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing snapshot id")
+	}
+	snapshotBucketName, name, ok := parseSnapshotId(req.SnapshotId)
+	if !ok {
+		klog.V(2).Infof("Snapshot '%s' was not created by the driver, not deleting", req.SnapshotId)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	client, _, err := d.controllerClient(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	snapshotBucket := client.Bucket(snapshotBucketName)
+
+	// The marker goes first so that a snapshot is never listed without all of its objects
+	err = snapshotBucket.Object(name).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, status.Errorf(codes.Internal, "Failed to delete snapshot %s: %v", req.SnapshotId, err)
+	}
+
+	objects := snapshotBucket.Objects(ctx, &storage.Query{Prefix: name + "/"})
+	for {
+		objectAttrs, err := objects.Next()
+		if err == iterator.Done || err == storage.ErrBucketNotExist {
+			break
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to list objects of snapshot %s: %v", req.SnapshotId, err)
+		}
+		if err := snapshotBucket.Object(objectAttrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return nil, status.Errorf(codes.Internal, "Failed to delete object '%s' of snapshot %s: %v", objectAttrs.Name, req.SnapshotId, err)
+		}
+	}
+	util.InfoS(2, "Deleted snapshot", "snapshotID", req.SnapshotId)
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// Only snapshots in --snapshot-bucket are known unless one is asked for by ID, there is no record of other buckets
+func (d *GCSDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (response *csi.ListSnapshotsResponse, err error) {
+	klog.V(4).Infof("Method ListSnapshots called with: %s", protosanitizer.StripSecrets(req))
+
+	ctx, cancel := d.gcsContext(ctx)
+	defer cancel()
+	defer func() { err = contextError(ctx, err) }()
+
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	snapshotBucketName, name := d.snapshotBucket, ""
+	if req.SnapshotId != "" {
+		var ok bool
+		if snapshotBucketName, name, ok = parseSnapshotId(req.SnapshotId); !ok {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+	}
+	if snapshotBucketName == "" {
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+
+	client, _, err := d.controllerClient(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	snapshotBucket := client.Bucket(snapshotBucketName)
+
+	if name != "" {
+		markerAttrs, err := snapshotBucket.Object(name).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return &csi.ListSnapshotsResponse{}, nil
+		} else if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to look up snapshot %s: %v", req.SnapshotId, err)
+		}
+		return listSnapshots(singleObject(markerAttrs), req.SourceVolumeId, "", 0)
+	}
+
+	// Only markers are at the top level, the objects of snapshots are below their name
+	markers := snapshotBucket.Objects(ctx, &storage.Query{Delimiter: "/"})
+	return listSnapshots(markers.Next, req.SourceVolumeId, req.StartingToken, req.MaxEntries)
+}
+
+// Objects are listed in lexicographical order so the ID of the last returned snapshot is used as the token
+func listSnapshots(next func() (*storage.ObjectAttrs, error), sourceVolumeId string, startingToken string, maxEntries int32) (*csi.ListSnapshotsResponse, error) {
+	resp := &csi.ListSnapshotsResponse{}
+
+	for {
+		objectAttrs, err := next()
+		if err == iterator.Done || err == storage.ErrBucketNotExist {
+			return resp, nil
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to list snapshots: %v", err)
+		}
+
+		// Prefixes of snapshots only have a name
+		source, isMarker := objectAttrs.Metadata[snapshotSourceVolumeMetadata]
+		if objectAttrs.Prefix != "" || !isMarker || (sourceVolumeId != "" && source != sourceVolumeId) {
+			continue
+		}
+		snapshot := snapshotFromMarker(objectAttrs)
+		if snapshot.SnapshotId <= startingToken {
+			continue
+		}
+
+		if maxEntries > 0 && len(resp.Entries) == int(maxEntries) {
+			resp.NextToken = resp.Entries[len(resp.Entries)-1].Snapshot.SnapshotId
+			return resp, nil
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+}
+
+func singleObject(objectAttrs *storage.ObjectAttrs) func() (*storage.ObjectAttrs, error) {
+	return func() (*storage.ObjectAttrs, error) {
+		if objectAttrs == nil {
+			return nil, iterator.Done
+		}
+		next := objectAttrs
+		objectAttrs = nil
+		return next, nil
+	}
+}
+
+func snapshotFromMarker(markerAttrs *storage.ObjectAttrs) *csi.Snapshot {
+	snapshot := &csi.Snapshot{
+		SnapshotId:     markerAttrs.Bucket + "/" + markerAttrs.Name,
+		SourceVolumeId: markerAttrs.Metadata[snapshotSourceVolumeMetadata],
+		ReadyToUse:     true,
+	}
+	snapshot.SizeBytes, _ = strconv.ParseInt(markerAttrs.Metadata[snapshotSizeMetadata], 10, 64)
+	if created, err := ptypes.TimestampProto(markerAttrs.Created); err == nil {
+		snapshot.CreationTime = created
+	}
+	return snapshot
+}
+
+func parseSnapshotId(snapshotId string) (bucket string, name string, ok bool) {
+	parts := strings.SplitN(snapshotId, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
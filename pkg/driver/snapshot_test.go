@@ -0,0 +1,336 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeObject struct {
+	size     int64
+	metadata map[string]string
+	created  time.Time
+}
+
+// Just enough of the JSON API of GCS to list, get, copy, upload and delete objects
+type fakeGCS struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+	// Buckets that reject requests without a project to bill
+	requesterPays map[string]bool
+}
+
+func (f *fakeGCS) objectJSON(bucket string, name string, object fakeObject) map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":      bucket,
+		"name":        name,
+		"size":        strconv.FormatInt(object.size, 10),
+		"generation":  "1",
+		"metadata":    object.metadata,
+		"timeCreated": object.created.Format(time.RFC3339Nano),
+	}
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Object names are escaped within the path
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+	if len(parts) < 2 || parts[0] != "b" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	objects, found := f.buckets[parts[1]]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.requesterPays[parts[1]] && r.URL.Query().Get("userProject") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": http.StatusBadRequest, "message": "Bucket is a requester pays bucket but no user project provided."}})
+		return
+	}
+
+	switch {
+	case len(parts) == 2:
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": parts[1]})
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+		names := []string{}
+		for name := range objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items, prefixes := []interface{}{}, []string{}
+		for _, name := range names {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				common := name[:len(prefix)+i+1]
+				if len(prefixes) == 0 || prefixes[len(prefixes)-1] != common {
+					prefixes = append(prefixes, common)
+				}
+				continue
+			}
+			items = append(items, f.objectJSON(parts[1], name, objects[name]))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items, "prefixes": prefixes})
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		part, _ := reader.NextPart()
+		var attrs struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		json.NewDecoder(part).Decode(&attrs)
+		part, _ = reader.NextPart()
+		data, _ := ioutil.ReadAll(part)
+		objects[attrs.Name] = fakeObject{size: int64(len(data)), metadata: attrs.Metadata, created: time.Now()}
+		json.NewEncoder(w).Encode(f.objectJSON(parts[1], attrs.Name, objects[attrs.Name]))
+	case len(parts) == 4:
+		object, found := objects[parts[3]]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(objects, parts[3])
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(f.objectJSON(parts[1], parts[3], object))
+	case len(parts) == 9 && parts[4] == "rewriteTo":
+		object, found := objects[parts[3]]
+		destination, bucketFound := f.buckets[parts[6]]
+		if !found || !bucketFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		object.created = time.Now()
+		destination[parts[8]] = object
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":     "storage#rewriteResponse",
+			"done":     true,
+			"resource": f.objectJSON(parts[6], parts[8], object),
+		})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+var _ = Describe("Snapshots", func() {
+	var (
+		d      *GCSDriver
+		gcs    *fakeGCS
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		gcs = &fakeGCS{buckets: map[string]map[string]fakeObject{
+			"volume": {
+				"a.txt":     {size: 3},
+				"dir/b.txt": {size: 4},
+			},
+			"other":     {},
+			"snapshots": {},
+		}}
+		server = httptest.NewServer(gcs)
+		d = &GCSDriver{name: CSIDriverName, storageEmulatorHost: server.URL, snapshotBucket: "snapshots"}
+		sourceVolumeAttributes = func(driverName string, volumeHandle string) ([]map[string]string, error) {
+			return nil, nil
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		sourceVolumeAttributes = util.GetVolumeAttributes
+	})
+
+	snapshot := func(name string, sourceVolumeId string) (*csi.Snapshot, error) {
+		resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: sourceVolumeId})
+		return resp.GetSnapshot(), err
+	}
+
+	It("Should Copy Every Object Of The Bucket", func() {
+		created, err := snapshot("snapshot-1", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.GetSnapshotId()).To(Equal("snapshots/snapshot-1"))
+		Expect(created.GetSourceVolumeId()).To(Equal("volume"))
+		Expect(created.GetSizeBytes()).To(Equal(int64(7)))
+		Expect(created.GetReadyToUse()).To(BeTrue())
+		Expect(created.GetCreationTime()).NotTo(BeNil())
+		Expect(gcs.buckets["snapshots"]).To(HaveKey("snapshot-1/a.txt"))
+		Expect(gcs.buckets["snapshots"]).To(HaveKey("snapshot-1/dir/b.txt"))
+
+		again, err := snapshot("snapshot-1", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(created))
+
+		_, err = snapshot("snapshot-1", "other")
+		Expect(status.Code(err)).To(Equal(codes.AlreadyExists))
+	})
+	It("Should Use The Bucket Of The Snapshot Class", func() {
+		gcs.buckets["team-snapshots"] = map[string]fakeObject{}
+		resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+			Name:           "snapshot-1",
+			SourceVolumeId: "volume",
+			Parameters:     map[string]string{"snapshotBucket": "team-snapshots"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetSnapshot().GetSnapshotId()).To(Equal("team-snapshots/snapshot-1"))
+		Expect(gcs.buckets["snapshots"]).To(BeEmpty())
+	})
+	It("Should Refuse Volumes Sharing Their Bucket", func() {
+		sourceVolumeAttributes = func(driverName string, volumeHandle string) ([]map[string]string, error) {
+			return []map[string]string{{"bucket": volumeHandle, "onlyDir": "team-a"}, {"bucket": volumeHandle, "onlyDir": "team-b"}}, nil
+		}
+		_, err := snapshot("snapshot-1", "volume")
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		Expect(gcs.buckets["snapshots"]).To(BeEmpty())
+	})
+	It("Should Bill The Project Of The Volume", func() {
+		gcs.requesterPays = map[string]bool{"volume": true}
+		_, err := snapshot("snapshot-1", "volume")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		sourceVolumeAttributes = func(driverName string, volumeHandle string) ([]map[string]string, error) {
+			return []map[string]string{{"bucket": volumeHandle, "billingProject": "team-a"}}, nil
+		}
+		created, err := snapshot("snapshot-1", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.GetSizeBytes()).To(Equal(int64(7)))
+	})
+	It("Should Require A Separate Snapshot Bucket", func() {
+		d.snapshotBucket = ""
+		_, err := snapshot("snapshot-1", "volume")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		d.snapshotBucket = "volume"
+		_, err = snapshot("snapshot-1", "volume")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		d.snapshotBucket = "missing"
+		_, err = snapshot("snapshot-1", "volume")
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	})
+	It("Should Delete Every Object Of The Snapshot", func() {
+		_, err := snapshot("snapshot-1", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = snapshot("snapshot-2", "volume")
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 2; i++ {
+			_, err = d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snapshots/snapshot-1"})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		for name := range gcs.buckets["snapshots"] {
+			Expect(name).To(HavePrefix("snapshot-2"))
+		}
+		Expect(gcs.buckets["volume"]).To(HaveLen(2))
+
+		_, err = d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "unknown"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("Should List Snapshots", func() {
+		for _, name := range []string{"snapshot-1", "snapshot-2"} {
+			_, err := snapshot(name, "volume")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		gcs.buckets["other"]["c.txt"] = fakeObject{size: 1}
+		_, err := snapshot("snapshot-3", "other")
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetEntries()).To(HaveLen(3))
+
+		resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "other"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetEntries()).To(HaveLen(1))
+		Expect(resp.GetEntries()[0].GetSnapshot().GetSizeBytes()).To(Equal(int64(1)))
+
+		resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snapshots/snapshot-2"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetEntries()).To(HaveLen(1))
+		Expect(resp.GetEntries()[0].GetSnapshot().GetSnapshotId()).To(Equal("snapshots/snapshot-2"))
+
+		resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snapshots/missing"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetEntries()).To(BeEmpty())
+	})
+
+	Describe("listSnapshots", func() {
+		var markers []*storage.ObjectAttrs
+
+		BeforeEach(func() {
+			marker := func(name string, source string) *storage.ObjectAttrs {
+				return &storage.ObjectAttrs{Bucket: "snapshots", Name: name, Metadata: map[string]string{snapshotSourceVolumeMetadata: source}}
+			}
+			markers = []*storage.ObjectAttrs{
+				marker("a", "volume"),
+				{Bucket: "snapshots", Name: "not-a-snapshot"},
+				marker("b", "other"),
+				marker("c", "volume"),
+				marker("d", "volume"),
+			}
+		})
+
+		list := func(sourceVolumeId string, startingToken string, maxEntries int32) *csi.ListSnapshotsResponse {
+			remaining := markers
+			next := func() (*storage.ObjectAttrs, error) {
+				if len(remaining) == 0 {
+					return nil, iterator.Done
+				}
+				objectAttrs := remaining[0]
+				remaining = remaining[1:]
+				return objectAttrs, nil
+			}
+
+			resp, err := listSnapshots(next, sourceVolumeId, startingToken, maxEntries)
+			Expect(err).NotTo(HaveOccurred())
+			return resp
+		}
+		snapshotIds := func(resp *csi.ListSnapshotsResponse) []string {
+			ids := []string{}
+			for _, entry := range resp.GetEntries() {
+				ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+			}
+			return ids
+		}
+
+		It("Should Paginate", func() {
+			resp := list("volume", "", 2)
+			Expect(snapshotIds(resp)).To(Equal([]string{"snapshots/a", "snapshots/c"}))
+			Expect(resp.GetNextToken()).To(Equal("snapshots/c"))
+
+			resp = list("volume", resp.GetNextToken(), 2)
+			Expect(snapshotIds(resp)).To(Equal([]string{"snapshots/d"}))
+			Expect(resp.GetNextToken()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Parses the mode of the gRPC socket in octal, empty leaves it to the umask
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed == 0 || parsed > 0777 {
+		return 0, fmt.Errorf("must be octal permissions e.g. 0660, got: %s", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// Parses the owner of the gRPC socket as UID or UID:GID, -1 leaves an ID as it is like for os.Chown
+func parseSocketOwner(owner string) (uid int, gid int, err error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+
+	parts := strings.SplitN(owner, ":", 2)
+	ids := []int{-1, -1}
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return -1, -1, fmt.Errorf("must be a numeric UID optionally followed by :GID e.g. 1000:1000, got: %s", owner)
+		}
+		ids[i] = id
+	}
+	return ids[0], ids[1], nil
+}
+
+// Applies the configured mode and owner to the socket once it is bound, so that e.g. a kubelet that does not run as
+// root can connect
+func (d *GCSDriver) prepareSocket(address string) error {
+	if d.socketMode != 0 {
+		if err := os.Chmod(address, d.socketMode); err != nil {
+			return fmt.Errorf("could not change mode of socket %s: %v", address, err)
+		}
+	}
+
+	if d.socketUID != -1 || d.socketGID != -1 {
+		if err := os.Chown(address, d.socketUID, d.socketGID); err != nil {
+			return fmt.Errorf("could not change owner of socket %s: %v", address, err)
+		}
+	}
+
+	return nil
+}
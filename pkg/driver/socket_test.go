@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Socket", func() {
+	It("Should Parse Modes", func() {
+		Expect(parseSocketMode("")).To(Equal(os.FileMode(0)))
+		Expect(parseSocketMode("0660")).To(Equal(os.FileMode(0660)))
+		Expect(parseSocketMode("666")).To(Equal(os.FileMode(0666)))
+		for _, value := range []string{"0", "0888", "rw-rw----", "01777"} {
+			_, err := parseSocketMode(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+	It("Should Parse Owners", func() {
+		uid, gid, err := parseSocketOwner("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]int{uid, gid}).To(Equal([]int{-1, -1}))
+
+		uid, gid, err = parseSocketOwner("1000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]int{uid, gid}).To(Equal([]int{1000, -1}))
+
+		uid, gid, err = parseSocketOwner("0:1000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]int{uid, gid}).To(Equal([]int{0, 1000}))
+
+		for _, value := range []string{"kubelet", "1000:", ":1000", "-1", "1000:1000:1000"} {
+			_, _, err := parseSocketOwner(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+	It("Should Apply The Mode And Owner To The Socket", func() {
+		dir, err := ioutil.TempDir("", "csi-gcs-socket")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		address := filepath.Join(dir, "csi.sock")
+		listener, err := net.Listen("unix", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		d := &GCSDriver{socketMode: 0660, socketUID: os.Getuid(), socketGID: os.Getgid()}
+		Expect(d.prepareSocket(address)).To(Succeed())
+		info, err := os.Stat(address)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+		d = &GCSDriver{socketUID: -1, socketGID: -1}
+		Expect(d.prepareSocket(filepath.Join(dir, "missing.sock"))).To(Succeed())
+		d.socketGID = os.Getgid()
+		Expect(d.prepareSocket(filepath.Join(dir, "missing.sock"))).To(MatchError(ContainSubstring("could not change owner of socket")))
+	})
+})
@@ -0,0 +1,210 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+// Bind mounts the staged bucket into the target, read-only if the pod asks for it
+func (driver *GCSDriver) bindStagedVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	notMnt, err := driver.mounter.IsLikelyNotMountPoint(stagingPath)
+	if mount.IsCorruptedMnt(err) {
+		// Binding it would only hand the pod the same dead mount
+		return status.Errorf(codes.FailedPrecondition, "gcsfuse of volume %s staged at %s exited: %v", req.GetVolumeId(), stagingPath, err)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err != nil || notMnt {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), stagingPath)
+	}
+
+	mounted, err := driver.bindTarget(stagingPath, req.GetTargetPath(), isReadOnly(req))
+	if err != nil {
+		return err
+	}
+	// Also when already mounted, as after a restart of the driver only the container orchestrator remembers the target
+	driver.stagedTargets.Add(stagingPath, req.GetTargetPath(), isReadOnly(req))
+	driver.mountRegistry.Add(registeredMount{VolumeID: req.GetVolumeId(), TargetPath: req.GetTargetPath(), MountOptions: bindOptions(isReadOnly(req))})
+	if !mounted {
+		return nil
+	}
+	util.InfoS(2, "Published staged volume",
+		"volumeID", req.GetVolumeId(),
+		"stagingPath", stagingPath,
+		"targetPath", req.GetTargetPath(),
+		"readOnly", isReadOnly(req),
+		"podNamespace", req.VolumeContext["csi.storage.k8s.io/pod.namespace"],
+		"podName", req.VolumeContext["csi.storage.k8s.io/pod.name"],
+	)
+
+	if driver.deleteOrphanedPods {
+		err = util.RegisterMount(
+			req.VolumeId,
+			req.TargetPath,
+			driver.nodeName,
+			req.VolumeContext["csi.storage.k8s.io/pod.namespace"],
+			req.VolumeContext["csi.storage.k8s.io/pod.name"],
+			req.VolumeContext,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Like mountTarget but for bind mounts, which need neither retries nor a slot
+func (driver *GCSDriver) bindTarget(stagingPath string, targetPath string, readOnly bool) (mounted bool, err error) {
+	defer driver.targetLocks.Lock(targetPath)()
+
+	notMnt, err := driver.prepareTarget(targetPath)
+	if err != nil || !notMnt {
+		return false, err
+	}
+
+	// No propagation flags are needed: the FUSE mount has no submounts, and the bind mount reaches
+	// the host and pods through the Bidirectional mount of the kubelet's directories in the container
+	if err := driver.mounter.Mount(stagingPath, targetPath, "", bindOptions(readOnly)); err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
+	return true, nil
+}
+
+func bindOptions(readOnly bool) []string {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return options
+}
+
+// A bind mount keeps referring to the FUSE mount it was made from, so once a staging mount is recreated
+// every target bound to it fails like the dead mount did. Binds them anew, which running containers only
+// see after restarting as their own view of the target is a copy taken when they started.
+func (driver *GCSDriver) rebindStagedTargets(stagingPath string) {
+	for targetPath, readOnly := range driver.stagedTargets.Get(stagingPath) {
+		if err := driver.rebindTarget(stagingPath, targetPath, readOnly); err != nil {
+			klog.Errorf("Could not bind %s to the remounted %s: %v", targetPath, stagingPath, err)
+			continue
+		}
+		util.InfoS(2, "Rebound staged volume", "stagingPath", stagingPath, "targetPath", targetPath)
+	}
+}
+
+func (driver *GCSDriver) rebindTarget(stagingPath string, targetPath string, readOnly bool) error {
+	defer driver.targetLocks.Lock(targetPath)()
+
+	notMnt, err := driver.mounter.IsLikelyNotMountPoint(targetPath)
+	if err == nil && !notMnt {
+		// Bound after the staging mount was recreated
+		return nil
+	}
+	if mount.IsCorruptedMnt(err) {
+		if err := driver.mounter.Unmount(targetPath); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		// Unpublished in the meantime
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return driver.mounter.Mount(stagingPath, targetPath, "", bindOptions(readOnly))
+}
+
+// Whether the staging path holds a mount whose gcsfuse exited, which is unmounted so it can be staged again
+func (driver *GCSDriver) unmountDeadStage(stagingPath string) (dead bool, err error) {
+	defer driver.targetLocks.Lock(stagingPath)()
+
+	_, err = driver.mounter.IsLikelyNotMountPoint(stagingPath)
+	if !mount.IsCorruptedMnt(err) {
+		return false, nil
+	}
+
+	klog.Warningf("gcsfuse staged at %s exited, staging again: %v", stagingPath, err)
+	if err := driver.mounter.Unmount(stagingPath); err != nil {
+		return true, status.Error(codes.Internal, err.Error())
+	}
+	return true, nil
+}
+
+// Targets bound to each staging path along with whether they are read only. The zero value is ready to use.
+type stagedTargets struct {
+	mu      sync.Mutex
+	targets map[string]map[string]bool
+}
+
+func (s *stagedTargets) Add(stagingPath string, targetPath string, readOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.targets == nil {
+		s.targets = map[string]map[string]bool{}
+	}
+	if s.targets[stagingPath] == nil {
+		s.targets[stagingPath] = map[string]bool{}
+	}
+	s.targets[stagingPath][targetPath] = readOnly
+}
+
+// Returns a copy so targets can be rebound without holding the lock
+func (s *stagedTargets) Get(stagingPath string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make(map[string]bool, len(s.targets[stagingPath]))
+	for targetPath, readOnly := range s.targets[stagingPath] {
+		targets[targetPath] = readOnly
+	}
+	return targets
+}
+
+// Returns where the target is bound from
+func (s *stagedTargets) StagingPath(targetPath string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stagingPath, targets := range s.targets {
+		if _, found := targets[targetPath]; found {
+			return stagingPath, true
+		}
+	}
+	return "", false
+}
+
+// Forgets the target wherever it was bound from
+func (s *stagedTargets) Remove(targetPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stagingPath, targets := range s.targets {
+		delete(targets, targetPath)
+		if len(targets) == 0 {
+			delete(s.targets, stagingPath)
+		}
+	}
+}
+
+// Forgets every target bound from the staging path
+func (s *stagedTargets) RemoveStage(stagingPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.targets, stagingPath)
+}
@@ -0,0 +1,150 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Creates a client for GCS, or for the emulator without any credentials if one is configured
+func (d *GCSDriver) newStorageClient(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+	if d.storageEmulatorHost != "" {
+		opts = []option.ClientOption{option.WithEndpoint(emulatorURL(d.storageEmulatorHost) + "/storage/v1/"), option.WithoutAuthentication()}
+	} else if d.gcsEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpointURL(d.gcsEndpoint)+"/storage/v1/"))
+	}
+
+	if d.gcsDialTimeout > 0 || d.gcsRequestTimeout > 0 {
+		httpClient, err := d.newHTTPClient(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(httpClient))
+	}
+
+	return storage.NewClient(ctx, opts...)
+}
+
+// The storage library retries transient errors until the context expires, these timeouts bound every single attempt
+func (d *GCSDriver) newHTTPClient(ctx context.Context, opts ...option.ClientOption) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: d.gcsDialTimeout, KeepAlive: 30 * time.Second}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = dialer.DialContext
+
+	// A custom HTTP client replaces the one the storage library would authenticate itself
+	transport, err := htransport.NewTransport(ctx, base, append([]option.ClientOption{option.WithScopes(storage.ScopeFullControl)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: transport, Timeout: d.gcsRequestTimeout}, nil
+}
+
+// Bounds the retries of the storage library for a controller call, a shorter deadline of the call still applies
+func (d *GCSDriver) gcsContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.gcsRetryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.gcsRetryTimeout)
+}
+
+// Reports calls that ran out of time or were cancelled by the caller as such rather than as whatever error GCS
+// returned last
+func contextError(ctx context.Context, err error) error {
+	var code codes.Code
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case context.Canceled:
+		code = codes.Canceled
+	default:
+		return err
+	}
+	if err == nil || status.Code(err) == code {
+		return err
+	}
+	return status.Error(code, status.Convert(err).Message())
+}
+
+// Like other Google libraries STORAGE_EMULATOR_HOST may omit the scheme e.g. localhost:4443
+func emulatorURL(host string) string {
+	if strings.Contains(host, "://") {
+		return strings.TrimSuffix(host, "/")
+	}
+
+	return "http://" + strings.TrimSuffix(host, "/")
+}
+
+// TLS verifies the certificate against the host of the URL, which is what the client sends as SNI
+func endpointURL(host string) string {
+	return "https://" + host
+}
+
+// Accepts a host name or IP address optionally followed by a port, IPv6 addresses in brackets
+func validateEndpointHost(host string) error {
+	if host == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpointURL(host))
+	// Without brackets the last group of an IPv6 address would be taken for the port
+	unbracketedIPv6 := strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[")
+	if err != nil || unbracketedIPv6 || u.Host != host || u.Hostname() == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("must be a host optionally followed by a port e.g. restricted.googleapis.com, got: %s", host)
+	}
+	return nil
+}
+
+// Requests to buckets with Requester Pays enabled must name a project to bill
+func bucketHandle(client *storage.Client, bucketName string, billingProject string) *storage.BucketHandle {
+	bucket := client.Bucket(bucketName)
+	if billingProject != "" {
+		bucket = bucket.UserProject(billingProject)
+	}
+	return bucket
+}
+
+// GCS rejects requests to buckets with Requester Pays enabled that do not name a project to bill
+func isRequesterPaysError(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusBadRequest {
+		message := strings.ToLower(e.Message)
+		return strings.Contains(message, "requester pays") || strings.Contains(message, "user project")
+	}
+	return false
+}
+
+// GCS rejects requests over a rate limit or quota with 429, or 403 for some quotas of the project
+func isQuotaError(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if e.Code == http.StatusForbidden {
+		for _, item := range e.Errors {
+			switch item.Reason {
+			case "quotaExceeded", "rateLimitExceeded", "userRateLimitExceeded", "dailyLimitExceeded":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func requesterPaysError(bucketName string) error {
+	return status.Errorf(codes.InvalidArgument, "Bucket '%s' has Requester Pays enabled, set %s to the project to bill", bucketName, flags.FLAG_BILLING_PROJECT)
+}
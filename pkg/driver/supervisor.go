@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ofek/csi-gcs/pkg/util"
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+// How often supervised mounts are checked, and how long to wait before the first remount
+var (
+	supervisorInterval = 10 * time.Second
+	remountDelay       = time.Second
+)
+
+// Watches a mount whose gcsfuse process may die e.g. when killed for running out of memory, which leaves
+// the target in place but every access failing, and remounts it with the options it was mounted with.
+// Runs until the target is unpublished, or gives up after MaxRemounts and reports the volume as abnormal.
+func (driver *GCSDriver) superviseMount(volumeID string, bucket string, targetPath string, mountOptions []string, mountTimeout time.Duration) {
+	driver.supervisors.Start(targetPath, func(stop <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		delay := remountDelay
+		for remounts := 0; ; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(supervisorInterval):
+			}
+
+			_, err := driver.mounter.IsLikelyNotMountPoint(targetPath)
+			if !mount.IsCorruptedMnt(err) {
+				continue
+			}
+
+			if remounts == MaxRemounts {
+				message := fmt.Sprintf("gcsfuse exited and was remounted %d times already, recreate the pod: %v", remounts, err)
+				klog.Errorf("Giving up on volume %s at %s: %s", volumeID, targetPath, message)
+				driver.remountFailures.Set(targetPath, message)
+				return
+			}
+
+			klog.Warningf("gcsfuse of volume %s at %s exited, remounting in %v: %v", volumeID, targetPath, delay, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			remounts++
+
+			if err := driver.remount(ctx, bucket, targetPath, mountOptions, mountTimeout); err != nil {
+				klog.Errorf("Could not remount volume %s at %s: %v", volumeID, targetPath, err)
+				continue
+			}
+			util.InfoS(2, "Remounted volume", "volumeID", volumeID, "bucket", bucket, "targetPath", targetPath, "remounts", remounts)
+			driver.rebindStagedTargets(targetPath)
+		}
+	})
+}
+
+// Stops supervising a mount and forgets whether it failed
+func (driver *GCSDriver) stopSupervising(targetPath string) {
+	driver.supervisors.Stop(targetPath)
+	driver.remountFailures.Delete(targetPath)
+}
+
+func (driver *GCSDriver) remount(ctx context.Context, bucket string, targetPath string, mountOptions []string, mountTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, mountTimeout)
+	defer cancel()
+
+	// The dead mount has to go before mountTarget sees that nothing is mounted
+	unlock := driver.targetLocks.Lock(targetPath)
+	err := driver.mounter.Unmount(targetPath)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = driver.mountTarget(ctx, bucket, targetPath, mountOptions)
+	return err
+}
+
+// Why supervised mounts were given up on, by target. The zero value is ready to use.
+type remountFailures struct {
+	mu       sync.Mutex
+	messages map[string]string
+}
+
+func (r *remountFailures) Set(targetPath string, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.messages == nil {
+		r.messages = map[string]string{}
+	}
+	r.messages[targetPath] = message
+}
+
+func (r *remountFailures) Get(targetPath string) (message string, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	message, found = r.messages[targetPath]
+	return message, found
+}
+
+func (r *remountFailures) Delete(targetPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.messages, targetPath)
+}
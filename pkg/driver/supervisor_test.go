@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/mount"
+)
+
+// Leaves targets behind as dead FUSE mounts, like gcsfuse being killed
+type crashingMounter struct {
+	*mount.FakeMounter
+	mu   sync.Mutex
+	dead map[string]bool
+	// gcsfuse dies again shortly after every mount
+	crashLoop bool
+}
+
+func (m *crashingMounter) Crash(target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dead[target] = true
+}
+
+func (m *crashingMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	m.mu.Lock()
+	dead := m.dead[file]
+	m.mu.Unlock()
+	if dead {
+		return true, &os.PathError{Op: "lstat", Path: file, Err: syscall.ENOTCONN}
+	}
+	return m.FakeMounter.IsLikelyNotMountPoint(file)
+}
+
+func (m *crashingMounter) Mount(source string, target string, fstype string, options []string) error {
+	if err := m.FakeMounter.Mount(source, target, fstype, options); err != nil {
+		return err
+	}
+	if m.crashLoop {
+		time.AfterFunc(20*time.Millisecond, func() { m.Crash(target) })
+	}
+	return nil
+}
+
+func (m *crashingMounter) Unmount(target string) error {
+	m.mu.Lock()
+	delete(m.dead, target)
+	m.mu.Unlock()
+	return m.FakeMounter.Unmount(target)
+}
+
+var _ = Describe("Supervisor", func() {
+	var (
+		d          *GCSDriver
+		mounter    *crashingMounter
+		volumePath string
+		targetPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "csi-gcs-supervisor")
+		Expect(err).NotTo(HaveOccurred())
+		targetPath = filepath.Join(volumePath, "target")
+		Expect(os.Mkdir(targetPath, 0750)).To(Succeed())
+
+		supervisorInterval = 10 * time.Millisecond
+		remountDelay = time.Millisecond
+		mounter = &crashingMounter{FakeMounter: mount.NewFakeMounter(nil), dead: map[string]bool{}}
+		Expect(mounter.Mount("test", targetPath, "gcsfuse", []string{"key_file=/tmp/keys/test"})).To(Succeed())
+		d = &GCSDriver{name: CSIDriverName, nodeName: "test-node", mounter: mounter, keyStoragePath: filepath.Join(volumePath, "keys")}
+	})
+
+	AfterEach(func() {
+		d.stopSupervising(targetPath)
+		os.RemoveAll(volumePath)
+	})
+
+	mounts := func() (launches int) {
+		for _, action := range mounter.GetLog() {
+			if action.Action == mount.FakeActionMount {
+				launches++
+			}
+		}
+		return launches
+	}
+
+	It("Should Remount When gcsfuse Exits", func() {
+		d.superviseMount("test", "test", targetPath, []string{"key_file=/tmp/keys/test"}, time.Second)
+		mounter.Crash(targetPath)
+
+		Eventually(mounts).Should(Equal(2))
+		Eventually(func() error {
+			_, err := mounter.IsLikelyNotMountPoint(targetPath)
+			return err
+		}).Should(Succeed())
+		Expect(mounter.MountPoints).To(ConsistOf(mount.MountPoint{Device: "test", Path: targetPath, Type: "gcsfuse", Opts: []string{"key_file=/tmp/keys/test"}}))
+	})
+	It("Should Report The Volume As Abnormal Once Remounts Are Exhausted", func() {
+		mounter.crashLoop = true
+		d.superviseMount("test", "test", targetPath, nil, time.Second)
+		mounter.Crash(targetPath)
+
+		Eventually(func() bool {
+			_, failed := d.remountFailures.Get(targetPath)
+			return failed
+		}, 5*time.Second).Should(BeTrue())
+		Expect(mounts()).To(Equal(1 + MaxRemounts))
+
+		resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: targetPath})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+		Expect(resp.GetVolumeCondition().GetMessage()).To(ContainSubstring("recreate the pod"))
+	})
+	It("Should Stop Once Unpublished", func() {
+		d.superviseMount("test", "test", targetPath, nil, time.Second)
+		_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test", TargetPath: targetPath})
+		Expect(err).NotTo(HaveOccurred())
+
+		Consistently(mounts, 100*time.Millisecond).Should(Equal(1))
+		Expect(d.supervisors.entries).To(BeEmpty())
+	})
+})
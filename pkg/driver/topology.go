@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	TopologyKeyZone   = "topology.gcs.csi.ofek.dev/zone"
+	TopologyKeyRegion = "topology.gcs.csi.ofek.dev/region"
+	// The prefix of the region e.g. us for us-central1, which multi-region buckets are located in
+	TopologyKeyMultiRegion = "topology.gcs.csi.ofek.dev/multi-region"
+)
+
+// Replaced in tests, nodes outside of GCE have no metadata server
+var gceZone = metadata.Zone
+
+// Multi-regions name the region prefixes they span
+var multiRegions = map[string]string{
+	"ASIA": "asia",
+	"EU":   "europe",
+	"US":   "us",
+}
+
+// The regions of the predefined dual-regions
+var dualRegions = map[string][]string{
+	"ASIA1": {"asia-northeast1", "asia-northeast2"},
+	"EUR4":  {"europe-north1", "europe-west4"},
+	"NAM4":  {"us-central1", "us-east1"},
+}
+
+// Returns the topology of a node in a zone e.g. us-central1-a
+func zoneTopology(zone string) (*csi.Topology, error) {
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid zone: %s", zone)
+	}
+	region := zone[:i]
+
+	return &csi.Topology{Segments: map[string]string{
+		TopologyKeyZone:        zone,
+		TopologyKeyRegion:      region,
+		TopologyKeyMultiRegion: strings.SplitN(region, "-", 2)[0],
+	}}, nil
+}
+
+// Returns where a bucket in location is accessible from, nil when it is unknown
+func locationTopology(location string) []*csi.Topology {
+	location = strings.ToUpper(location)
+
+	if prefix, found := multiRegions[location]; found {
+		return []*csi.Topology{{Segments: map[string]string{TopologyKeyMultiRegion: prefix}}}
+	}
+
+	regions, found := dualRegions[location]
+	if !found {
+		if !strings.Contains(location, "-") {
+			return nil
+		}
+		regions = []string{location}
+	}
+
+	var topologies []*csi.Topology
+	for _, region := range regions {
+		topologies = append(topologies, &csi.Topology{Segments: map[string]string{TopologyKeyRegion: strings.ToLower(region)}})
+	}
+	return topologies
+}
+
+// Picks the location of a new bucket from where the volume should be accessible, i.e. the region or multi-region of the
+// first preferred topology, or else requisite one, that names either. Empty if none does.
+func requirementsLocation(requirements *csi.TopologyRequirement) string {
+	for _, topologies := range [][]*csi.Topology{requirements.GetPreferred(), requirements.GetRequisite()} {
+		for _, topology := range topologies {
+			segments := topology.GetSegments()
+			if region := segments[TopologyKeyRegion]; region != "" {
+				return strings.ToUpper(region)
+			}
+			for location, prefix := range multiRegions {
+				if segments[TopologyKeyMultiRegion] == prefix {
+					return location
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Whether any node the requirements allow can use a volume accessible from accessible, nil meaning from everywhere
+func meetsRequirements(accessible []*csi.Topology, requirements *csi.TopologyRequirement) bool {
+	allowed := requirements.GetRequisite()
+	if len(allowed) == 0 {
+		allowed = requirements.GetPreferred()
+	}
+	if accessible == nil || len(allowed) == 0 {
+		return true
+	}
+
+	for _, node := range allowed {
+		for _, topology := range accessible {
+			if containsSegments(node, topology) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsSegments(topology *csi.Topology, subset *csi.Topology) bool {
+	for key, value := range subset.GetSegments() {
+		if topology.GetSegments()[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topology", func() {
+	segments := func(location string) []map[string]string {
+		var result []map[string]string
+		for _, topology := range locationTopology(location) {
+			result = append(result, topology.GetSegments())
+		}
+		return result
+	}
+
+	It("Should Restrict Regional Buckets To Their Region", func() {
+		Expect(segments("US-CENTRAL1")).To(Equal([]map[string]string{{TopologyKeyRegion: "us-central1"}}))
+		Expect(segments("europe-west4")).To(Equal([]map[string]string{{TopologyKeyRegion: "europe-west4"}}))
+	})
+	It("Should Restrict Dual-Region Buckets To Both Regions", func() {
+		Expect(segments("NAM4")).To(Equal([]map[string]string{{TopologyKeyRegion: "us-central1"}, {TopologyKeyRegion: "us-east1"}}))
+	})
+	It("Should Restrict Multi-Region Buckets To Every Region Within", func() {
+		Expect(segments("US")).To(Equal([]map[string]string{{TopologyKeyMultiRegion: "us"}}))
+		Expect(segments("EU")).To(Equal([]map[string]string{{TopologyKeyMultiRegion: "europe"}}))
+	})
+	It("Should Not Restrict Buckets In Unknown Locations", func() {
+		Expect(locationTopology("")).To(BeNil())
+		Expect(locationTopology("MARS")).To(BeNil())
+	})
+	It("Should Locate Buckets Where They Are Preferably Used", func() {
+		node := func(zone string) *csi.Topology {
+			topology, err := zoneTopology(zone)
+			Expect(err).NotTo(HaveOccurred())
+			return topology
+		}
+		Expect(requirementsLocation(&csi.TopologyRequirement{
+			Requisite: []*csi.Topology{node("us-east1-b"), node("europe-west4-a")},
+			Preferred: []*csi.Topology{node("europe-west4-a")},
+		})).To(Equal("EUROPE-WEST4"))
+		Expect(requirementsLocation(&csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{TopologyKeyMultiRegion: "europe"}}},
+		})).To(Equal("EU"))
+		Expect(requirementsLocation(nil)).To(BeEmpty())
+	})
+	It("Should Tell Whether Allowed Nodes Can Access Buckets", func() {
+		requirements := &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{
+			TopologyKeyZone:        "us-east1-b",
+			TopologyKeyRegion:      "us-east1",
+			TopologyKeyMultiRegion: "us",
+		}}}}
+		Expect(meetsRequirements(locationTopology("US"), requirements)).To(BeTrue())
+		Expect(meetsRequirements(locationTopology("NAM4"), requirements)).To(BeTrue())
+		Expect(meetsRequirements(locationTopology("EU"), requirements)).To(BeFalse())
+		Expect(meetsRequirements(locationTopology("MARS"), requirements)).To(BeTrue())
+		Expect(meetsRequirements(locationTopology("EU"), nil)).To(BeTrue())
+	})
+	It("Should Reject Invalid Zones", func() {
+		_, err := zoneTopology("local")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Should Only Advertise Accessibility Constraints When Enabled", func() {
+		advertised := func(topology bool) int {
+			d := &GCSDriver{name: CSIDriverName, topology: topology}
+			resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			return len(resp.GetCapabilities())
+		}
+		Expect(advertised(true)).To(Equal(1))
+		Expect(advertised(false)).To(Equal(0))
+	})
+})
@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ofek/csi-gcs/pkg/flags"
+	"google.golang.org/grpc/status"
+)
+
+// Parameters of the external-provisioner rather than the driver
+const provisionerParameterPrefix = "csi.storage.k8s.io/"
+
+// Secrets the external-provisioner and kubelet pass to the driver, each referenced by a name and namespace parameter
+var secretParameterPrefixes = []string{"provisioner", "controller-publish", "node-stage", "node-publish", "controller-expand"}
+
+// Checks the parameters and mount options of a StorageClass like CreateVolume and NodePublishVolume would, without
+// the annotations of a PersistentVolumeClaim or the contents of any Secret. Returns every problem found.
+func ValidateStorageClass(parameters map[string]string, mountOptions []string) []error {
+	var problems []error
+
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !flags.IsFlag(name) && !flags.IsAnnotation(name) && !strings.HasPrefix(name, provisionerParameterPrefix) {
+			problems = append(problems, fmt.Errorf("unknown parameter %s", name))
+		}
+	}
+
+	if _, err := flags.ParseMountOptions(map[string]string{}, mountOptions); err != nil {
+		problems = append(problems, err)
+	}
+
+	for _, prefix := range secretParameterPrefixes {
+		name := parameters[provisionerParameterPrefix+prefix+"-secret-name"]
+		namespace := parameters[provisionerParameterPrefix+prefix+"-secret-namespace"]
+		if (name == "") != (namespace == "") {
+			problems = append(problems, fmt.Errorf("%s%s-secret-name and %s%s-secret-namespace must be set together", provisionerParameterPrefix, prefix, provisionerParameterPrefix, prefix))
+		}
+	}
+
+	// Stand-ins for what the external-provisioner adds, which bucket name templates may use
+	provisioned := map[string]string{
+		provisionerParameterPrefix + "pvc/name":      "pvc",
+		provisionerParameterPrefix + "pvc/namespace": "default",
+	}
+	for name, value := range parameters {
+		provisioned[name] = value
+	}
+
+	capability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountOptions}}}
+	// Any name works as generated bucket names are always valid
+	options, err := provisioningOptions("pvc-validate", nil, []*csi.VolumeCapability{capability}, provisioned, nil)
+	if err != nil {
+		return append(problems, fmt.Errorf("%s", status.Convert(err).Message()))
+	}
+	if _, err := publishOptions(publishDefaults(options[flags.FLAG_BUCKET]), nil, capability, options); err != nil {
+		return append(problems, fmt.Errorf("%s", status.Convert(err).Message()))
+	}
+
+	// Without the Secret the key of the volume would be looked for in vain
+	_, authFile := options[flags.FLAG_AUTH_FILE]
+	if options[flags.FLAG_AUTH_TYPE] == flags.AUTH_TYPE_KEY && !authFile && parameters[provisionerParameterPrefix+"node-publish-secret-name"] == "" {
+		problems = append(problems, fmt.Errorf("authType %s needs the Secret holding the key in %snode-publish-secret-name", flags.AUTH_TYPE_KEY, provisionerParameterPrefix))
+	}
+
+	return problems
+}
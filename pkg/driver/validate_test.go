@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateStorageClass", func() {
+	It("Should Accept Parameters, Annotations And Mount Options", func() {
+		Expect(ValidateStorageClass(map[string]string{
+			"projectId":                                        "my-project",
+			"gcs.csi.ofek.dev/location":                        "EU",
+			"csi.storage.k8s.io/pvc/name":                      "${pvc.name}",
+			"csi.storage.k8s.io/fstype":                        "",
+			"csi.storage.k8s.io/node-publish-secret-name":      "csi-gcs-secret-mounter",
+			"csi.storage.k8s.io/node-publish-secret-namespace": "default",
+		}, []string{"--implicit-dirs", "--gid=1000"})).To(BeEmpty())
+	})
+	It("Should Report Every Problem", func() {
+		problems := ValidateStorageClass(map[string]string{
+			"implicitDir": "true",
+			"csi.storage.k8s.io/provisioner-secret-name": "csi-gcs-secret-creator",
+		}, []string{"--gid=1000", "implicit-dirs"})
+		Expect(problems).To(HaveLen(3))
+		Expect(problems[0]).To(MatchError(ContainSubstring("implicitDir")))
+		Expect(problems[1]).To(MatchError(ContainSubstring("implicit-dirs")))
+		Expect(problems[2]).To(MatchError(ContainSubstring("provisioner-secret-namespace")))
+	})
+	It("Should Validate Like CreateVolume", func() {
+		Expect(ValidateStorageClass(map[string]string{"dirMode": "999"}, nil)).To(ConsistOf(MatchError(ContainSubstring("dirMode"))))
+		Expect(ValidateStorageClass(map[string]string{"bucketPrefix": "a-very-long-prefix-that-leaves-no-room-for-the-name-of-the-volume-"}, nil)).To(ConsistOf(MatchError(ContainSubstring("63 characters"))))
+	})
+	It("Should Expand Bucket Name Templates", func() {
+		Expect(ValidateStorageClass(map[string]string{"bucketNameTemplate": "${pvc.namespace}-${pvc.name}-${random}"}, nil)).To(BeEmpty())
+		Expect(ValidateStorageClass(map[string]string{"bucketNameTemplate": "${pvc.name}-" + strings.Repeat("x", 60)}, nil)).To(ConsistOf(MatchError(ContainSubstring("3 to 63"))))
+	})
+	It("Should Require The Secret Of Keys", func() {
+		Expect(ValidateStorageClass(map[string]string{"authType": "key"}, nil)).To(ConsistOf(MatchError(ContainSubstring("node-publish-secret-name"))))
+		Expect(ValidateStorageClass(map[string]string{"authType": "workload-identity"}, nil)).To(BeEmpty())
+	})
+})
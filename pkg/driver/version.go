@@ -9,10 +9,12 @@ import (
 // These will be set at build time.
 var (
 	driverVersion string
+	gitCommit     string
 )
 
 type VersionInfo struct {
 	DriverVersion string `json:"driverVersion"`
+	GitCommit     string `json:"gitCommit"`
 	GoVersion     string `json:"goVersion"`
 	Compiler      string `json:"compiler"`
 	Platform      string `json:"platform"`
@@ -21,6 +23,7 @@ type VersionInfo struct {
 func GetVersion() VersionInfo {
 	return VersionInfo{
 		DriverVersion: driverVersion,
+		GitCommit:     gitCommit,
 		GoVersion:     runtime.Version(),
 		Compiler:      runtime.Compiler,
 		Platform:      fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
@@ -0,0 +1,170 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"k8s.io/klog"
+)
+
+// Object counts of mounted volumes. Listing a bucket takes long and is billed per request, so they are counted in the
+// background every --volume-stats-interval and the last counts are served in between. The zero value is ready to use.
+type volumeStats struct {
+	mu      sync.Mutex
+	volumes map[string]*volumeUsage
+}
+
+type volumeUsage struct {
+	bucket         string
+	prefix         string
+	billingProject string
+	clientOpt      option.ClientOption
+	// Zero until counted for the first time
+	countedAt time.Time
+	objects   int64
+	bytes     int64
+	// Counting stopped at --volume-stats-max-objects, there are more
+	truncated bool
+}
+
+func (s *volumeStats) Track(targetPath string, bucket string, prefix string, billingProject string, clientOpt option.ClientOption) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.volumes == nil {
+		s.volumes = map[string]*volumeUsage{}
+	}
+	// Publishing again must not throw away the counts
+	if usage, found := s.volumes[targetPath]; found && usage.bucket == bucket && usage.prefix == prefix {
+		usage.billingProject, usage.clientOpt = billingProject, clientOpt
+		return
+	}
+	s.volumes[targetPath] = &volumeUsage{bucket: bucket, prefix: prefix, billingProject: billingProject, clientOpt: clientOpt}
+}
+
+func (s *volumeStats) Untrack(targetPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.volumes, targetPath)
+}
+
+func (s *volumeStats) Get(targetPath string) (usage volumeUsage, found bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tracked, found := s.volumes[targetPath]; found {
+		return *tracked, true
+	}
+	return volumeUsage{}, false
+}
+
+func (s *volumeStats) targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]string, 0, len(s.volumes))
+	for targetPath := range s.volumes {
+		targets = append(targets, targetPath)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Unless the target was unmounted or mounted with something else while counting
+func (s *volumeStats) update(targetPath string, counted volumeUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usage, found := s.volumes[targetPath]; found && usage.bucket == counted.bucket && usage.prefix == counted.prefix {
+		usage.countedAt, usage.objects, usage.bytes, usage.truncated = counted.countedAt, counted.objects, counted.bytes, counted.truncated
+	}
+}
+
+// Replaced in tests
+var countVolumeUsage = listVolumeUsage
+
+// Counts the objects under the prefix and their size, stopping after maxObjects unless it is 0
+func listVolumeUsage(ctx context.Context, d *GCSDriver, usage volumeUsage, maxObjects int64) (volumeUsage, error) {
+	var opts []option.ClientOption
+	if usage.clientOpt != nil {
+		opts = append(opts, usage.clientOpt)
+	}
+	client, err := d.newStorageClient(ctx, opts...)
+	if err != nil {
+		return usage, err
+	}
+	defer client.Close()
+
+	usage.objects, usage.bytes, usage.truncated = 0, 0, false
+	objects := bucketHandle(client, usage.bucket, usage.billingProject).Objects(ctx, &storage.Query{Prefix: usage.prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return usage, nil
+		}
+		if err != nil {
+			return usage, err
+		}
+		if maxObjects > 0 && usage.objects >= maxObjects {
+			usage.truncated = true
+			return usage, nil
+		}
+		usage.objects++
+		usage.bytes += attrs.Size
+	}
+}
+
+func (d *GCSDriver) RunVolumeStatsRefresher(stopCh <-chan struct{}) {
+	klog.V(1).Infof("Counting objects of mounted volumes every %s", d.volumeStatsInterval)
+
+	ticker := time.NewTicker(d.volumeStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			d.refreshVolumeStats(context.Background())
+		}
+	}
+}
+
+// Counts one volume after the other to keep the load on GCS low, volumes that fail keep their previous counts
+func (d *GCSDriver) refreshVolumeStats(ctx context.Context) {
+	for _, targetPath := range d.volumeStats.targets() {
+		usage, found := d.volumeStats.Get(targetPath)
+		if !found {
+			continue
+		}
+
+		countCtx, cancel := d.gcsContext(ctx)
+		counted, err := countVolumeUsage(countCtx, d, usage, d.volumeStatsMaxObjects)
+		cancel()
+		if err != nil {
+			klog.Warningf("Could not count objects of bucket %s mounted at %s: %v", usage.bucket, targetPath, err)
+			continue
+		}
+
+		counted.countedAt = time.Now()
+		d.volumeStats.update(targetPath, counted)
+		klog.V(5).Infof("Counted %d objects with %d bytes of bucket %s mounted at %s", counted.objects, counted.bytes, usage.bucket, targetPath)
+	}
+}
+
+// Looks through bind mounts of staged volumes, which are counted once at the staging path
+func (d *GCSDriver) countedVolumeUsage(volumePath string) (volumeUsage, bool) {
+	usage, found := d.volumeStats.Get(volumePath)
+	if !found {
+		if stagingPath, staged := d.stagedTargets.StagingPath(volumePath); staged {
+			usage, found = d.volumeStats.Get(stagingPath)
+		}
+	}
+	return usage, found && !usage.countedAt.IsZero()
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	raw "google.golang.org/api/storage/v1"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Volume Stats", func() {
+	var (
+		d          *GCSDriver
+		mounter    *mount.FakeMounter
+		volumePath string
+		counts     int
+	)
+
+	var usageOf = func(resp *csi.NodeGetVolumeStatsResponse, unit csi.VolumeUsage_Unit) *csi.VolumeUsage {
+		for _, usage := range resp.GetUsage() {
+			if usage.GetUnit() == unit {
+				return usage
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "csi-gcs-stats")
+		Expect(err).NotTo(HaveOccurred())
+
+		mounter = mount.NewFakeMounter(nil)
+		Expect(mounter.Mount("bucket", volumePath, "gcsfuse", nil)).To(Succeed())
+		d = &GCSDriver{mounter: mounter, keyStoragePath: filepath.Join(volumePath, "keys"), volumeStatsInterval: time.Minute}
+
+		counts = 0
+		countVolumeUsage = func(ctx context.Context, d *GCSDriver, usage volumeUsage, maxObjects int64) (volumeUsage, error) {
+			counts++
+			usage.objects, usage.bytes = 3, 300
+			return usage, nil
+		}
+	})
+
+	AfterEach(func() {
+		countVolumeUsage = listVolumeUsage
+		os.RemoveAll(volumePath)
+	})
+
+	It("Should Serve Counts Between Refreshes", func() {
+		d.volumeStats.Track(volumePath, "bucket", "", "", nil)
+		req := &csi.NodeGetVolumeStatsRequest{VolumeId: "test", VolumePath: volumePath}
+
+		// What gcsfuse reports until counted
+		resp, err := d.NodeGetVolumeStats(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetVolumeCondition().GetMessage()).To(Equal("Volume is mounted"))
+
+		d.refreshVolumeStats(context.Background())
+		for i := 0; i < 2; i++ {
+			resp, err = d.NodeGetVolumeStats(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usageOf(resp, csi.VolumeUsage_BYTES).GetUsed()).To(Equal(int64(300)))
+			Expect(usageOf(resp, csi.VolumeUsage_INODES).GetUsed()).To(Equal(int64(3)))
+			Expect(resp.GetVolumeCondition().GetMessage()).To(ContainSubstring("usage of 3 objects counted"))
+		}
+		Expect(counts).To(Equal(1))
+	})
+	It("Should Keep Counts When Counting Fails", func() {
+		d.volumeStats.Track(volumePath, "bucket", "", "", nil)
+		d.refreshVolumeStats(context.Background())
+		countVolumeUsage = func(ctx context.Context, d *GCSDriver, usage volumeUsage, maxObjects int64) (volumeUsage, error) {
+			return usage, errors.New("quota exceeded")
+		}
+		d.refreshVolumeStats(context.Background())
+
+		usage, found := d.countedVolumeUsage(volumePath)
+		Expect(found).To(BeTrue())
+		Expect(usage.objects).To(Equal(int64(3)))
+	})
+	It("Should Count Staged Volumes Once", func() {
+		targetPath := filepath.Join(volumePath, "target")
+		d.volumeStats.Track(volumePath, "bucket", "", "", nil)
+		d.stagedTargets.Add(volumePath, targetPath, false)
+		d.refreshVolumeStats(context.Background())
+
+		usage, found := d.countedVolumeUsage(targetPath)
+		Expect(found).To(BeTrue())
+		Expect(usage.bytes).To(Equal(int64(300)))
+		Expect(counts).To(Equal(1))
+	})
+	It("Should Forget Unmounted Volumes", func() {
+		d.volumeStats.Track(volumePath, "bucket", "", "", nil)
+		Expect(d.unmountTarget(context.Background(), "test", volumePath)).To(Succeed())
+		d.refreshVolumeStats(context.Background())
+
+		Expect(counts).To(BeZero())
+		Expect(d.volumeStats.targets()).To(BeEmpty())
+	})
+	It("Should Count Objects Below The Prefix Up To The Limit", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var items []*raw.Object
+			for _, name := range []string{"dir/a", "dir/b", "dir/c", "other/d"} {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					items = append(items, &raw.Object{Bucket: "bucket", Name: name, Size: 10})
+				}
+			}
+			json.NewEncoder(w).Encode(&raw.Objects{Items: items})
+		}))
+		defer server.Close()
+		d.storageEmulatorHost = server.URL
+
+		usage := volumeUsage{bucket: "bucket", prefix: objectPrefix("/dir/")}
+		counted, err := listVolumeUsage(context.Background(), d, usage, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]int64{counted.objects, counted.bytes}).To(Equal([]int64{3, 30}))
+		Expect(counted.truncated).To(BeFalse())
+
+		counted, err = listVolumeUsage(context.Background(), d, usage, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counted.objects).To(Equal(int64(2)))
+		Expect(counted.truncated).To(BeTrue())
+	})
+})
@@ -2,65 +2,189 @@ package flags
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/klog"
 )
 
 const (
-	FLAG_BUCKET              = "bucket"
-	FLAG_PROJECT_ID          = "projectId"
-	FLAG_KMS_KEY_ID          = "kmsKeyId"
-	FLAG_LOCATION            = "location"
-	FLAG_FUSE_MOUNT_OPTION   = "fuseMountOptions"
-	FLAG_DIR_MODE            = "dirMode"
-	FLAG_FILE_MODE           = "fileMode"
-	FLAG_UID                 = "uid"
-	FLAG_GID                 = "gid"
-	FLAG_IMPLICIT_DIRS       = "implicitDirs"
-	FLAG_BILLING_PROJECT     = "billingProject"
-	FLAG_LIMIT_BYTES_PER_SEC = "limitBytesPerSec"
-	FLAG_LIMIT_OPS_PER_SEC   = "limitOpsPerSec"
-	FLAG_STAT_CACHE_TTL      = "statCacheTTL"
-	FLAG_TYPE_CACHE_TTL      = "typeCacheTTL"
-	FLAG_MAX_RETRY_SLEEP     = "maxRetrySleep"
+	FLAG_BUCKET                      = "bucket"
+	FLAG_PROJECT_ID                  = "projectId"
+	FLAG_KMS_KEY_ID                  = "kmsKeyId"
+	FLAG_LOCATION                    = "location"
+	FLAG_FUSE_MOUNT_OPTION           = "fuseMountOptions"
+	FLAG_DIR_MODE                    = "dirMode"
+	FLAG_FILE_MODE                   = "fileMode"
+	FLAG_UID                         = "uid"
+	FLAG_GID                         = "gid"
+	FLAG_IMPLICIT_DIRS               = "implicitDirs"
+	FLAG_BILLING_PROJECT             = "billingProject"
+	FLAG_LIMIT_BYTES_PER_SEC         = "limitBytesPerSec"
+	FLAG_LIMIT_OPS_PER_SEC           = "limitOpsPerSec"
+	FLAG_STAT_CACHE_TTL              = "statCacheTTL"
+	FLAG_TYPE_CACHE_TTL              = "typeCacheTTL"
+	FLAG_MAX_RETRY_SLEEP             = "maxRetrySleep"
+	FLAG_AUTH_TYPE                   = "authType"
+	FLAG_PROVISION_BUCKET            = "provisionBucket"
+	FLAG_BUCKET_PREFIX               = "bucketPrefix"
+	FLAG_BUCKET_STORAGE_CLASS        = "bucketStorageClass"
+	FLAG_UNIFORM_BUCKET_LEVEL_ACCESS = "uniformBucketLevelAccess"
+	FLAG_ONLY_DIR                    = "onlyDir"
+	FLAG_MOUNT_TIMEOUT               = "mountTimeout"
+	FLAG_CACHE_DIR                   = "cacheDir"
+	FLAG_CACHE_MAX_SIZE_MB           = "cacheMaxSizeMb"
+	FLAG_BUCKET_LABELS               = "bucketLabels"
+	FLAG_REMOUNT_ON_FAILURE          = "remountOnFailure"
+	FLAG_DEBUG                       = "debug"
+	FLAG_MAX_CONNS_PER_HOST          = "maxConnsPerHost"
+	FLAG_MAX_IDLE_CONNS_PER_HOST     = "maxIdleConnsPerHost"
+	FLAG_LIFECYCLE_DELETE_AFTER_DAYS = "lifecycleDeleteAfterDays"
+	FLAG_RETENTION_PERIOD_DAYS       = "retentionPeriodDays"
+	FLAG_BUCKET_NAME_TEMPLATE        = "bucketNameTemplate"
+	FLAG_AUTH_FILE                   = "authFile"
+	FLAG_STAT_CACHE_CAPACITY         = "statCacheCapacity"
+	FLAG_ALLOW_NON_EMPTY_DELETE      = "allowNonEmptyDelete"
+	FLAG_SNAPSHOT_ID                 = "snapshotId"
+	FLAG_SEQUENTIAL_READ_SIZE_MB     = "sequentialReadSizeMb"
+	FLAG_READ_PATTERN                = "readPattern"
+	FLAG_DEFAULT_OBJECT_ACL          = "defaultObjectAcl"
+	FLAG_LOG_FILE                    = "logFile"
+	FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB = "logRotateMaxFileSizeMb"
+	FLAG_LOG_ROTATE_BACKUPS          = "logRotateBackupFileCount"
+	FLAG_AUDIENCE                    = "audience"
+	FLAG_TOKEN_URL                   = "tokenUrl"
+	FLAG_SERVICE_ACCOUNT             = "serviceAccount"
+	FLAG_KERNEL_LIST_CACHE_TTL       = "kernelListCacheTTL"
+	FLAG_METADATA_PREFETCH_ON_MOUNT  = "metadataPrefetchOnMount"
 
 	ANNOTATION_PREFIX = "gcs.csi.ofek.dev/"
 
-	ANNOTATION_BUCKET              = "gcs.csi.ofek.dev/bucket"
-	ANNOTATION_PROJECT_ID          = "gcs.csi.ofek.dev/project-id"
-	ANNOTATION_KMS_KEY_ID          = "gcs.csi.ofek.dev/kms-key-id"
-	ANNOTATION_LOCATION            = "gcs.csi.ofek.dev/location"
-	ANNOTATION_FUSE_MOUNT_OPTION   = "gcs.csi.ofek.dev/fuse-mount-options"
-	ANNOTATION_DIR_MODE            = "gcs.csi.ofek.dev/dir-mode"
-	ANNOTATION_FILE_MODE           = "gcs.csi.ofek.dev/file-mode"
-	ANNOTATION_UID                 = "gcs.csi.ofek.dev/uid"
-	ANNOTATION_GID                 = "gcs.csi.ofek.dev/gid"
-	ANNOTATION_IMPLICIT_DIRS       = "gcs.csi.ofek.dev/implicit-dirs"
-	ANNOTATION_BILLING_PROJECT     = "gcs.csi.ofek.dev/billing-project"
-	ANNOTATION_LIMIT_BYTES_PER_SEC = "gcs.csi.ofek.dev/limit-bytes-per-sec"
-	ANNOTATION_LIMIT_OPS_PER_SEC   = "gcs.csi.ofek.dev/limit-ops-per-sec"
-	ANNOTATION_STAT_CACHE_TTL      = "gcs.csi.ofek.dev/stat-cache-ttl"
-	ANNOTATION_TYPE_CACHE_TTL      = "gcs.csi.ofek.dev/type-cache-ttl"
-	ANNOTATION_MAX_RETRY_SLEEP     = "gcs.csi.ofek.dev/max-retry-sleep"
-
-	MOUNT_OPTION_BUCKET              = "bucket"
-	MOUNT_OPTION_PROJECT_ID          = "project-id"
-	MOUNT_OPTION_KMS_KEY_ID          = "kms-key-id"
-	MOUNT_OPTION_LOCATION            = "location"
-	MOUNT_OPTION_FUSE_MOUNT_OPTION   = "fuse-mount-option"
-	MOUNT_OPTION_DIR_MODE            = "dir-mode"
-	MOUNT_OPTION_FILE_MODE           = "file-mode"
-	MOUNT_OPTION_UID                 = "uid"
-	MOUNT_OPTION_GID                 = "gid"
-	MOUNT_OPTION_IMPLICIT_DIRS       = "implicit-dirs"
-	MOUNT_OPTION_BILLING_PROJECT     = "billing-project"
-	MOUNT_OPTION_LIMIT_BYTES_PER_SEC = "limit-bytes-per-sec"
-	MOUNT_OPTION_LIMIT_OPS_PER_SEC   = "limit-ops-per-sec"
-	MOUNT_OPTION_STAT_CACHE_TTL      = "stat-cache-ttl"
-	MOUNT_OPTION_TYPE_CACHE_TTL      = "type-cache-ttl"
-	MOUNT_OPTION_MAX_RETRY_SLEEP     = "max-retry-sleep"
+	ANNOTATION_BUCKET                      = "gcs.csi.ofek.dev/bucket"
+	ANNOTATION_PROJECT_ID                  = "gcs.csi.ofek.dev/project-id"
+	ANNOTATION_KMS_KEY_ID                  = "gcs.csi.ofek.dev/kms-key-id"
+	ANNOTATION_LOCATION                    = "gcs.csi.ofek.dev/location"
+	ANNOTATION_FUSE_MOUNT_OPTION           = "gcs.csi.ofek.dev/fuse-mount-options"
+	ANNOTATION_DIR_MODE                    = "gcs.csi.ofek.dev/dir-mode"
+	ANNOTATION_FILE_MODE                   = "gcs.csi.ofek.dev/file-mode"
+	ANNOTATION_UID                         = "gcs.csi.ofek.dev/uid"
+	ANNOTATION_GID                         = "gcs.csi.ofek.dev/gid"
+	ANNOTATION_IMPLICIT_DIRS               = "gcs.csi.ofek.dev/implicit-dirs"
+	ANNOTATION_BILLING_PROJECT             = "gcs.csi.ofek.dev/billing-project"
+	ANNOTATION_LIMIT_BYTES_PER_SEC         = "gcs.csi.ofek.dev/limit-bytes-per-sec"
+	ANNOTATION_LIMIT_OPS_PER_SEC           = "gcs.csi.ofek.dev/limit-ops-per-sec"
+	ANNOTATION_STAT_CACHE_TTL              = "gcs.csi.ofek.dev/stat-cache-ttl"
+	ANNOTATION_TYPE_CACHE_TTL              = "gcs.csi.ofek.dev/type-cache-ttl"
+	ANNOTATION_MAX_RETRY_SLEEP             = "gcs.csi.ofek.dev/max-retry-sleep"
+	ANNOTATION_PROVISION_BUCKET            = "gcs.csi.ofek.dev/provision-bucket"
+	ANNOTATION_BUCKET_PREFIX               = "gcs.csi.ofek.dev/bucket-prefix"
+	ANNOTATION_BUCKET_STORAGE_CLASS        = "gcs.csi.ofek.dev/bucket-storage-class"
+	ANNOTATION_UNIFORM_BUCKET_LEVEL_ACCESS = "gcs.csi.ofek.dev/uniform-bucket-level-access"
+	ANNOTATION_ONLY_DIR                    = "gcs.csi.ofek.dev/only-dir"
+	ANNOTATION_MOUNT_TIMEOUT               = "gcs.csi.ofek.dev/mount-timeout"
+	ANNOTATION_CACHE_DIR                   = "gcs.csi.ofek.dev/cache-dir"
+	ANNOTATION_CACHE_MAX_SIZE_MB           = "gcs.csi.ofek.dev/cache-max-size-mb"
+	ANNOTATION_BUCKET_LABELS               = "gcs.csi.ofek.dev/bucket-labels"
+	ANNOTATION_REMOUNT_ON_FAILURE          = "gcs.csi.ofek.dev/remount-on-failure"
+	ANNOTATION_DEBUG                       = "gcs.csi.ofek.dev/debug"
+	ANNOTATION_MAX_CONNS_PER_HOST          = "gcs.csi.ofek.dev/max-conns-per-host"
+	ANNOTATION_MAX_IDLE_CONNS_PER_HOST     = "gcs.csi.ofek.dev/max-idle-conns-per-host"
+	ANNOTATION_LIFECYCLE_DELETE_AFTER_DAYS = "gcs.csi.ofek.dev/lifecycle-delete-after-days"
+	ANNOTATION_RETENTION_PERIOD_DAYS       = "gcs.csi.ofek.dev/retention-period-days"
+	ANNOTATION_BUCKET_NAME_TEMPLATE        = "gcs.csi.ofek.dev/bucket-name-template"
+	ANNOTATION_STAT_CACHE_CAPACITY         = "gcs.csi.ofek.dev/stat-cache-capacity"
+	ANNOTATION_ALLOW_NON_EMPTY_DELETE      = "gcs.csi.ofek.dev/allow-non-empty-delete"
+	ANNOTATION_SNAPSHOT_ID                 = "gcs.csi.ofek.dev/snapshot-id"
+	ANNOTATION_SEQUENTIAL_READ_SIZE_MB     = "gcs.csi.ofek.dev/sequential-read-size-mb"
+	ANNOTATION_READ_PATTERN                = "gcs.csi.ofek.dev/read-pattern"
+	ANNOTATION_DEFAULT_OBJECT_ACL          = "gcs.csi.ofek.dev/default-object-acl"
+	ANNOTATION_LOG_FILE                    = "gcs.csi.ofek.dev/log-file"
+	ANNOTATION_LOG_ROTATE_MAX_FILE_SIZE_MB = "gcs.csi.ofek.dev/log-rotate-max-file-size-mb"
+	ANNOTATION_LOG_ROTATE_BACKUPS          = "gcs.csi.ofek.dev/log-rotate-backup-file-count"
+	ANNOTATION_AUDIENCE                    = "gcs.csi.ofek.dev/audience"
+	ANNOTATION_TOKEN_URL                   = "gcs.csi.ofek.dev/token-url"
+	ANNOTATION_SERVICE_ACCOUNT             = "gcs.csi.ofek.dev/service-account"
+	ANNOTATION_KERNEL_LIST_CACHE_TTL       = "gcs.csi.ofek.dev/kernel-list-cache-ttl"
+	ANNOTATION_METADATA_PREFETCH_ON_MOUNT  = "gcs.csi.ofek.dev/metadata-prefetch-on-mount"
+
+	MOUNT_OPTION_BUCKET                      = "bucket"
+	MOUNT_OPTION_PROJECT_ID                  = "project-id"
+	MOUNT_OPTION_KMS_KEY_ID                  = "kms-key-id"
+	MOUNT_OPTION_LOCATION                    = "location"
+	MOUNT_OPTION_FUSE_MOUNT_OPTION           = "fuse-mount-option"
+	MOUNT_OPTION_DIR_MODE                    = "dir-mode"
+	MOUNT_OPTION_FILE_MODE                   = "file-mode"
+	MOUNT_OPTION_UID                         = "uid"
+	MOUNT_OPTION_GID                         = "gid"
+	MOUNT_OPTION_IMPLICIT_DIRS               = "implicit-dirs"
+	MOUNT_OPTION_BILLING_PROJECT             = "billing-project"
+	MOUNT_OPTION_LIMIT_BYTES_PER_SEC         = "limit-bytes-per-sec"
+	MOUNT_OPTION_LIMIT_OPS_PER_SEC           = "limit-ops-per-sec"
+	MOUNT_OPTION_STAT_CACHE_TTL              = "stat-cache-ttl"
+	MOUNT_OPTION_TYPE_CACHE_TTL              = "type-cache-ttl"
+	MOUNT_OPTION_MAX_RETRY_SLEEP             = "max-retry-sleep"
+	MOUNT_OPTION_PROVISION_BUCKET            = "provision-bucket"
+	MOUNT_OPTION_BUCKET_PREFIX               = "bucket-prefix"
+	MOUNT_OPTION_BUCKET_STORAGE_CLASS        = "bucket-storage-class"
+	MOUNT_OPTION_UNIFORM_BUCKET_LEVEL_ACCESS = "uniform-bucket-level-access"
+	MOUNT_OPTION_ONLY_DIR                    = "only-dir"
+	MOUNT_OPTION_MOUNT_TIMEOUT               = "mount-timeout"
+	MOUNT_OPTION_CACHE_DIR                   = "cache-dir"
+	MOUNT_OPTION_CACHE_MAX_SIZE_MB           = "cache-max-size-mb"
+	MOUNT_OPTION_BUCKET_LABELS               = "bucket-labels"
+	MOUNT_OPTION_REMOUNT_ON_FAILURE          = "remount-on-failure"
+	MOUNT_OPTION_DEBUG                       = "debug"
+	MOUNT_OPTION_MAX_CONNS_PER_HOST          = "max-conns-per-host"
+	MOUNT_OPTION_MAX_IDLE_CONNS_PER_HOST     = "max-idle-conns-per-host"
+	MOUNT_OPTION_LIFECYCLE_DELETE_AFTER_DAYS = "lifecycle-delete-after-days"
+	MOUNT_OPTION_RETENTION_PERIOD_DAYS       = "retention-period-days"
+	MOUNT_OPTION_BUCKET_NAME_TEMPLATE        = "bucket-name-template"
+	MOUNT_OPTION_STAT_CACHE_CAPACITY         = "stat-cache-capacity"
+	MOUNT_OPTION_ALLOW_NON_EMPTY_DELETE      = "allow-non-empty-delete"
+	MOUNT_OPTION_SNAPSHOT_ID                 = "snapshot-id"
+	MOUNT_OPTION_SEQUENTIAL_READ_SIZE_MB     = "sequential-read-size-mb"
+	MOUNT_OPTION_READ_PATTERN                = "read-pattern"
+	MOUNT_OPTION_DEFAULT_OBJECT_ACL          = "default-object-acl"
+	MOUNT_OPTION_LOG_FILE                    = "log-file"
+	MOUNT_OPTION_LOG_ROTATE_MAX_FILE_SIZE_MB = "log-rotate-max-file-size-mb"
+	MOUNT_OPTION_LOG_ROTATE_BACKUPS          = "log-rotate-backup-file-count"
+	MOUNT_OPTION_AUDIENCE                    = "audience"
+	MOUNT_OPTION_TOKEN_URL                   = "token-url"
+	MOUNT_OPTION_SERVICE_ACCOUNT             = "service-account"
+	MOUNT_OPTION_KERNEL_LIST_CACHE_TTL       = "kernel-list-cache-ttl"
+	MOUNT_OPTION_METADATA_PREFETCH_ON_MOUNT  = "metadata-prefetch-on-mount"
+
+	AUTH_TYPE_KEY               = "key"
+	AUTH_TYPE_WORKLOAD_IDENTITY = "workload-identity"
+	AUTH_TYPE_NONE              = "none"
+	// Exchanges a token of the pod's Kubernetes service account, e.g. outside of GKE
+	AUTH_TYPE_FEDERATION = "workload-identity-federation"
+
+	// Predefined ACLs objects may get by default
+	ACL_AUTHENTICATED_READ        = "authenticatedRead"
+	ACL_BUCKET_OWNER_FULL_CONTROL = "bucketOwnerFullControl"
+	ACL_BUCKET_OWNER_READ         = "bucketOwnerRead"
+	ACL_PRIVATE                   = "private"
+	ACL_PROJECT_PRIVATE           = "projectPrivate"
+	ACL_PUBLIC_READ               = "publicRead"
+
+	READ_PATTERN_SEQUENTIAL = "sequential"
+	READ_PATTERN_RANDOM     = "random"
+
+	PREFETCH_DISABLED = "disabled"
+	PREFETCH_SYNC     = "sync"
+	PREFETCH_ASYNC    = "async"
+
+	// Placeholders of bucket name templates
+	TEMPLATE_PVC_NAME      = "${pvc.name}"
+	TEMPLATE_PVC_NAMESPACE = "${pvc.namespace}"
+	TEMPLATE_PV_NAME       = "${pv.name}"
+	TEMPLATE_RANDOM        = "${random}"
 )
 
 func IsFlag(flag string) bool {
@@ -97,6 +221,70 @@ func IsFlag(flag string) bool {
 		return true
 	case FLAG_MAX_RETRY_SLEEP:
 		return true
+	case FLAG_AUTH_TYPE:
+		return true
+	case FLAG_PROVISION_BUCKET:
+		return true
+	case FLAG_BUCKET_PREFIX:
+		return true
+	case FLAG_BUCKET_STORAGE_CLASS:
+		return true
+	case FLAG_UNIFORM_BUCKET_LEVEL_ACCESS:
+		return true
+	case FLAG_ONLY_DIR:
+		return true
+	case FLAG_MOUNT_TIMEOUT:
+		return true
+	case FLAG_CACHE_DIR:
+		return true
+	case FLAG_CACHE_MAX_SIZE_MB:
+		return true
+	case FLAG_BUCKET_LABELS:
+		return true
+	case FLAG_REMOUNT_ON_FAILURE:
+		return true
+	case FLAG_DEBUG:
+		return true
+	case FLAG_MAX_CONNS_PER_HOST:
+		return true
+	case FLAG_MAX_IDLE_CONNS_PER_HOST:
+		return true
+	case FLAG_LIFECYCLE_DELETE_AFTER_DAYS:
+		return true
+	case FLAG_RETENTION_PERIOD_DAYS:
+		return true
+	case FLAG_BUCKET_NAME_TEMPLATE:
+		return true
+	case FLAG_AUTH_FILE:
+		return true
+	case FLAG_STAT_CACHE_CAPACITY:
+		return true
+	case FLAG_ALLOW_NON_EMPTY_DELETE:
+		return true
+	case FLAG_SNAPSHOT_ID:
+		return true
+	case FLAG_SEQUENTIAL_READ_SIZE_MB:
+		return true
+	case FLAG_READ_PATTERN:
+		return true
+	case FLAG_DEFAULT_OBJECT_ACL:
+		return true
+	case FLAG_LOG_FILE:
+		return true
+	case FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB:
+		return true
+	case FLAG_LOG_ROTATE_BACKUPS:
+		return true
+	case FLAG_AUDIENCE:
+		return true
+	case FLAG_TOKEN_URL:
+		return true
+	case FLAG_SERVICE_ACCOUNT:
+		return true
+	case FLAG_KERNEL_LIST_CACHE_TTL:
+		return true
+	case FLAG_METADATA_PREFETCH_ON_MOUNT:
+		return true
 	}
 	return false
 }
@@ -135,6 +323,66 @@ func FlagNameFromAnnotation(annotation string) string {
 		return FLAG_TYPE_CACHE_TTL
 	case ANNOTATION_MAX_RETRY_SLEEP:
 		return FLAG_MAX_RETRY_SLEEP
+	case ANNOTATION_PROVISION_BUCKET:
+		return FLAG_PROVISION_BUCKET
+	case ANNOTATION_BUCKET_PREFIX:
+		return FLAG_BUCKET_PREFIX
+	case ANNOTATION_BUCKET_STORAGE_CLASS:
+		return FLAG_BUCKET_STORAGE_CLASS
+	case ANNOTATION_UNIFORM_BUCKET_LEVEL_ACCESS:
+		return FLAG_UNIFORM_BUCKET_LEVEL_ACCESS
+	case ANNOTATION_ONLY_DIR:
+		return FLAG_ONLY_DIR
+	case ANNOTATION_MOUNT_TIMEOUT:
+		return FLAG_MOUNT_TIMEOUT
+	case ANNOTATION_CACHE_DIR:
+		return FLAG_CACHE_DIR
+	case ANNOTATION_CACHE_MAX_SIZE_MB:
+		return FLAG_CACHE_MAX_SIZE_MB
+	case ANNOTATION_BUCKET_LABELS:
+		return FLAG_BUCKET_LABELS
+	case ANNOTATION_REMOUNT_ON_FAILURE:
+		return FLAG_REMOUNT_ON_FAILURE
+	case ANNOTATION_DEBUG:
+		return FLAG_DEBUG
+	case ANNOTATION_MAX_CONNS_PER_HOST:
+		return FLAG_MAX_CONNS_PER_HOST
+	case ANNOTATION_MAX_IDLE_CONNS_PER_HOST:
+		return FLAG_MAX_IDLE_CONNS_PER_HOST
+	case ANNOTATION_LIFECYCLE_DELETE_AFTER_DAYS:
+		return FLAG_LIFECYCLE_DELETE_AFTER_DAYS
+	case ANNOTATION_RETENTION_PERIOD_DAYS:
+		return FLAG_RETENTION_PERIOD_DAYS
+	case ANNOTATION_BUCKET_NAME_TEMPLATE:
+		return FLAG_BUCKET_NAME_TEMPLATE
+	case ANNOTATION_STAT_CACHE_CAPACITY:
+		return FLAG_STAT_CACHE_CAPACITY
+	case ANNOTATION_ALLOW_NON_EMPTY_DELETE:
+		return FLAG_ALLOW_NON_EMPTY_DELETE
+	case ANNOTATION_SNAPSHOT_ID:
+		return FLAG_SNAPSHOT_ID
+	case ANNOTATION_SEQUENTIAL_READ_SIZE_MB:
+		return FLAG_SEQUENTIAL_READ_SIZE_MB
+	case ANNOTATION_READ_PATTERN:
+		return FLAG_READ_PATTERN
+	case ANNOTATION_DEFAULT_OBJECT_ACL:
+		return FLAG_DEFAULT_OBJECT_ACL
+	case ANNOTATION_LOG_FILE:
+		return FLAG_LOG_FILE
+	case ANNOTATION_LOG_ROTATE_MAX_FILE_SIZE_MB:
+		return FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB
+	case ANNOTATION_LOG_ROTATE_BACKUPS:
+		return FLAG_LOG_ROTATE_BACKUPS
+	case ANNOTATION_AUDIENCE:
+		return FLAG_AUDIENCE
+	case ANNOTATION_TOKEN_URL:
+		return FLAG_TOKEN_URL
+	case ANNOTATION_SERVICE_ACCOUNT:
+		return FLAG_SERVICE_ACCOUNT
+	case ANNOTATION_KERNEL_LIST_CACHE_TTL:
+		return FLAG_KERNEL_LIST_CACHE_TTL
+	case ANNOTATION_METADATA_PREFETCH_ON_MOUNT:
+		return FLAG_METADATA_PREFETCH_ON_MOUNT
 	}
 	return ""
 }
@@ -181,6 +429,66 @@ func FlagNameFromMountOption(cmd string) string {
 		return FLAG_TYPE_CACHE_TTL
 	case MOUNT_OPTION_MAX_RETRY_SLEEP:
 		return FLAG_MAX_RETRY_SLEEP
+	case MOUNT_OPTION_PROVISION_BUCKET:
+		return FLAG_PROVISION_BUCKET
+	case MOUNT_OPTION_BUCKET_PREFIX:
+		return FLAG_BUCKET_PREFIX
+	case MOUNT_OPTION_BUCKET_STORAGE_CLASS:
+		return FLAG_BUCKET_STORAGE_CLASS
+	case MOUNT_OPTION_UNIFORM_BUCKET_LEVEL_ACCESS:
+		return FLAG_UNIFORM_BUCKET_LEVEL_ACCESS
+	case MOUNT_OPTION_ONLY_DIR:
+		return FLAG_ONLY_DIR
+	case MOUNT_OPTION_MOUNT_TIMEOUT:
+		return FLAG_MOUNT_TIMEOUT
+	case MOUNT_OPTION_CACHE_DIR:
+		return FLAG_CACHE_DIR
+	case MOUNT_OPTION_CACHE_MAX_SIZE_MB:
+		return FLAG_CACHE_MAX_SIZE_MB
+	case MOUNT_OPTION_BUCKET_LABELS:
+		return FLAG_BUCKET_LABELS
+	case MOUNT_OPTION_REMOUNT_ON_FAILURE:
+		return FLAG_REMOUNT_ON_FAILURE
+	case MOUNT_OPTION_DEBUG:
+		return FLAG_DEBUG
+	case MOUNT_OPTION_MAX_CONNS_PER_HOST:
+		return FLAG_MAX_CONNS_PER_HOST
+	case MOUNT_OPTION_MAX_IDLE_CONNS_PER_HOST:
+		return FLAG_MAX_IDLE_CONNS_PER_HOST
+	case MOUNT_OPTION_LIFECYCLE_DELETE_AFTER_DAYS:
+		return FLAG_LIFECYCLE_DELETE_AFTER_DAYS
+	case MOUNT_OPTION_RETENTION_PERIOD_DAYS:
+		return FLAG_RETENTION_PERIOD_DAYS
+	case MOUNT_OPTION_BUCKET_NAME_TEMPLATE:
+		return FLAG_BUCKET_NAME_TEMPLATE
+	case MOUNT_OPTION_STAT_CACHE_CAPACITY:
+		return FLAG_STAT_CACHE_CAPACITY
+	case MOUNT_OPTION_ALLOW_NON_EMPTY_DELETE:
+		return FLAG_ALLOW_NON_EMPTY_DELETE
+	case MOUNT_OPTION_SNAPSHOT_ID:
+		return FLAG_SNAPSHOT_ID
+	case MOUNT_OPTION_SEQUENTIAL_READ_SIZE_MB:
+		return FLAG_SEQUENTIAL_READ_SIZE_MB
+	case MOUNT_OPTION_READ_PATTERN:
+		return FLAG_READ_PATTERN
+	case MOUNT_OPTION_DEFAULT_OBJECT_ACL:
+		return FLAG_DEFAULT_OBJECT_ACL
+	case MOUNT_OPTION_LOG_FILE:
+		return FLAG_LOG_FILE
+	case MOUNT_OPTION_LOG_ROTATE_MAX_FILE_SIZE_MB:
+		return FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB
+	case MOUNT_OPTION_LOG_ROTATE_BACKUPS:
+		return FLAG_LOG_ROTATE_BACKUPS
+	case MOUNT_OPTION_AUDIENCE:
+		return FLAG_AUDIENCE
+	case MOUNT_OPTION_TOKEN_URL:
+		return FLAG_TOKEN_URL
+	case MOUNT_OPTION_SERVICE_ACCOUNT:
+		return FLAG_SERVICE_ACCOUNT
+	case MOUNT_OPTION_KERNEL_LIST_CACHE_TTL:
+		return FLAG_KERNEL_LIST_CACHE_TTL
+	case MOUNT_OPTION_METADATA_PREFETCH_ON_MOUNT:
+		return FLAG_METADATA_PREFETCH_ON_MOUNT
 	}
 	return ""
 }
@@ -259,24 +567,63 @@ func (i *octalInt) Set(value string) error {
 }
 
 func MergeMountOptions(a map[string]string, b []string) (result map[string]string) {
+	result, err := ParseMountOptions(a, b)
+	if err != nil {
+		klog.Warningf("%s", err)
+	}
+	return result
+}
+
+// Like MergeMountOptions but returns what it could not parse, options after it are ignored
+func ParseMountOptions(a map[string]string, b []string) (result map[string]string, err error) {
 	var (
-		args             = flag.NewFlagSet("csi-gcs", flag.ContinueOnError)
-		bucket           string
-		projectId        string
-		kmsKeyId         string
-		location         string
-		fuseMountOptions fuseMountOptions
-		dirMode          octalInt = -1
-		fileMode         octalInt = -1
-		uid              int64
-		gid              int64
-		implicitDirs     bool
-		billingProject   string
-		limitBytesPerSec int64
-		limitOpsPerSec   int64
-		statCacheTTL     string
-		typeCacheTTL     string
-		maxRetrySleepMin int64
+		args                     = flag.NewFlagSet("csi-gcs", flag.ContinueOnError)
+		bucket                   string
+		projectId                string
+		kmsKeyId                 string
+		location                 string
+		fuseMountOptions         fuseMountOptions
+		dirMode                  octalInt = -1
+		fileMode                 octalInt = -1
+		uid                      int64
+		gid                      int64
+		implicitDirs             bool
+		billingProject           string
+		limitBytesPerSec         int64
+		limitOpsPerSec           int64
+		statCacheTTL             string
+		typeCacheTTL             string
+		maxRetrySleepMin         int64
+		provisionBucket          string
+		bucketPrefix             string
+		bucketStorageClass       string
+		uniformBucketLevelAccess bool
+		onlyDir                  string
+		mountTimeout             string
+		cacheDir                 string
+		cacheMaxSizeMb           int64
+		bucketLabels             string
+		remountOnFailure         bool
+		debug                    bool
+		maxConnsPerHost          int64
+		maxIdleConnsPerHost      int64
+		lifecycleDeleteAfterDays int64
+		retentionPeriodDays      int64
+		bucketNameTemplate       string
+		statCacheCapacity        int64
+		allowNonEmptyDelete      bool
+		snapshotId               string
+		sequentialReadSizeMb     int64
+		readPattern              string
+		defaultObjectAcl         string
+		logFile                  bool
+		logRotateMaxFileSizeMb   int64
+		logRotateBackupFileCount int64
+		audience                 string
+		tokenUrl                 string
+		serviceAccount           string
+		kernelListCacheTTL       string
+		metadataPrefetchOnMount  string
 	)
 
 	args.StringVar(&bucket, MOUNT_OPTION_BUCKET, "", "Bucket Name")
@@ -295,10 +642,42 @@ func MergeMountOptions(a map[string]string, b []string) (result map[string]strin
 	args.StringVar(&statCacheTTL, MOUNT_OPTION_STAT_CACHE_TTL, "", "How long to cache StatObject results and inode attributes.")
 	args.StringVar(&typeCacheTTL, MOUNT_OPTION_TYPE_CACHE_TTL, "", "How long to cache name -> file/dir mappings in directory inodes.")
 	args.Int64Var(&maxRetrySleepMin, MOUNT_OPTION_MAX_RETRY_SLEEP, -1, "The maximum duration allowed to sleep in a retry loop with exponential backoff for failed requests to GCS backend. Once the backoff duration exceeds this limit, the retry stops. The default is 1 minute. A value of 0 disables retries.")
+	args.StringVar(&provisionBucket, MOUNT_OPTION_PROVISION_BUCKET, "", "Create the bucket if it does not exist. (default: true)")
+	args.StringVar(&bucketPrefix, MOUNT_OPTION_BUCKET_PREFIX, "", "Prefix of generated bucket names.")
+	args.StringVar(&bucketStorageClass, MOUNT_OPTION_BUCKET_STORAGE_CLASS, "", "Default storage class of created buckets.")
+	args.BoolVar(&uniformBucketLevelAccess, MOUNT_OPTION_UNIFORM_BUCKET_LEVEL_ACCESS, false, "Enable uniform bucket-level access on created buckets.")
+	args.StringVar(&onlyDir, MOUNT_OPTION_ONLY_DIR, "", "Only mount this directory of the bucket")
+	args.StringVar(&mountTimeout, MOUNT_OPTION_MOUNT_TIMEOUT, "", "How long mounting may take before it is aborted e.g. 1m.")
+	args.StringVar(&cacheDir, MOUNT_OPTION_CACHE_DIR, "", "Directory of the file cache relative to the cache root of the node.")
+	args.Int64Var(&cacheMaxSizeMb, MOUNT_OPTION_CACHE_MAX_SIZE_MB, -1, "Maximum size of the file cache in MiB, -1 means unlimited. (default: 1024)")
+	args.StringVar(&bucketLabels, MOUNT_OPTION_BUCKET_LABELS, "", "Labels of created buckets, in the format key=value,key=value.")
+	args.BoolVar(&remountOnFailure, MOUNT_OPTION_REMOUNT_ON_FAILURE, false, "Remount if gcsfuse exits while the volume is in use.")
+	args.BoolVar(&debug, MOUNT_OPTION_DEBUG, false, "Log every request of gcsfuse to the kernel and GCS.")
+	args.Int64Var(&maxConnsPerHost, MOUNT_OPTION_MAX_CONNS_PER_HOST, -1, "Maximum number of TCP connections to GCS, 0 means no limit.")
+	args.Int64Var(&maxIdleConnsPerHost, MOUNT_OPTION_MAX_IDLE_CONNS_PER_HOST, -1, "Maximum number of idle TCP connections to GCS kept open for reuse.")
+	args.Int64Var(&lifecycleDeleteAfterDays, MOUNT_OPTION_LIFECYCLE_DELETE_AFTER_DAYS, -1, "Delete objects of created buckets this many days after they were written.")
+	args.Int64Var(&retentionPeriodDays, MOUNT_OPTION_RETENTION_PERIOD_DAYS, -1, "Keep objects of created buckets from being deleted or overwritten for this many days.")
+	args.StringVar(&bucketNameTemplate, MOUNT_OPTION_BUCKET_NAME_TEMPLATE, "", "Template of generated bucket names")
+	args.Int64Var(&statCacheCapacity, MOUNT_OPTION_STAT_CACHE_CAPACITY, -1, "How many entries the stat cache holds.")
+	args.BoolVar(&allowNonEmptyDelete, MOUNT_OPTION_ALLOW_NON_EMPTY_DELETE, false, "Delete the objects of created buckets along with their volume.")
+	args.StringVar(&snapshotId, MOUNT_OPTION_SNAPSHOT_ID, "", "Mount this snapshot read-only instead of the bucket")
+	args.Int64Var(&sequentialReadSizeMb, MOUNT_OPTION_SEQUENTIAL_READ_SIZE_MB, -1, "How many MiB to read from GCS at once when reading sequentially.")
+	args.StringVar(&readPattern, MOUNT_OPTION_READ_PATTERN, "", "How files are mostly read, sequential or random.")
+	args.StringVar(&defaultObjectAcl, MOUNT_OPTION_DEFAULT_OBJECT_ACL, "", "Predefined ACL of objects written to created buckets.")
+	args.BoolVar(&logFile, MOUNT_OPTION_LOG_FILE, false, "Write the gcsfuse log of the volume to a file of its own on the node")
+	args.Int64Var(&logRotateMaxFileSizeMb, MOUNT_OPTION_LOG_ROTATE_MAX_FILE_SIZE_MB, -1, "Size in MiB at which the log file of the volume is rotated")
+	args.Int64Var(&logRotateBackupFileCount, MOUNT_OPTION_LOG_ROTATE_BACKUPS, -1, "Number of rotated log files of the volume to keep")
+	args.StringVar(&audience, MOUNT_OPTION_AUDIENCE, "", "Workload identity pool provider to exchange the token of the pod with")
+	args.StringVar(&tokenUrl, MOUNT_OPTION_TOKEN_URL, "", "Token endpoint of the Security Token Service")
+	args.StringVar(&serviceAccount, MOUNT_OPTION_SERVICE_ACCOUNT, "", "Google service account to impersonate")
+	args.StringVar(&kernelListCacheTTL, MOUNT_OPTION_KERNEL_LIST_CACHE_TTL, "", "How long the kernel caches directory listings in whole seconds")
+	args.StringVar(&metadataPrefetchOnMount, MOUNT_OPTION_METADATA_PREFETCH_ON_MOUNT, "", "Fill the metadata caches when mounting, disabled, sync or async")
 
-	err := args.Parse(b)
-	if err != nil {
-		klog.Warningf("%s", err)
+	// The error is returned instead
+	args.SetOutput(ioutil.Discard)
+	err = args.Parse(b)
+	if err == nil && args.NArg() > 0 {
+		err = fmt.Errorf("mount option %s does not start with --", args.Arg(0))
 	}
 
 	result = a
@@ -367,7 +746,130 @@ func MergeMountOptions(a map[string]string, b []string) (result map[string]strin
 		result[FLAG_MAX_RETRY_SLEEP] = strconv.FormatInt(maxRetrySleepMin, 10)
 	}
 
-	return result
+	if provisionBucket != "" {
+		result[FLAG_PROVISION_BUCKET] = provisionBucket
+	}
+
+	if bucketPrefix != "" {
+		result[FLAG_BUCKET_PREFIX] = bucketPrefix
+	}
+
+	if bucketStorageClass != "" {
+		result[FLAG_BUCKET_STORAGE_CLASS] = bucketStorageClass
+	}
+
+	if uniformBucketLevelAccess {
+		result[FLAG_UNIFORM_BUCKET_LEVEL_ACCESS] = "true"
+	}
+
+	if onlyDir != "" {
+		result[FLAG_ONLY_DIR] = onlyDir
+	}
+
+	if mountTimeout != "" {
+		result[FLAG_MOUNT_TIMEOUT] = mountTimeout
+	}
+
+	if cacheDir != "" {
+		result[FLAG_CACHE_DIR] = cacheDir
+	}
+
+	// -1 means unlimited, so only options that are absent are left unset
+	args.Visit(func(option *flag.Flag) {
+		if option.Name == MOUNT_OPTION_CACHE_MAX_SIZE_MB {
+			result[FLAG_CACHE_MAX_SIZE_MB] = strconv.FormatInt(cacheMaxSizeMb, 10)
+		}
+	})
+
+	if bucketLabels != "" {
+		result[FLAG_BUCKET_LABELS] = bucketLabels
+	}
+
+	if remountOnFailure {
+		result[FLAG_REMOUNT_ON_FAILURE] = "true"
+	}
+
+	if debug {
+		result[FLAG_DEBUG] = "true"
+	}
+
+	if maxConnsPerHost != -1 {
+		result[FLAG_MAX_CONNS_PER_HOST] = strconv.FormatInt(maxConnsPerHost, 10)
+	}
+
+	if maxIdleConnsPerHost != -1 {
+		result[FLAG_MAX_IDLE_CONNS_PER_HOST] = strconv.FormatInt(maxIdleConnsPerHost, 10)
+	}
+
+	if lifecycleDeleteAfterDays != -1 {
+		result[FLAG_LIFECYCLE_DELETE_AFTER_DAYS] = strconv.FormatInt(lifecycleDeleteAfterDays, 10)
+	}
+
+	if retentionPeriodDays != -1 {
+		result[FLAG_RETENTION_PERIOD_DAYS] = strconv.FormatInt(retentionPeriodDays, 10)
+	}
+
+	if bucketNameTemplate != "" {
+		result[FLAG_BUCKET_NAME_TEMPLATE] = bucketNameTemplate
+	}
+
+	if statCacheCapacity != -1 {
+		result[FLAG_STAT_CACHE_CAPACITY] = strconv.FormatInt(statCacheCapacity, 10)
+	}
+
+	if allowNonEmptyDelete {
+		result[FLAG_ALLOW_NON_EMPTY_DELETE] = "true"
+	}
+
+	if snapshotId != "" {
+		result[FLAG_SNAPSHOT_ID] = snapshotId
+	}
+
+	if sequentialReadSizeMb != -1 {
+		result[FLAG_SEQUENTIAL_READ_SIZE_MB] = strconv.FormatInt(sequentialReadSizeMb, 10)
+	}
+
+	if readPattern != "" {
+		result[FLAG_READ_PATTERN] = readPattern
+	}
+
+	if defaultObjectAcl != "" {
+		result[FLAG_DEFAULT_OBJECT_ACL] = defaultObjectAcl
+	}
+
+	if logFile {
+		result[FLAG_LOG_FILE] = "true"
+	}
+
+	if logRotateMaxFileSizeMb != -1 {
+		result[FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB] = strconv.FormatInt(logRotateMaxFileSizeMb, 10)
+	}
+
+	if logRotateBackupFileCount != -1 {
+		result[FLAG_LOG_ROTATE_BACKUPS] = strconv.FormatInt(logRotateBackupFileCount, 10)
+	}
+
+	if audience != "" {
+		result[FLAG_AUDIENCE] = audience
+	}
+
+	if tokenUrl != "" {
+		result[FLAG_TOKEN_URL] = tokenUrl
+	}
+
+	if serviceAccount != "" {
+		result[FLAG_SERVICE_ACCOUNT] = serviceAccount
+	}
+
+	if kernelListCacheTTL != "" {
+		result[FLAG_KERNEL_LIST_CACHE_TTL] = kernelListCacheTTL
+	}
+
+	if metadataPrefetchOnMount != "" {
+		result[FLAG_METADATA_PREFETCH_ON_MOUNT] = metadataPrefetchOnMount
+	}
+
+	return result, err
 }
 
 func FlagNameToGcsfuseOption(flag string) string {
@@ -394,6 +896,18 @@ func FlagNameToGcsfuseOption(flag string) string {
 		return "type_cache_ttl"
 	case FLAG_MAX_RETRY_SLEEP:
 		return "max_retry_sleep"
+	case FLAG_ONLY_DIR:
+		return "only_dir"
+	case FLAG_MAX_CONNS_PER_HOST:
+		return "max_conns_per_host"
+	case FLAG_MAX_IDLE_CONNS_PER_HOST:
+		return "max_idle_conns_per_host"
+	case FLAG_STAT_CACHE_CAPACITY:
+		return "stat_cache_capacity"
+	case FLAG_SEQUENTIAL_READ_SIZE_MB:
+		return "sequential_read_size_mb"
+	case FLAG_METADATA_PREFETCH_ON_MOUNT:
+		return "experimental_metadata_prefetch_on_mount"
 	}
 	return ""
 }
@@ -410,13 +924,24 @@ func MaybeAddFlag(result []string, flags map[string]string, name string) []strin
 func MaybeAddBooleanFlag(result []string, flags map[string]string, name string) []string {
 	argName := FlagNameToGcsfuseOption(name)
 
-	value, found := flags[name]
-	if found && value == "true" {
+	if IsTrue(flags, name) {
 		result = append(result, argName)
 	}
 	return result
 }
 
+// Whether a boolean flag is true in any of the spellings validation accepts e.g. "True" or "1"
+func IsTrue(flags map[string]string, name string) bool {
+	value, _ := strconv.ParseBool(flags[name])
+	return value
+}
+
+// Whether a boolean flag is set to false, as opposed to unset for flags that default to true
+func IsFalse(flags map[string]string, name string) bool {
+	value, err := strconv.ParseBool(flags[name])
+	return err == nil && !value
+}
+
 func MaybeAddDirectFlag(result []string, flags map[string]string, name string) []string {
 	value, found := flags[name]
 	if found {
@@ -425,6 +950,33 @@ func MaybeAddDirectFlag(result []string, flags map[string]string, name string) [
 	return result
 }
 
+// Sequential read sizes in MiB that read patterns stand for. Large reads suit big files read from start to end, while
+// small ones keep random reads that look sequential for a while from fetching data that is never used.
+var readPatternSequentialReadSizes = map[string]string{
+	READ_PATTERN_SEQUENTIAL: "1024",
+	READ_PATTERN_RANDOM:     "1",
+}
+
+// A sequential read size that is set wins over the one of the read pattern
+func maybeAddSequentialReadSize(result []string, flags map[string]string) []string {
+	if _, found := flags[FLAG_SEQUENTIAL_READ_SIZE_MB]; found {
+		return MaybeAddFlag(result, flags, FLAG_SEQUENTIAL_READ_SIZE_MB)
+	}
+	if size, found := readPatternSequentialReadSizes[flags[FLAG_READ_PATTERN]]; found {
+		return append(result, FlagNameToGcsfuseOption(FLAG_SEQUENTIAL_READ_SIZE_MB)+"="+size)
+	}
+	return result
+}
+
+// gcsfuse takes the TTL in seconds, validated to be whole
+func maybeAddKernelListCacheTTL(result []string, flags map[string]string) []string {
+	ttl, err := time.ParseDuration(flags[FLAG_KERNEL_LIST_CACHE_TTL])
+	if err != nil {
+		return result
+	}
+	return append(result, fmt.Sprintf("kernel_list_cache_ttl_secs=%d", int64(ttl/time.Second)))
+}
+
 func ExtraFlags(flags map[string]string) (result []string) {
 	result = []string{}
 
@@ -434,11 +986,469 @@ func ExtraFlags(flags map[string]string) (result []string) {
 	result = MaybeAddFlag(result, flags, FLAG_UID)
 	result = MaybeAddFlag(result, flags, FLAG_GID)
 	result = MaybeAddBooleanFlag(result, flags, FLAG_IMPLICIT_DIRS)
+	result = MaybeAddFlag(result, flags, FLAG_BILLING_PROJECT)
 	result = MaybeAddFlag(result, flags, FLAG_LIMIT_BYTES_PER_SEC)
 	result = MaybeAddFlag(result, flags, FLAG_LIMIT_OPS_PER_SEC)
 	result = MaybeAddFlag(result, flags, FLAG_STAT_CACHE_TTL)
 	result = MaybeAddFlag(result, flags, FLAG_TYPE_CACHE_TTL)
+	result = MaybeAddFlag(result, flags, FLAG_STAT_CACHE_CAPACITY)
+	result = maybeAddSequentialReadSize(result, flags)
+	result = maybeAddKernelListCacheTTL(result, flags)
+	result = MaybeAddFlag(result, flags, FLAG_METADATA_PREFETCH_ON_MOUNT)
 	result = MaybeAddFlag(result, flags, FLAG_MAX_RETRY_SLEEP)
+	result = MaybeAddFlag(result, flags, FLAG_ONLY_DIR)
+	result = MaybeAddFlag(result, flags, FLAG_MAX_CONNS_PER_HOST)
+	result = MaybeAddFlag(result, flags, FLAG_MAX_IDLE_CONNS_PER_HOST)
+
+	if IsTrue(flags, FLAG_DEBUG) {
+		result = append(result, "debug_fuse", "debug_gcs")
+	}
 
 	return result
 }
+
+// Generic mount options of FUSE and the kernel. gcsfuse takes its own flags as mount options too, spelled with dashes
+// or underscores, which must go through the flags of the driver so they are validated and can't point at host paths.
+var allowedFuseMountOptions = map[string]bool{
+	"ro":                  true,
+	"rw":                  true,
+	"exec":                true,
+	"noexec":              true,
+	"suid":                true,
+	"nosuid":              true,
+	"dev":                 true,
+	"nodev":               true,
+	"sync":                true,
+	"async":               true,
+	"dirsync":             true,
+	"atime":               true,
+	"noatime":             true,
+	"nodiratime":          true,
+	"relatime":            true,
+	"strictatime":         true,
+	"allow_other":         true,
+	"default_permissions": true,
+	"max_read":            true,
+	"fsname":              true,
+	"subtype":             true,
+}
+
+func validateInt(flags map[string]string, name string, min int64) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < min {
+		return fmt.Errorf("%s must be an integer greater than or equal to %d, got: %s", name, min, value)
+	}
+	return nil
+}
+
+func validateOctal(flags map[string]string, name string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 8, 64)
+	if err != nil || parsed < 0 || parsed > 0777 {
+		return fmt.Errorf("%s must be an octal permission between 0000 and 0777, got: %s", name, value)
+	}
+	return nil
+}
+
+// Prevents escaping the directory the path is relative to e.g. the root of the bucket
+func validateRelativePath(flags map[string]string, name string, within string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	if value == "" || strings.HasPrefix(value, "/") {
+		return fmt.Errorf("%s must be a relative path within %s, got: %s", name, within, value)
+	}
+	for _, part := range strings.Split(value, "/") {
+		if part == ".." {
+			return fmt.Errorf("%s must not contain '..', got: %s", name, value)
+		}
+	}
+	return nil
+}
+
+// Buckets named after a domain may contain dots, every part following the rules of other names
+var bucketNamePartPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]{0,61}[a-z0-9])?$`)
+
+// Existing buckets may be domain-named unlike the ones the driver names
+func validateBucket(flags map[string]string) error {
+	value, found := flags[FLAG_BUCKET]
+	if !found {
+		return nil
+	}
+	if !strings.Contains(value, ".") {
+		if err := ValidateBucketName(value); err != nil {
+			return fmt.Errorf("%s %v", FLAG_BUCKET, err)
+		}
+		return nil
+	}
+
+	if len(value) > 222 || strings.HasPrefix(value, "goog") || strings.Contains(value, "google") {
+		return fmt.Errorf("%s must be at most 222 characters and may neither start with goog nor contain google, got: %s", FLAG_BUCKET, value)
+	}
+	for _, part := range strings.Split(value, ".") {
+		if !bucketNamePartPattern.MatchString(part) {
+			return fmt.Errorf("%s must be dot-separated parts of 1 to 63 lowercase letters, digits, dashes or underscores, starting and ending with a letter or digit, got: %s", FLAG_BUCKET, value)
+		}
+	}
+	return nil
+}
+
+// Snapshots made by the driver are identified by <snapshot bucket>/<name>
+func validateSnapshotId(flags map[string]string) error {
+	value, found := flags[FLAG_SNAPSHOT_ID]
+	if !found {
+		return nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || ValidateBucketName(parts[0]) != nil || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return fmt.Errorf("%s must be the ID of a snapshot made by the driver e.g. my-snapshots/snapshot-1234, got: %s", FLAG_SNAPSHOT_ID, value)
+	}
+	return nil
+}
+
+// The pool provider is required to exchange the token, the other settings make no sense without it
+func validateFederation(flags map[string]string) error {
+	if flags[FLAG_AUTH_TYPE] != AUTH_TYPE_FEDERATION {
+		for _, name := range []string{FLAG_AUDIENCE, FLAG_TOKEN_URL, FLAG_SERVICE_ACCOUNT} {
+			if _, found := flags[name]; found {
+				return fmt.Errorf("%s needs %s %s", name, FLAG_AUTH_TYPE, AUTH_TYPE_FEDERATION)
+			}
+		}
+		return nil
+	}
+
+	if flags[FLAG_AUDIENCE] == "" {
+		return fmt.Errorf("%s %s needs %s", FLAG_AUTH_TYPE, AUTH_TYPE_FEDERATION, FLAG_AUDIENCE)
+	}
+	if err := validatePattern(flags, FLAG_AUDIENCE, audiencePattern, "//iam.googleapis.com/projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER"); err != nil {
+		return err
+	}
+	if err := validatePattern(flags, FLAG_SERVICE_ACCOUNT, serviceAccountPattern, "of a service account e.g. csi-gcs@my-project.iam.gserviceaccount.com"); err != nil {
+		return err
+	}
+
+	if tokenUrl, found := flags[FLAG_TOKEN_URL]; found {
+		u, err := url.Parse(tokenUrl)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s must be an https URL, got: %s", FLAG_TOKEN_URL, tokenUrl)
+		}
+	}
+	return nil
+}
+
+func validateBool(flags map[string]string, name string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%s must be a boolean, got: %s", name, value)
+	}
+	return nil
+}
+
+func validateDuration(flags map[string]string, name string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	if duration, err := time.ParseDuration(value); err != nil || duration < 0 {
+		return fmt.Errorf("%s must be a duration e.g. 1h, got: %s", name, value)
+	}
+	return nil
+}
+
+func validateChoice(flags map[string]string, name string, choices ...string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	for _, choice := range choices {
+		if value == choice {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of: %s, got: %s", name, strings.Join(choices, ", "), value)
+}
+
+// Optionally prefixed by the domain of domain-scoped projects
+var projectIdPattern = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+
+var audiencePattern = regexp.MustCompile(`^//iam\.googleapis\.com/projects/[0-9]+/locations/global/workloadIdentityPools/[a-z0-9-]+/providers/[a-z0-9-]+$`)
+
+var serviceAccountPattern = regexp.MustCompile(`^[a-z0-9-]+@[a-z0-9.-]+\.gserviceaccount\.com$`)
+
+var kmsKeyIdPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// Empty values are allowed as they mean the default
+func validatePattern(flags map[string]string, name string, pattern *regexp.Regexp, format string) error {
+	value, found := flags[name]
+	if !found || value == "" {
+		return nil
+	}
+
+	if !pattern.MatchString(value) {
+		return fmt.Errorf("%s must have the format %s, got: %s", name, format, value)
+	}
+	return nil
+}
+
+// Keys must start with a letter, values may be empty
+var labelKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+var labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+
+// Parses comma-separated key=value pairs and checks them against the constraints GCS has for labels
+func ParseLabels(value string) (labels map[string]string, err error) {
+	labels = map[string]string{}
+	if value == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("label must have the format key=value, got: %s", pair)
+		}
+
+		key, labelValue := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !labelKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("label key must start with a lowercase letter followed by at most 62 lowercase letters, digits, '_' or '-', got: %s", key)
+		}
+		if !labelValuePattern.MatchString(labelValue) {
+			return nil, fmt.Errorf("label value must be at most 63 lowercase letters, digits, '_' or '-', got: %s", labelValue)
+		}
+		labels[key] = labelValue
+	}
+
+	// One is reserved for marking buckets as managed
+	if len(labels) > 63 {
+		return nil, fmt.Errorf("at most 63 labels are allowed, got: %d", len(labels))
+	}
+	return labels, nil
+}
+
+func validateLabels(flags map[string]string, name string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	if _, err := ParseLabels(value); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// Names that need no domain verification, i.e. without dots
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,61}[a-z0-9]$`)
+
+// Checks a bucket name against the naming rules of GCS
+func ValidateBucketName(name string) error {
+	if !bucketNamePattern.MatchString(name) {
+		return fmt.Errorf("bucket name must be 3 to 63 lowercase letters, digits, dashes or underscores, starting and ending with a letter or digit, got: %s", name)
+	}
+	if strings.HasPrefix(name, "goog") || strings.Contains(name, "google") {
+		return fmt.Errorf("bucket name may neither start with goog nor contain google, got: %s", name)
+	}
+	return nil
+}
+
+var templatePlaceholderPattern = regexp.MustCompile(`\$\{[^}]*\}`)
+
+// Placeholders expand to lowercase letters, digits and dashes, so the rest of the template must not break the name
+var templateLiteralPattern = regexp.MustCompile(`^[a-z0-9-]*$`)
+
+func validateBucketNameTemplate(flags map[string]string, name string) error {
+	value, found := flags[name]
+	if !found {
+		return nil
+	}
+
+	placeholders := templatePlaceholderPattern.FindAllString(value, -1)
+	if len(placeholders) == 0 {
+		return fmt.Errorf("%s must contain at least one of %s, %s, %s or %s, got: %s", name, TEMPLATE_PVC_NAME, TEMPLATE_PVC_NAMESPACE, TEMPLATE_PV_NAME, TEMPLATE_RANDOM, value)
+	}
+	for _, placeholder := range placeholders {
+		switch placeholder {
+		case TEMPLATE_PVC_NAME, TEMPLATE_PVC_NAMESPACE, TEMPLATE_PV_NAME, TEMPLATE_RANDOM:
+		default:
+			return fmt.Errorf("%s has the unknown placeholder %s", name, placeholder)
+		}
+	}
+
+	literal := templatePlaceholderPattern.ReplaceAllString(value, "")
+	if !templateLiteralPattern.MatchString(literal) {
+		return fmt.Errorf("%s may only contain lowercase letters, digits and dashes besides placeholders, got: %s", name, value)
+	}
+	// Every placeholder expands to at least one character
+	if len(literal)+len(placeholders) > 63 {
+		return fmt.Errorf("%s always produces bucket names longer than 63 characters, got: %s", name, value)
+	}
+	if strings.HasPrefix(value, "-") || strings.HasSuffix(value, "-") || strings.HasPrefix(value, "goog") || strings.Contains(literal, "google") {
+		return fmt.Errorf("%s always produces invalid bucket names, got: %s", name, value)
+	}
+	return nil
+}
+
+func validateFuseMountOptions(flags map[string]string) error {
+	value, found := flags[FLAG_FUSE_MOUNT_OPTION]
+	if !found {
+		return nil
+	}
+
+	for _, option := range strings.Split(value, ",") {
+		name := strings.SplitN(option, "=", 2)[0]
+		if !allowedFuseMountOptions[strings.ReplaceAll(name, "-", "_")] {
+			return fmt.Errorf("%s may not contain the option: %s", FLAG_FUSE_MOUNT_OPTION, name)
+		}
+	}
+	return nil
+}
+
+func ValidateFlags(flags map[string]string) (err error) {
+	for _, name := range []string{FLAG_DIR_MODE, FLAG_FILE_MODE} {
+		if err = validateOctal(flags, name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{FLAG_UID, FLAG_GID, FLAG_LIMIT_BYTES_PER_SEC, FLAG_LIMIT_OPS_PER_SEC, FLAG_CACHE_MAX_SIZE_MB} {
+		if err = validateInt(flags, name, -1); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{FLAG_MAX_CONNS_PER_HOST, FLAG_MAX_IDLE_CONNS_PER_HOST, FLAG_STAT_CACHE_CAPACITY} {
+		if err = validateInt(flags, name, 0); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{FLAG_LIFECYCLE_DELETE_AFTER_DAYS, FLAG_RETENTION_PERIOD_DAYS} {
+		if err = validateInt(flags, name, 1); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{FLAG_IMPLICIT_DIRS, FLAG_PROVISION_BUCKET, FLAG_UNIFORM_BUCKET_LEVEL_ACCESS, FLAG_REMOUNT_ON_FAILURE, FLAG_DEBUG, FLAG_ALLOW_NON_EMPTY_DELETE, FLAG_LOG_FILE} {
+		if err = validateBool(flags, name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{FLAG_STAT_CACHE_TTL, FLAG_TYPE_CACHE_TTL, FLAG_MOUNT_TIMEOUT} {
+		if err = validateDuration(flags, name); err != nil {
+			return err
+		}
+	}
+
+	if err = validateChoice(flags, FLAG_AUTH_TYPE, AUTH_TYPE_KEY, AUTH_TYPE_WORKLOAD_IDENTITY, AUTH_TYPE_NONE, AUTH_TYPE_FEDERATION); err != nil {
+		return err
+	}
+
+	if err = validateChoice(flags, FLAG_DEFAULT_OBJECT_ACL, ACL_AUTHENTICATED_READ, ACL_BUCKET_OWNER_FULL_CONTROL, ACL_BUCKET_OWNER_READ, ACL_PRIVATE, ACL_PROJECT_PRIVATE, ACL_PUBLIC_READ); err != nil {
+		return err
+	}
+
+	// Uniform bucket-level access turns ACLs off
+	if _, found := flags[FLAG_DEFAULT_OBJECT_ACL]; found && IsTrue(flags, FLAG_UNIFORM_BUCKET_LEVEL_ACCESS) {
+		return fmt.Errorf("%s needs %s to be false", FLAG_DEFAULT_OBJECT_ACL, FLAG_UNIFORM_BUCKET_LEVEL_ACCESS)
+	}
+
+	if err = validateChoice(flags, FLAG_READ_PATTERN, READ_PATTERN_SEQUENTIAL, READ_PATTERN_RANDOM); err != nil {
+		return err
+	}
+
+	if err = validateChoice(flags, FLAG_METADATA_PREFETCH_ON_MOUNT, PREFETCH_DISABLED, PREFETCH_SYNC, PREFETCH_ASYNC); err != nil {
+		return err
+	}
+
+	if err = validateDuration(flags, FLAG_KERNEL_LIST_CACHE_TTL); err != nil {
+		return err
+	}
+	if ttl, _ := time.ParseDuration(flags[FLAG_KERNEL_LIST_CACHE_TTL]); ttl%time.Second != 0 {
+		return fmt.Errorf("%s must be whole seconds, got: %s", FLAG_KERNEL_LIST_CACHE_TTL, flags[FLAG_KERNEL_LIST_CACHE_TTL])
+	}
+
+	// gcsfuse refuses anything larger
+	if err = validateInt(flags, FLAG_SEQUENTIAL_READ_SIZE_MB, 1); err != nil {
+		return err
+	}
+	if size, _ := strconv.ParseInt(flags[FLAG_SEQUENTIAL_READ_SIZE_MB], 10, 64); size > 1024 {
+		return fmt.Errorf("%s must be at most 1024, got: %d", FLAG_SEQUENTIAL_READ_SIZE_MB, size)
+	}
+
+	if err = validateInt(flags, FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB, 1); err != nil {
+		return err
+	}
+	if err = validateInt(flags, FLAG_LOG_ROTATE_BACKUPS, 0); err != nil {
+		return err
+	}
+	for _, name := range []string{FLAG_LOG_ROTATE_MAX_FILE_SIZE_MB, FLAG_LOG_ROTATE_BACKUPS} {
+		if _, found := flags[name]; found && !IsTrue(flags, FLAG_LOG_FILE) {
+			return fmt.Errorf("%s needs %s to be true", name, FLAG_LOG_FILE)
+		}
+	}
+
+	for _, name := range []string{FLAG_PROJECT_ID, FLAG_BILLING_PROJECT} {
+		if err = validatePattern(flags, name, projectIdPattern, "of a project ID e.g. my-project"); err != nil {
+			return err
+		}
+	}
+
+	if err = validatePattern(flags, FLAG_KMS_KEY_ID, kmsKeyIdPattern, "projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY"); err != nil {
+		return err
+	}
+
+	if err = validateBucket(flags); err != nil {
+		return err
+	}
+
+	if err = validateSnapshotId(flags); err != nil {
+		return err
+	}
+
+	if err = validateRelativePath(flags, FLAG_ONLY_DIR, "the bucket"); err != nil {
+		return err
+	}
+
+	if err = validateRelativePath(flags, FLAG_CACHE_DIR, "the cache root"); err != nil {
+		return err
+	}
+
+	if err = validateRelativePath(flags, FLAG_AUTH_FILE, "the auth file root"); err != nil {
+		return err
+	}
+	if _, found := flags[FLAG_AUTH_FILE]; found && flags[FLAG_AUTH_TYPE] != "" && flags[FLAG_AUTH_TYPE] != AUTH_TYPE_KEY {
+		return fmt.Errorf("%s needs %s %s, got: %s", FLAG_AUTH_FILE, FLAG_AUTH_TYPE, AUTH_TYPE_KEY, flags[FLAG_AUTH_TYPE])
+	}
+
+	if err = validateFederation(flags); err != nil {
+		return err
+	}
+
+	if err = validateLabels(flags, FLAG_BUCKET_LABELS); err != nil {
+		return err
+	}
+
+	if err = validateBucketNameTemplate(flags, FLAG_BUCKET_NAME_TEMPLATE); err != nil {
+		return err
+	}
+
+	return validateFuseMountOptions(flags)
+}
@@ -1,6 +1,8 @@
 package flags_test
 
 import (
+	"strings"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -79,6 +81,26 @@ var _ = Describe("Flags", func() {
 			}))
 		})
 	})
+	Describe("ParseMountOptions", func() {
+		It("Should Reject Unknown Options", func() {
+			_, err := ParseMountOptions(map[string]string{}, []string{"--implicit-dirs", "--implicit-dir"})
+			Expect(err).To(MatchError(ContainSubstring("implicit-dir")))
+		})
+		It("Should Reject Options Without Dashes", func() {
+			options, err := ParseMountOptions(map[string]string{}, []string{"--gid=1000", "implicit-dirs"})
+			Expect(err).To(MatchError(ContainSubstring("implicit-dirs")))
+			Expect(options).To(Equal(map[string]string{"gid": "1000"}))
+		})
+		It("Should Keep An Unlimited Cache Size", func() {
+			options, err := ParseMountOptions(map[string]string{}, []string{"--cache-max-size-mb=-1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).To(Equal(map[string]string{"cacheMaxSizeMb": "-1"}))
+
+			options, err = ParseMountOptions(map[string]string{}, []string{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(options).NotTo(HaveKey("cacheMaxSizeMb"))
+		})
+	})
 	Describe("ExtraFlags", func() {
 		It("Should Merge", func() {
 			Expect(
@@ -93,5 +115,236 @@ var _ = Describe("Flags", func() {
 				),
 			).To(Equal([]string{"foo", "bar", "baz", "dir_mode=0600", "implicit_dirs"}))
 		})
+		It("Should Turn Implicit Directories On And Off", func() {
+			for _, value := range []string{"true", "True", "1"} {
+				Expect(ExtraFlags(map[string]string{"implicitDirs": value})).To(Equal([]string{"implicit_dirs"}), value)
+			}
+			for _, value := range []string{"false", "False", "0"} {
+				Expect(ExtraFlags(map[string]string{"implicitDirs": value})).To(BeEmpty(), value)
+			}
+			Expect(ExtraFlags(map[string]string{})).To(BeEmpty())
+		})
+		It("Should Only Debug When Asked To", func() {
+			Expect(ExtraFlags(map[string]string{"debug": "true"})).To(Equal([]string{"debug_fuse", "debug_gcs"}))
+			Expect(ExtraFlags(map[string]string{"debug": "True"})).To(Equal([]string{"debug_fuse", "debug_gcs"}))
+			Expect(ExtraFlags(map[string]string{"debug": "false"})).To(BeEmpty())
+			Expect(ExtraFlags(map[string]string{})).To(BeEmpty())
+		})
+		It("Should Size The Connection Pool", func() {
+			Expect(ExtraFlags(map[string]string{"maxConnsPerHost": "200", "maxIdleConnsPerHost": "50"})).To(Equal([]string{"max_conns_per_host=200", "max_idle_conns_per_host=50"}))
+			Expect(MergeMountOptions(map[string]string{}, []string{"--max-conns-per-host=200", "--max-idle-conns-per-host=50"})).To(Equal(map[string]string{"maxConnsPerHost": "200", "maxIdleConnsPerHost": "50"}))
+		})
+		It("Should Pass Fresh Metadata Caches", func() {
+			options := MergeMountOptions(map[string]string{}, []string{"--stat-cache-ttl=0s", "--type-cache-ttl=0s", "--stat-cache-capacity=0"})
+			Expect(ValidateFlags(options)).To(Succeed())
+			Expect(ExtraFlags(options)).To(Equal([]string{"stat_cache_ttl=0s", "type_cache_ttl=0s", "stat_cache_capacity=0"}))
+		})
+		It("Should Pass Lasting Metadata Caches", func() {
+			options := map[string]string{"statCacheTTL": "1h", "typeCacheTTL": "1h", "statCacheCapacity": "65536"}
+			Expect(ValidateFlags(options)).To(Succeed())
+			Expect(ExtraFlags(options)).To(Equal([]string{"stat_cache_ttl=1h", "type_cache_ttl=1h", "stat_cache_capacity=65536"}))
+		})
+		It("Should Expand Read Patterns", func() {
+			Expect(ExtraFlags(map[string]string{"readPattern": "sequential"})).To(Equal([]string{"sequential_read_size_mb=1024"}))
+			Expect(ExtraFlags(map[string]string{"readPattern": "random"})).To(Equal([]string{"sequential_read_size_mb=1"}))
+			Expect(ExtraFlags(map[string]string{})).To(BeEmpty())
+		})
+		It("Should Pass Directory Listing Options", func() {
+			options := MergeMountOptions(map[string]string{}, []string{"--kernel-list-cache-ttl=1m", "--metadata-prefetch-on-mount=async"})
+			Expect(ValidateFlags(options)).To(Succeed())
+			Expect(ExtraFlags(options)).To(Equal([]string{"kernel_list_cache_ttl_secs=60", "experimental_metadata_prefetch_on_mount=async"}))
+			Expect(ExtraFlags(map[string]string{"kernelListCacheTTL": "0s"})).To(Equal([]string{"kernel_list_cache_ttl_secs=0"}))
+			Expect(ExtraFlags(map[string]string{"bucket": "test"})).To(BeEmpty())
+		})
+		It("Should Prefer A Set Sequential Read Size", func() {
+			options := MergeMountOptions(map[string]string{}, []string{"--read-pattern=sequential", "--sequential-read-size-mb=512"})
+			Expect(ValidateFlags(options)).To(Succeed())
+			Expect(ExtraFlags(options)).To(Equal([]string{"sequential_read_size_mb=512"}))
+			Expect(ExtraFlags(map[string]string{"sequentialReadSizeMb": "8"})).To(Equal([]string{"sequential_read_size_mb=8"}))
+		})
+	})
+	Describe("ValidateFlags", func() {
+		It("Should Accept Valid Flags", func() {
+			Expect(
+				ValidateFlags(
+					map[string]string{
+						"bucket":           "test",
+						"dirMode":          "0775",
+						"fileMode":         "0664",
+						"uid":              "-1",
+						"gid":              "63147",
+						"implicitDirs":     "true",
+						"statCacheTTL":     "1h",
+						"fuseMountOptions": "noatime,max_read=131072",
+						"maxConnsPerHost":  "0",
+					},
+				),
+			).To(Succeed())
+		})
+		It("Should Reject Invalid Values", func() {
+			Expect(ValidateFlags(map[string]string{"dirMode": "0999"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fileMode": "01777"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"gid": "foo"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"uid": "-2"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"implicitDirs": "yes"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"debug": "on"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"typeCacheTTL": "10"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"statCacheTTL": "-1m"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"statCacheCapacity": "-1"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"statCacheCapacity": "lots"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"mountTimeout": "soon"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"maxConnsPerHost": "-1"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"maxIdleConnsPerHost": "many"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"readPattern": "mixed"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"sequentialReadSizeMb": "0"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"sequentialReadSizeMb": "2048"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"sequentialReadSizeMb": "1GB"})).NotTo(Succeed())
+		})
+		It("Should Validate Bucket Names", func() {
+			Expect(ValidateFlags(map[string]string{"bucket": "my_bucket-1"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "data.example.com"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "My-Bucket"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "ab"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "gs://my-bucket"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "data..example.com"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucket": "data.google.com"})).NotTo(Succeed())
+		})
+		It("Should Validate Default Object ACLs", func() {
+			for _, acl := range []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"} {
+				Expect(ValidateFlags(map[string]string{"defaultObjectAcl": acl})).To(Succeed(), acl)
+			}
+			Expect(ValidateFlags(map[string]string{"defaultObjectAcl": "bucket-owner-full-control"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"defaultObjectAcl": "publicReadWrite"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"defaultObjectAcl": "private", "uniformBucketLevelAccess": "true"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"defaultObjectAcl": "private", "uniformBucketLevelAccess": "false"})).To(Succeed())
+		})
+		It("Should Validate Log Rotation", func() {
+			Expect(ValidateFlags(map[string]string{"logFile": "true", "logRotateMaxFileSizeMb": "1", "logRotateBackupFileCount": "0"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"logFile": "yes"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"logFile": "true", "logRotateMaxFileSizeMb": "0"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"logFile": "true", "logRotateBackupFileCount": "-1"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"logRotateMaxFileSizeMb": "10"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"logFile": "false", "logRotateBackupFileCount": "5"})).NotTo(Succeed())
+		})
+		It("Should Validate Directory Listing Options", func() {
+			Expect(ValidateFlags(map[string]string{"kernelListCacheTTL": "1h", "metadataPrefetchOnMount": "sync"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"kernelListCacheTTL": "1500ms"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"kernelListCacheTTL": "-1s"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"kernelListCacheTTL": "60"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"metadataPrefetchOnMount": "true"})).NotTo(Succeed())
+		})
+		It("Should Validate Workload Identity Federation", func() {
+			audience := "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/eks"
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation", "audience": audience})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation", "audience": audience, "tokenUrl": "https://sts.example.com/v1/token", "serviceAccount": "csi-gcs@my-project.iam.gserviceaccount.com"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation", "audience": "sts.googleapis.com"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation", "audience": audience, "tokenUrl": "http://sts.example.com/v1/token"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity-federation", "audience": audience, "serviceAccount": "csi-gcs"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "key", "audience": audience})).NotTo(Succeed())
+		})
+		It("Should Validate Auth Type", func() {
+			Expect(ValidateFlags(map[string]string{"authType": "key"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "workload-identity"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "none"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authType": "magic"})).NotTo(Succeed())
+		})
+		It("Should Reject Unsafe Fuse Mount Options", func() {
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "foo,key_file=/etc/key.json"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "temp_dir=/"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "only_dir=../other"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "key-file=/etc/key.json"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "config-file=/etc/gcsfuse.yaml"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "config_file=/etc/gcsfuse.yaml"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "allow-other,nodev"})).To(Succeed())
+		})
+		It("Should Validate Project IDs", func() {
+			Expect(ValidateFlags(map[string]string{"projectId": "csi-gcs"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"projectId": "example.com:csi-gcs"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"projectId": "CSI-GCS"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"projectId": "gcs"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"projectId": "csi-gcs-"})).NotTo(Succeed())
+		})
+		It("Should Validate Billing Projects", func() {
+			Expect(ValidateFlags(map[string]string{"billingProject": "csi-gcs"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"billingProject": "csi gcs"})).NotTo(Succeed())
+		})
+		It("Should Validate KMS Key IDs", func() {
+			Expect(ValidateFlags(map[string]string{"kmsKeyId": ""})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"kmsKeyId": "projects/test/locations/us/keyRings/ring/cryptoKeys/key"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"kmsKeyId": "key"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"kmsKeyId": "projects/test/locations/us/keyRings/ring"})).NotTo(Succeed())
+		})
+		It("Should Not Allow Escaping The Only Dir", func() {
+			Expect(ValidateFlags(map[string]string{"onlyDir": "team-a"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"onlyDir": "team-a/data..old"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"onlyDir": "/team-a"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"onlyDir": "team-a/../team-b"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"onlyDir": ".."})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"onlyDir": ""})).NotTo(Succeed())
+		})
+		It("Should Validate Bucket Labels", func() {
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "team=a, cost-center=42,empty="})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "Team=a"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "team=A"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "42=a"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "team"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketLabels": "team=" + strings.Repeat("a", 64)})).NotTo(Succeed())
+		})
+		It("Should Keep Auth Files Within The Auth File Root", func() {
+			Expect(ValidateFlags(map[string]string{"authFile": "team-a/key.json"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authFile": "key.json", "authType": "key"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"authFile": "/etc/key.json"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authFile": "../key.json"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"authFile": "key.json", "authType": "workload-identity"})).NotTo(Succeed())
+		})
+		It("Should Not Take Auth Files From Claims Or Mount Options", func() {
+			Expect(MergeAnnotations(map[string]string{}, map[string]string{"gcs.csi.ofek.dev/auth-file": "team-b/key.json"})).NotTo(HaveKey("authFile"))
+			Expect(MergeMountOptions(map[string]string{}, []string{"--auth-file=team-b/key.json"})).NotTo(HaveKey("authFile"))
+		})
+		It("Should Not Take Auth Types From Claims Or Mount Options", func() {
+			Expect(MergeAnnotations(map[string]string{}, map[string]string{"gcs.csi.ofek.dev/auth-type": "workload-identity"})).NotTo(HaveKey("authType"))
+			Expect(MergeMountOptions(map[string]string{}, []string{"--auth-type=workload-identity"})).NotTo(HaveKey("authType"))
+		})
+		It("Should Validate Bucket Name Templates", func() {
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "${pvc.namespace}-${pvc.name}-${random}"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "data-${pv.name}"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "data"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "${pvc.uid}"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "Data-${random}"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "data_${random}"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "-${random}"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": "goog-${random}"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"bucketNameTemplate": strings.Repeat("x", 63) + "${random}"})).NotTo(Succeed())
+		})
+		It("Should Validate Bucket Names", func() {
+			Expect(ValidateBucketName("team-a_data-1")).To(Succeed())
+			Expect(ValidateBucketName("ab")).NotTo(Succeed())
+			Expect(ValidateBucketName("data-")).NotTo(Succeed())
+			Expect(ValidateBucketName("my.domain.com")).NotTo(Succeed())
+			Expect(ValidateBucketName("my-google-data")).NotTo(Succeed())
+		})
+		It("Should Keep The Cache Within The Cache Root", func() {
+			Expect(ValidateFlags(map[string]string{"cacheDir": "ssd/gcsfuse", "cacheMaxSizeMb": "2048"})).To(Succeed())
+			Expect(ValidateFlags(map[string]string{"cacheDir": "/mnt/disks/ssd"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"cacheDir": "../keys"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"cacheMaxSizeMb": "2GiB"})).NotTo(Succeed())
+			Expect(ValidateFlags(map[string]string{"fuseMountOptions": "cache_dir=/etc"})).NotTo(Succeed())
+		})
+	})
+	Describe("StorageClass Parameters", func() {
+		It("Should Reach Gcsfuse", func() {
+			options := MergeSecret(
+				map[string]string{"bucket": "test"},
+				map[string]string{
+					"implicitDirs":                "true",
+					"statCacheTTL":                "5m",
+					"onlyDir":                     "team-a",
+					"csi.storage.k8s.io/pvc/name": "test",
+				},
+			)
+			Expect(ValidateFlags(options)).To(Succeed())
+			Expect(ExtraFlags(options)).To(Equal([]string{"implicit_dirs", "stat_cache_ttl=5m", "only_dir=team-a"}))
+		})
 	})
 })
@@ -2,6 +2,8 @@ package util
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
@@ -11,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/ofek/csi-gcs/pkg/apis/published-volume/v1beta1"
@@ -18,13 +21,26 @@ import (
 	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
 
+const (
+	// Stamped on buckets created by the driver so that only those get deleted
+	ManagedByLabel      = "managed-by"
+	ManagedByLabelValue = "csi-gcs"
+	// Holds the name of the volume a bucket with a random name was created for
+	VolumeLabel = "csi-gcs-volume"
+	// Lets deleting the volume of a bucket delete its objects as well
+	AllowNonEmptyDeleteLabel = "csi-gcs-allow-non-empty-delete"
+)
+
 func ParseEndpoint(endpoint string) (string, string, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
@@ -86,9 +102,35 @@ func CreateDir(d string) error {
 	return nil
 }
 
+// Keys are only for the driver and the gcsfuse processes it starts, which run as the same user. The directory
+// may be provided by the deployment e.g. as a memory backed emptyDir, so its mode is fixed rather than assumed.
+func prepareKeyStorage(keyStoragePath string) error {
+	if err := os.MkdirAll(keyStoragePath, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(keyStoragePath, 0700)
+}
+
+// Writes the key readable only by its owner, also when the file already exists as a key is written again on remount
+func writeKey(keyFile string, keyContents string) error {
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.WriteString(keyContents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func GetKey(secrets map[string]string, keyStoragePath string) (string, error) {
-	if _, err := os.Stat(keyStoragePath); os.IsNotExist(err) {
-		os.Mkdir(keyStoragePath, 0700)
+	if err := prepareKeyStorage(keyStoragePath); err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to prepare %s for keys: %v", keyStoragePath, err)
 	}
 
 	keyContents, keyNameExists := secrets["key"]
@@ -105,23 +147,94 @@ func GetKey(secrets map[string]string, keyStoragePath string) (string, error) {
 	return keyFile, nil
 }
 
+// The key of a mount is named after its target, which only ever holds one mount, so that it
+// can be found again on unpublish or from the mount table
+func MountKeyFile(keyStoragePath string, targetPath string) string {
+	hash := sha256.Sum256([]byte(targetPath))
+	return filepath.Join(keyStoragePath, hex.EncodeToString(hash[:]))
+}
+
+func GetMountKey(secrets map[string]string, keyStoragePath string, targetPath string) (string, error) {
+	if err := prepareKeyStorage(keyStoragePath); err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to prepare %s for keys: %v", keyStoragePath, err)
+	}
+
+	keyContents, keyNameExists := secrets["key"]
+	if !keyNameExists {
+		return "", status.Errorf(codes.Internal, "Secret '%s' is unavailable", "key")
+	}
+
+	keyFile := MountKeyFile(keyStoragePath, targetPath)
+	klog.V(5).Infof("Saving key contents to %s", keyFile)
+	if err := writeKey(keyFile, keyContents); err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to save secret 'key' to %s", keyStoragePath)
+	}
+
+	return keyFile, nil
+}
+
+// The token of the pod for Workload Identity Federation, beside the key file that refers to it
+func MountTokenFile(keyStoragePath string, targetPath string) string {
+	return MountKeyFile(keyStoragePath, targetPath) + ".token"
+}
+
+func GetMountToken(token string, keyStoragePath string, targetPath string) (string, error) {
+	if err := prepareKeyStorage(keyStoragePath); err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to prepare %s for keys: %v", keyStoragePath, err)
+	}
+
+	tokenFile := MountTokenFile(keyStoragePath, targetPath)
+	klog.V(5).Infof("Saving service account token to %s", tokenFile)
+	if err := writeKey(tokenFile, token); err != nil {
+		return "", status.Errorf(codes.Internal, "Unable to save service account token to %s", keyStoragePath)
+	}
+
+	return tokenFile, nil
+}
+
 func CleanupKey(keyFile string, keyStoragePath string) {
 	location := filepath.Dir(keyFile)
 	if location == keyStoragePath {
-		if err := os.Remove(keyFile); err != nil {
+		if err := os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
 			klog.Warningf("Error removing temporary key file %s: %s", keyFile, err)
 		}
 	}
 }
 
+// Removes every key left behind, for when the driver exits as no mount can be made with them anymore
+func CleanupKeys(keyStoragePath string) {
+	files, err := ioutil.ReadDir(keyStoragePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Error listing temporary key files in %s: %s", keyStoragePath, err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			CleanupKey(filepath.Join(keyStoragePath, file.Name()), keyStoragePath)
+		}
+	}
+}
+
 func BucketName(volumeId string) string {
+	return PrefixedBucketName("", volumeId)
+}
+
+func PrefixedBucketName(prefix string, volumeId string) string {
 	// return volumeId
 	var crc32Hash = crc32.ChecksumIEEE([]byte(volumeId))
 
-	if len(volumeId) > 48 {
-		volumeId = volumeId[0:48]
+	// Leave room for the hash so the name stays within 63 characters
+	maxLength := 48 - len(prefix)
+	if maxLength < 0 {
+		maxLength = 0
 	}
-	return fmt.Sprintf("%s-%x", strings.ToLower(volumeId), crc32Hash)
+	if len(volumeId) > maxLength {
+		volumeId = volumeId[0:maxLength]
+	}
+	return fmt.Sprintf("%s%s-%x", strings.ToLower(prefix), strings.ToLower(volumeId), crc32Hash)
 }
 
 func BucketCapacity(attrs *storage.BucketAttrs) (int64, error) {
@@ -141,6 +254,10 @@ func BucketCapacity(attrs *storage.BucketAttrs) (int64, error) {
 	return 0, nil
 }
 
+func IsManagedBucket(attrs *storage.BucketAttrs) bool {
+	return attrs.Labels[ManagedByLabel] == ManagedByLabelValue
+}
+
 func SetBucketCapacity(ctx context.Context, bucket *storage.BucketHandle, capacity int64) (attrs *storage.BucketAttrs, err error) {
 	var uattrs = storage.BucketAttrsToUpdate{}
 
@@ -185,6 +302,143 @@ func GetPvcAnnotations(pvcName string, pvcNamespace string) (annotations map[str
 	return pvc.ObjectMeta.Annotations, nil
 }
 
+// Records an event on the PersistentVolumeClaim so that `kubectl describe pvc` shows it
+func CreatePvcEvent(pvcName string, pvcNamespace string, eventType string, reason string, message string) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(pvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := metav1.NewTime(time.Now())
+	_, err = clientset.CoreV1().Events(pvcNamespace).Create(&corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pvcName + ".",
+			Namespace:    pvcNamespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "PersistentVolumeClaim",
+			Name:            pvcName,
+			Namespace:       pvcNamespace,
+			UID:             pvc.GetUID(),
+			ResourceVersion: pvc.GetResourceVersion(),
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         corev1.EventSource{Component: "gcs.csi.ofek.dev"},
+	})
+	return err
+}
+
+// Returns nil if the pod has no security context
+func GetPodSecurityContext(podName string, podNamespace string) (securityContext *corev1.PodSecurityContext, err error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pod, err := clientset.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pod.Spec.SecurityContext, nil
+}
+
+// Returns the volume attributes of every PersistentVolume of the driver with the volume handle, as volumes sharing a
+// bucket have the same one
+func GetVolumeAttributes(driverName string, volumeHandle string) (attributes []map[string]string, err error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pvs, err := clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pv := range pvs.Items {
+		if csi := pv.Spec.CSI; csi != nil && csi.Driver == driverName && csi.VolumeHandle == volumeHandle {
+			attributes = append(attributes, csi.VolumeAttributes)
+		}
+	}
+	return attributes, nil
+}
+
+func GetNodePodUIDs(node string) (uids map[string]bool, err error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uids = map[string]bool{}
+	for _, pod := range pods.Items {
+		uids[string(pod.UID)] = true
+	}
+
+	return uids, nil
+}
+
+// Finds the gcsfuse process serving a mount by looking for the target path in its arguments
+func FindGcsfuseProcess(targetPath string) (pid int, err error) {
+	cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, cmdline := range cmdlines {
+		contents, err := ioutil.ReadFile(cmdline)
+		if err != nil || len(contents) == 0 {
+			continue
+		}
+
+		args := strings.Split(strings.TrimRight(string(contents), "\x00"), "\x00")
+		if filepath.Base(args[0]) != "gcsfuse" || args[len(args)-1] != targetPath {
+			continue
+		}
+
+		return strconv.Atoi(filepath.Base(filepath.Dir(cmdline)))
+	}
+
+	return 0, nil
+}
+
 func DeletePod(namespace string, name string) (err error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -218,6 +472,17 @@ func GetRegisteredMounts(node string) (list *v1beta1.PublishedVolumeList, err er
 	})
 }
 
+// Names are unique per mount, a 32-bit checksum of the joined fields could collide between volumes of the same Pod
+func PublishedVolumeName(volumeID string, targetPath string, node string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{volumeID, targetPath, node}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Name of PublishedVolumes registered by releases before PublishedVolumeName, still deleted when their mount is unpublished
+func legacyPublishedVolumeName(volumeID string, targetPath string, node string) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%s-%s", volumeID, targetPath, node)))), 16)
+}
+
 func RegisterMount(volumeID string, targetPath string, node string, podNamespace string, podName string, options map[string]string) (err error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -234,7 +499,7 @@ func RegisterMount(volumeID string, targetPath string, node string, podNamespace
 		return err
 	}
 
-	name := strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%s-%s", volumeID, targetPath, node)))), 16)
+	name := PublishedVolumeName(volumeID, targetPath, node)
 
 	nodeResource, err := coreClientset.CoreV1().Nodes().Get(node, metav1.GetOptions{})
 	if err != nil {
@@ -286,12 +551,21 @@ func UnregisterMount(volumeID string, targetPath string, node string) (err error
 		return err
 	}
 
-	name := strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%s-%s", volumeID, targetPath, node)))), 16)
+	name := PublishedVolumeName(volumeID, targetPath, node)
 
 	delPropPolicy := metav1.DeletePropagationForeground
 	err = clientset.GcsV1beta1().PublishedVolumes().Delete(name, &metav1.DeleteOptions{
 		PropagationPolicy: &delPropPolicy,
 	})
+	if errors.IsNotFound(err) {
+		// Mounts published before an upgrade are registered under the old name
+		legacyErr := clientset.GcsV1beta1().PublishedVolumes().Delete(legacyPublishedVolumeName(volumeID, targetPath, node), &metav1.DeleteOptions{
+			PropagationPolicy: &delPropPolicy,
+		})
+		if !errors.IsNotFound(legacyErr) {
+			err = legacyErr
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -1,10 +1,82 @@
 package util_test
 
 import (
-	// . "github.com/ofek/csi-gcs/pkg/util"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
 	. "github.com/onsi/ginkgo"
-	// . "github.com/onsi/gomega"
+	. "github.com/onsi/gomega"
+
+	. "github.com/ofek/csi-gcs/pkg/util"
 )
 
 var _ = Describe("Common", func() {
+	Describe("PrefixedBucketName", func() {
+		It("Should Match BucketName Without Prefix", func() {
+			Expect(PrefixedBucketName("", "pvc-906ed812")).To(Equal(BucketName("pvc-906ed812")))
+		})
+		It("Should Prepend The Prefix", func() {
+			Expect(PrefixedBucketName("Team-A-", "pvc-906ed812")).To(HavePrefix("team-a-pvc-906ed812-"))
+		})
+		It("Should Fit Within 63 Characters", func() {
+			Expect(len(PrefixedBucketName("team-a-", strings.Repeat("x", 100)))).To(BeNumerically("<=", 63))
+		})
+	})
+	Describe("PublishedVolumeName", func() {
+		It("Should Differ For Volumes Of The Same Pod", func() {
+			targetPath := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/%s/mount"
+			Expect(PublishedVolumeName("bucket-a", fmt.Sprintf(targetPath, "pv-a"), "node")).NotTo(Equal(PublishedVolumeName("bucket-b", fmt.Sprintf(targetPath, "pv-b"), "node")))
+		})
+		It("Should Not Be Ambiguous", func() {
+			Expect(PublishedVolumeName("a-b", "c", "node")).NotTo(Equal(PublishedVolumeName("a", "b-c", "node")))
+		})
+		It("Should Be A Valid Object Name", func() {
+			Expect(PublishedVolumeName("bucket", "/target", "node")).To(MatchRegexp(`^[a-z0-9]{1,253}$`))
+		})
+	})
+	Describe("GetMountKey", func() {
+		var keyStoragePath string
+
+		BeforeEach(func() {
+			tempDir, err := ioutil.TempDir("", "csi-gcs-keys")
+			Expect(err).NotTo(HaveOccurred())
+			keyStoragePath = filepath.Join(tempDir, "keys")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(keyStoragePath))
+		})
+
+		It("Should Only Be Readable By Its Owner", func() {
+			// An emptyDir is world writable
+			Expect(os.Mkdir(keyStoragePath, 0777)).To(Succeed())
+			Expect(os.Chmod(keyStoragePath, 0777)).To(Succeed())
+			keyFile := MountKeyFile(keyStoragePath, "/target")
+			Expect(ioutil.WriteFile(keyFile, []byte("old"), 0644)).To(Succeed())
+
+			_, err := GetMountKey(map[string]string{"key": "{}"}, keyStoragePath, "/target")
+			Expect(err).NotTo(HaveOccurred())
+
+			stat, err := os.Stat(keyStoragePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0700)))
+			stat, err = os.Stat(keyFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			Expect(ioutil.ReadFile(keyFile)).To(Equal([]byte("{}")))
+		})
+		It("Should Be Removed With Every Other Key", func() {
+			keyFile, err := GetMountKey(map[string]string{"key": "{}"}, keyStoragePath, "/target")
+			Expect(err).NotTo(HaveOccurred())
+			otherKeyFile, err := GetKey(map[string]string{"key": "{}"}, keyStoragePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			CleanupKeys(keyStoragePath)
+			Expect(keyFile).NotTo(BeAnExistingFile())
+			Expect(otherKeyFile).NotTo(BeAnExistingFile())
+		})
+	})
 })
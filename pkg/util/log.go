@@ -0,0 +1,153 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// Logs a message followed by key="value" pairs, which JSON output turns into fields
+func InfoS(level klog.Level, msg string, keysAndValues ...interface{}) {
+	if klog.V(level) {
+		klog.InfoDepth(1, FormatStructured(msg, keysAndValues...))
+	}
+}
+
+func FormatStructured(msg string, keysAndValues ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(strconv.Quote(msg))
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], strconv.Quote(fmt.Sprint(value)))
+	}
+
+	return b.String()
+}
+
+// Sends all klog output through a JSONLogWriter, must be called after flags are parsed
+func EnableJSONLogging(w io.Writer) error {
+	for name, value := range map[string]string{"logtostderr": "false", "alsologtostderr": "false", "stderrthreshold": "FATAL"} {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	// klog writes each line to the output of its own severity and all lower ones
+	klog.SetOutputBySeverity("INFO", NewJSONLogWriter(w))
+	klog.SetOutputBySeverity("WARNING", ioutil.Discard)
+	klog.SetOutputBySeverity("ERROR", ioutil.Discard)
+	klog.SetOutputBySeverity("FATAL", ioutil.Discard)
+	return nil
+}
+
+// Lmmdd hh:mm:ss.uuuuuu threadid file:line] msg
+var klogLinePattern = regexp.MustCompile(`(?s)^([IWEF])(\d{4} \d{2}:\d{2}:\d{2}\.\d{6})\s+\d+ ([^\]]+)\] (.*?)\n?$`)
+
+var klogLevels = map[string]string{"I": "info", "W": "warning", "E": "error", "F": "fatal"}
+
+// Turns lines written by klog into JSON objects
+type JSONLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONLogWriter(w io.Writer) *JSONLogWriter {
+	return &JSONLogWriter{w: w}
+}
+
+func (jw *JSONLogWriter) Write(data []byte) (int, error) {
+	entry := map[string]interface{}{}
+
+	match := klogLinePattern.FindStringSubmatch(string(data))
+	if match == nil {
+		entry["msg"] = strings.TrimSuffix(string(data), "\n")
+	} else {
+		entry["level"] = klogLevels[match[1]]
+		entry["ts"] = match[2]
+		entry["caller"] = match[3]
+
+		msg, fields, ok := parseStructured(match[4])
+		if ok {
+			for key, value := range fields {
+				entry[key] = value
+			}
+		} else {
+			msg = match[4]
+		}
+		entry["msg"] = msg
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Parses the output of FormatStructured, ok is false for any other message
+func parseStructured(s string) (msg string, fields map[string]string, ok bool) {
+	msg, rest, ok := cutQuoted(s)
+	if !ok {
+		return "", nil, false
+	}
+
+	fields = map[string]string{}
+	for rest != "" {
+		if !strings.HasPrefix(rest, " ") {
+			return "", nil, false
+		}
+		separator := strings.Index(rest, "=")
+		if separator < 0 {
+			return "", nil, false
+		}
+
+		key := rest[1:separator]
+		value, remaining, ok := cutQuoted(rest[separator+1:])
+		if !ok {
+			return "", nil, false
+		}
+		fields[key] = value
+		rest = remaining
+	}
+
+	return msg, fields, true
+}
+
+// Splits off the Go-quoted string at the start of s
+func cutQuoted(s string) (value string, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", false
+	}
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", false
+			}
+			return value, s[i+1:], true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,57 @@
+package util_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/ofek/csi-gcs/pkg/util"
+)
+
+var _ = Describe("Log", func() {
+	Describe("JSONLogWriter", func() {
+		var (
+			buffer *bytes.Buffer
+			writer *JSONLogWriter
+		)
+
+		BeforeEach(func() {
+			buffer = &bytes.Buffer{}
+			writer = NewJSONLogWriter(buffer)
+		})
+
+		decode := func() map[string]interface{} {
+			entry := map[string]interface{}{}
+			Expect(json.Unmarshal(buffer.Bytes(), &entry)).To(Succeed())
+			return entry
+		}
+
+		It("Should Convert Formatted Lines", func() {
+			_, err := writer.Write([]byte("W1015 08:21:06.123456   12345 node.go:42] Something happened\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decode()).To(Equal(map[string]interface{}{
+				"level":  "warning",
+				"ts":     "1015 08:21:06.123456",
+				"caller": "node.go:42",
+				"msg":    "Something happened",
+			}))
+		})
+		It("Should Turn Key Value Pairs Into Fields", func() {
+			line := "I1015 08:21:06.123456   12345 node.go:42] " + FormatStructured("Mounted volume", "volumeID", "test", "targetPath", `/var/lib/"quoted"`) + "\n"
+			_, err := writer.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+
+			entry := decode()
+			Expect(entry).To(HaveKeyWithValue("msg", "Mounted volume"))
+			Expect(entry).To(HaveKeyWithValue("volumeID", "test"))
+			Expect(entry).To(HaveKeyWithValue("targetPath", `/var/lib/"quoted"`))
+		})
+		It("Should Keep Messages That Merely Start With A Quote", func() {
+			_, err := writer.Write([]byte("I1015 08:21:06.123456   12345 node.go:42] \"foo\" is not structured\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decode()).To(HaveKeyWithValue("msg", `"foo" is not structured`))
+		})
+	})
+})
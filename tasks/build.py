@@ -1,6 +1,6 @@
 from invoke import task
 
-from .utils import EnvVars, get_version
+from .utils import EnvVars, get_commit, get_version
 
 
 @task(
@@ -20,7 +20,10 @@ def build(ctx, release=False):
             f'go build '
             f'-o bin/driver '
             f'-ldflags "all={global_ldflags}" '
-            f'-ldflags "-X github.com/ofek/csi-gcs/pkg/driver.driverVersion={get_version()} {global_ldflags}" '
+            f'-ldflags "'
+            f'-X github.com/ofek/csi-gcs/pkg/driver.driverVersion={get_version()} '
+            f'-X github.com/ofek/csi-gcs/pkg/driver.gitCommit={get_commit()} '
+            f'{global_ldflags}" '
             f'./cmd',
             echo=True,
         )
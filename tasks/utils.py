@@ -40,6 +40,10 @@ def get_version():
     current_ref = subprocess.run(['git', 'rev-list', '-n1', 'HEAD'], stdout=subprocess.PIPE, cwd=get_root())
     return current_ref.stdout.decode('utf-8').strip()
 
+def get_commit():
+    current_ref = subprocess.run(['git', 'rev-parse', 'HEAD'], stdout=subprocess.PIPE, cwd=get_root())
+    return current_ref.stdout.decode('utf-8').strip()
+
 def image_name(version=False):
     if not version:
         version = get_version()
@@ -35,7 +35,18 @@ func TestCsiGcs(t *testing.T) {
 	var endpoint = "unix://"
 	endpoint += endpointFile.Name()
 
-	d, err := driver.NewGCSDriver(driver.CSIDriverName, "test-node", endpoint, "development", false)
+	d, err := driver.NewGCSDriver(driver.Config{
+		Name:                  driver.CSIDriverName,
+		NodeName:              "test-node",
+		Endpoint:              endpoint,
+		Version:               "development",
+		Components:            driver.ComponentAll,
+		KeyStoragePath:        driver.KeyStoragePath,
+		GcsfusePath:           "gcsfuse",
+		MountFailureThreshold: driver.DefaultMountFailureThreshold,
+		MountFailureCooldown:  driver.DefaultMountFailureCooldown,
+		VolumeStatsMaxObjects: driver.DefaultVolumeStatsMaxObjects,
+	})
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)